@@ -7,6 +7,7 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/pachyderm/pachyderm/src/client"
 	healthclient "github.com/pachyderm/pachyderm/src/client/health"
@@ -51,22 +52,32 @@ func init() {
 }
 
 type appEnv struct {
-	Port               uint16 `env:"PORT,default=650"`
-	NumShards          uint64 `env:"NUM_SHARDS,default=32"`
-	StorageRoot        string `env:"PACH_ROOT,default=/pach"`
-	StorageBackend     string `env:"STORAGE_BACKEND,default="`
-	DatabaseAddress    string `env:"RETHINK_PORT_28015_TCP_ADDR,required"`
-	PPSDatabaseName    string `env:"DATABASE_NAME,default=pachyderm_pps"`
-	PFSDatabaseName    string `env:"DATABASE_NAME,default=pachyderm_pfs"`
-	KubeAddress        string `env:"KUBERNETES_PORT_443_TCP_ADDR,required"`
-	EtcdAddress        string `env:"ETCD_PORT_2379_TCP_ADDR,required"`
-	Namespace          string `env:"NAMESPACE,default=default"`
-	Metrics            bool   `env:"METRICS,default=true"`
-	Init               bool   `env:"INIT,default=false"`
-	BlockCacheBytes    int64  `env:"BLOCK_CACHE_BYTES,default=1073741824"` //default = 1 gigabyte
-	JobShimImage       string `env:"JOB_SHIM_IMAGE,default="`
-	JobImagePullPolicy string `env:"JOB_IMAGE_PULL_POLICY,default="`
-	LogLevel           string `env:"LOG_LEVEL,default=info"`
+	Port                             uint16 `env:"PORT,default=650"`
+	NumShards                        uint64 `env:"NUM_SHARDS,default=32"`
+	StorageRoot                      string `env:"PACH_ROOT,default=/pach"`
+	StorageBackend                   string `env:"STORAGE_BACKEND,default="`
+	DatabaseAddress                  string `env:"RETHINK_PORT_28015_TCP_ADDR,required"`
+	PPSDatabaseName                  string `env:"DATABASE_NAME,default=pachyderm_pps"`
+	PFSDatabaseName                  string `env:"DATABASE_NAME,default=pachyderm_pfs"`
+	PFSDatabaseMaxIdle               int    `env:"PFS_DATABASE_MAX_IDLE,default=5"`
+	PFSDatabaseMaxOpen               int    `env:"PFS_DATABASE_MAX_OPEN,default=100"`
+	PFSDatabaseConnectTimeoutSeconds int    `env:"PFS_DATABASE_CONNECT_TIMEOUT_SECONDS,default=5"`
+	PFSDatabaseReadTimeoutSeconds    int    `env:"PFS_DATABASE_READ_TIMEOUT_SECONDS,default=0"`
+	PFSDatabaseWriteTimeoutSeconds   int    `env:"PFS_DATABASE_WRITE_TIMEOUT_SECONDS,default=0"`
+	PFSSlowQueryThresholdMillis      int    `env:"PFS_SLOW_QUERY_THRESHOLD_MILLIS,default=1000"`
+	PFSFileTypeCacheSize             int    `env:"PFS_FILE_TYPE_CACHE_SIZE,default=10000"`
+	PFSBlockCacheBytes               int64  `env:"PFS_BLOCK_CACHE_BYTES,default=0"`
+	PFSDedupBlocks                   bool   `env:"PFS_DEDUP_BLOCKS,default=false"`
+	PFSVerifyBlocks                  bool   `env:"PFS_VERIFY_BLOCKS,default=false"`
+	KubeAddress                      string `env:"KUBERNETES_PORT_443_TCP_ADDR,required"`
+	EtcdAddress                      string `env:"ETCD_PORT_2379_TCP_ADDR,required"`
+	Namespace                        string `env:"NAMESPACE,default=default"`
+	Metrics                          bool   `env:"METRICS,default=true"`
+	Init                             bool   `env:"INIT,default=false"`
+	BlockCacheBytes                  int64  `env:"BLOCK_CACHE_BYTES,default=1073741824"` //default = 1 gigabyte
+	JobShimImage                     string `env:"JOB_SHIM_IMAGE,default="`
+	JobImagePullPolicy               string `env:"JOB_IMAGE_PULL_POLICY,default="`
+	LogLevel                         string `env:"LOG_LEVEL,default=info"`
 }
 
 func main() {
@@ -95,7 +106,7 @@ func do(appEnvObj interface{}) error {
 		if err := persist_server.InitDBs(rethinkAddress, appEnv.PPSDatabaseName); err != nil {
 			return err
 		}
-		return pfs_persist.InitDB(rethinkAddress, appEnv.PFSDatabaseName)
+		return pfs_persist.EnsureDB(rethinkAddress, appEnv.PFSDatabaseName, "", time.Duration(appEnv.PFSDatabaseConnectTimeoutSeconds)*time.Second, time.Duration(appEnv.PFSDatabaseReadTimeoutSeconds)*time.Second)
 	}
 	if readinessCheck {
 		c, err := client.NewFromAddress("127.0.0.1:650")
@@ -248,7 +259,18 @@ func getKubeClient(env *appEnv) (*kube.Client, error) {
 
 func getPFSDriver(address string, env *appEnv) (drive.Driver, error) {
 	rethinkAddress := fmt.Sprintf("%s:28015", env.DatabaseAddress)
-	return pfs_persist.NewDriver(address, rethinkAddress, env.PFSDatabaseName)
+	return pfs_persist.NewDriver(address, rethinkAddress, env.PFSDatabaseName, &pfs_persist.DriverOptions{
+		MaxIdle:            env.PFSDatabaseMaxIdle,
+		MaxOpen:            env.PFSDatabaseMaxOpen,
+		ConnectTimeout:     time.Duration(env.PFSDatabaseConnectTimeoutSeconds) * time.Second,
+		ReadTimeout:        time.Duration(env.PFSDatabaseReadTimeoutSeconds) * time.Second,
+		WriteTimeout:       time.Duration(env.PFSDatabaseWriteTimeoutSeconds) * time.Second,
+		SlowQueryThreshold: time.Duration(env.PFSSlowQueryThresholdMillis) * time.Millisecond,
+		FileTypeCacheSize:  env.PFSFileTypeCacheSize,
+		BlockCacheBytes:    env.PFSBlockCacheBytes,
+		DedupBlocks:        env.PFSDedupBlocks,
+		VerifyBlocks:       env.PFSVerifyBlocks,
+	})
 }
 
 func getRethinkAPIServer(env *appEnv) (persist.APIServer, error) {
@@ -0,0 +1,78 @@
+package pfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+
+	"github.com/pachyderm/pachyderm/src/client/pfs"
+)
+
+// BlockSize is the size past which the content of a PutBlock is split into
+// another block, at the next delimiter.
+const BlockSize = 8 * 1024 * 1024 // 8 Megabytes
+
+// ReadBlock reads the next block from reader, splitting the content the way
+// the block servers do, and returns a reference to the block along with its
+// content.  The reference identifies the block by the hash of its content.
+// decoder must decode from reader; it's only used for JSON delimiters.
+func ReadBlock(delimiter pfs.Delimiter, reader *bufio.Reader, decoder *json.Decoder) (*pfs.BlockRef, []byte, error) {
+	var buffer bytes.Buffer
+	var bytesWritten int
+	hash := sha512.New()
+	EOF := false
+	var value []byte
+
+	for !EOF {
+		var err error
+		if delimiter == pfs.Delimiter_JSON {
+			var jsonValue json.RawMessage
+			err = decoder.Decode(&jsonValue)
+			value = jsonValue
+		} else if delimiter == pfs.Delimiter_NONE {
+			value = make([]byte, 1000)
+			n, e := reader.Read(value)
+			err = e
+			value = value[:n]
+		} else {
+			value, err = reader.ReadBytes('\n')
+		}
+		if err != nil {
+			if err == io.EOF {
+				EOF = true
+			} else {
+				return nil, nil, err
+			}
+		}
+		buffer.Write(value)
+		hash.Write(value)
+		bytesWritten += len(value)
+		if bytesWritten > BlockSize && delimiter != pfs.Delimiter_NONE {
+			break
+		}
+	}
+
+	return &pfs.BlockRef{
+		Block: &pfs.Block{
+			Hash: encodeBlockHash(hash.Sum(nil)),
+		},
+		Range: &pfs.ByteRange{
+			Lower: 0,
+			Upper: uint64(buffer.Len()),
+		},
+	}, buffer.Bytes(), nil
+}
+
+// HashBlock returns the hash that identifies a block with the given content,
+// the same one that ReadBlock returns.
+func HashBlock(data []byte) string {
+	sum := sha512.Sum512(data)
+	return encodeBlockHash(sum[:])
+}
+
+func encodeBlockHash(sum []byte) string {
+	return base64.URLEncoding.EncodeToString(sum)
+}
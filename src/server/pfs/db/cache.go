@@ -0,0 +1,114 @@
+package persist
+
+import (
+	"sync"
+
+	"github.com/pachyderm/pachyderm/src/server/pfs/db/persist"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// fileTypeKey identifies a path within a commit.  CommitID is the database
+// primary key of the commit, not a branch name.
+type fileTypeKey struct {
+	Repo     string
+	CommitID string
+	Path     string
+}
+
+// fileTypeCache is an LRU cache of the file types of paths, so that we don't
+// have to go to the database every time we check for a type conflict.
+// It's safe for concurrent access.
+type fileTypeCache struct {
+	lock  sync.Mutex
+	size  int
+	cache *lru.Cache
+}
+
+func newFileTypeCache(size int) *fileTypeCache {
+	return &fileTypeCache{
+		size:  size,
+		cache: lru.New(size),
+	}
+}
+
+func (c *fileTypeCache) get(repo string, commitID string, path string) (persist.FileType, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	value, ok := c.cache.Get(fileTypeKey{repo, commitID, path})
+	if !ok {
+		return persist.FileType_NONE, false
+	}
+	return value.(persist.FileType), true
+}
+
+func (c *fileTypeCache) add(repo string, commitID string, path string, typ persist.FileType) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cache.Add(fileTypeKey{repo, commitID, path}, typ)
+}
+
+func (c *fileTypeCache) remove(repo string, commitID string, path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cache.Remove(fileTypeKey{repo, commitID, path})
+}
+
+// purge removes all entries from the cache.  It's used when a commit's
+// content changes in ways that we can't track path by path, e.g. when the
+// commit is deleted.
+func (c *fileTypeCache) purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cache = lru.New(c.size)
+}
+
+// blockCache is an LRU cache of the content of blocks, keyed by their hash,
+// so that blocks read repeatedly aren't fetched from the block server every
+// time.  Blocks never change, so cached content never goes stale.  The
+// cache holds at most size bytes.  It's safe for concurrent access.
+type blockCache struct {
+	lock  sync.Mutex
+	size  int64
+	used  int64
+	cache *lru.Cache
+}
+
+func newBlockCache(size int64) *blockCache {
+	c := &blockCache{
+		size:  size,
+		cache: lru.New(0),
+	}
+	c.cache.OnEvicted = func(key lru.Key, value interface{}) {
+		c.used -= int64(len(value.([]byte)))
+	}
+	return c
+}
+
+func (c *blockCache) get(hash string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	value, ok := c.cache.Get(hash)
+	if !ok {
+		return nil, false
+	}
+	return value.([]byte), true
+}
+
+// add caches the content of a block, evicting the least recently used
+// blocks to make room for it.  Blocks larger than the cache aren't cached.
+func (c *blockCache) add(hash string, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if int64(len(data)) > c.size {
+		return
+	}
+	if _, ok := c.cache.Get(hash); ok {
+		return
+	}
+	c.cache.Add(hash, data)
+	c.used += int64(len(data))
+	for c.used > c.size {
+		c.cache.RemoveOldest()
+	}
+}
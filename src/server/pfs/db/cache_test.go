@@ -0,0 +1,90 @@
+package persist
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/pachyderm/pachyderm/src/client/pfs"
+	"github.com/pachyderm/pachyderm/src/client/pkg/require"
+	"github.com/pachyderm/pachyderm/src/server/pfs/db/persist"
+)
+
+func TestBlockCache(t *testing.T) {
+	cache := newBlockCache(10)
+	cache.add("a", []byte("0123"))
+	cache.add("b", []byte("4567"))
+	// Too big to be cached
+	cache.add("c", []byte("0123456789a"))
+	_, ok := cache.get("c")
+	require.False(t, ok)
+
+	// Reading a makes b the least recently used block, so b is evicted to
+	// make room for d and e
+	data, ok := cache.get("a")
+	require.True(t, ok)
+	require.Equal(t, "0123", string(data))
+	cache.add("d", []byte("89"))
+	cache.add("e", []byte("ab"))
+	_, ok = cache.get("b")
+	require.False(t, ok)
+	for _, hash := range []string{"a", "d", "e"} {
+		_, ok := cache.get(hash)
+		require.True(t, ok)
+	}
+	require.Equal(t, int64(8), cache.used)
+}
+
+func TestFileReaderBlockCache(t *testing.T) {
+	blockClient := &fakeBlockClient{
+		blocks: map[string][]byte{
+			"a": []byte("0123456789"),
+		},
+	}
+	d := &driver{blockClient: blockClient, blockCache: newBlockCache(100)}
+	blockRefs := []*persist.BlockRef{{Hash: "a", Lower: 2, Upper: 6}}
+	for i := 0; i < 3; i++ {
+		data, err := ioutil.ReadAll(d.newFileReader(blockRefs, &pfs.File{Path: "file"}, 0, 0))
+		require.NoError(t, err)
+		require.Equal(t, "2345", string(data))
+	}
+	// The whole block is fetched once
+	require.Equal(t, 1, len(blockClient.requests))
+	require.Equal(t, uint64(0), blockClient.requests[0].SizeBytes)
+
+	data := make([]byte, 2)
+	_, err := newFileReaderAt(blockClient, d.blockCache, blockRefs, false).ReadAt(data, 1)
+	require.NoError(t, err)
+	require.Equal(t, "34", string(data))
+	require.Equal(t, 1, len(blockClient.requests))
+}
+
+func BenchmarkFileReaderBlockCache(b *testing.B) {
+	benchmarkFileReader(b, newBlockCache(1<<20))
+}
+
+func BenchmarkFileReaderNoBlockCache(b *testing.B) {
+	benchmarkFileReader(b, nil)
+}
+
+// benchmarkFileReader repeatedly reads a file made of 100 blocks, and
+// reports the number of GetBlock calls per read.
+func benchmarkFileReader(b *testing.B, cache *blockCache) {
+	blockClient := &fakeBlockClient{
+		blocks: make(map[string][]byte),
+	}
+	var blockRefs []*persist.BlockRef
+	for i := 0; i < 100; i++ {
+		hash := fmt.Sprintf("block%d", i)
+		blockClient.blocks[hash] = make([]byte, 1024)
+		blockRefs = append(blockRefs, &persist.BlockRef{Hash: hash, Upper: 1024})
+	}
+	d := &driver{blockClient: blockClient, blockCache: cache}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := ioutil.ReadAll(d.newFileReader(blockRefs, &pfs.File{Path: "file"}, 0, 0))
+		require.NoError(b, err)
+	}
+	b.ReportMetric(float64(len(blockClient.requests))/float64(b.N), "GetBlocks/op")
+}
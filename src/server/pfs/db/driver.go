@@ -1,16 +1,22 @@
 package persist
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
+	"path"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pachyderm/pachyderm/src/client"
@@ -23,9 +29,13 @@ import (
 	"github.com/dancannon/gorethink"
 	"github.com/gogo/protobuf/proto"
 	"go.pedge.io/lion"
+	"go.pedge.io/lion/proto"
 	"go.pedge.io/pb/go/google/protobuf"
+	"go.pedge.io/proto/stream"
 	"go.pedge.io/proto/time"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 // A Table is a rethinkdb table name.
@@ -38,10 +48,41 @@ const (
 	repoTable   Table = "Repos"
 	diffTable   Table = "Diffs"
 	commitTable Table = "Commits"
-
-	connectTimeoutSeconds = 5
-	maxIdle               = 5
-	maxOpen               = 100
+	metaTable   Table = "Meta"
+
+	// SchemaVersion is the version of the database schema that this driver
+	// reads and writes.  It must be bumped whenever a change to the tables
+	// or indexes requires existing databases to be migrated.
+	SchemaVersion = 1
+	// schemaVersionID is the primary key of the document in the meta table
+	// that records the schema version of the database
+	schemaVersionID = "SchemaVersion"
+
+	maxRepoNameLength = 64
+	// healthCheckTimeout bounds how long Health waits for the dependencies
+	// of the driver
+	healthCheckTimeout = 2 * time.Second
+	// DefaultConnectTimeout is the default timeout for connecting to
+	// rethinkdb
+	DefaultConnectTimeout = 5 * time.Second
+	// DefaultMaxIdle is the default number of idle connections kept in the
+	// rethinkdb connection pool
+	DefaultMaxIdle = 5
+	// DefaultMaxOpen is the default maximum number of open connections in the
+	// rethinkdb connection pool
+	DefaultMaxOpen = 100
+	// DefaultFileTypeCacheSize is the default number of file types that the
+	// driver caches
+	DefaultFileTypeCacheSize = 10000
+	// DefaultSlowQueryThreshold is the default duration after which a
+	// driver operation is logged as slow
+	DefaultSlowQueryThreshold = time.Second
+	// defaultCommitRetryInitialInterval, defaultCommitRetryMaxInterval and
+	// defaultCommitRetryMaxAttempts control how StartCommit backs off when
+	// it races with other commits on the same branch
+	defaultCommitRetryInitialInterval = 10 * time.Millisecond
+	defaultCommitRetryMaxInterval     = time.Second
+	defaultCommitRetryMaxAttempts     = 32
 )
 
 const (
@@ -49,11 +90,18 @@ const (
 	ErrConflictFileTypeMsg = "file type conflict"
 )
 
+var (
+	// ErrReaderClosed is returned when reading from a file reader that has
+	// been closed
+	ErrReaderClosed = errors.New("reader closed")
+)
+
 var (
 	tables = []Table{
 		repoTable,
 		commitTable,
 		diffTable,
+		metaTable,
 	}
 
 	tableToTableCreateOpts = map[Table][]gorethink.TableCreateOpts{
@@ -72,34 +120,289 @@ var (
 				PrimaryKey: "ID",
 			},
 		},
+		metaTable: []gorethink.TableCreateOpts{
+			gorethink.TableCreateOpts{
+				PrimaryKey: "ID",
+			},
+		},
 	}
 )
 
+// schemaVersion is the document that records the schema version of a
+// database.
+type schemaVersion struct {
+	ID      string
+	Version int
+}
+
+// Reporter is notified of the duration and outcome of every driver
+// operation, e.g. to export them as metrics.
+type Reporter interface {
+	ReportDuration(method string, d time.Duration, err error)
+}
+
+// driver is a drive.Driver that keeps all metadata in RethinkDB.  It is not
+// sharded: every pachd reads and writes the same tables, so any of them can
+// serve any request, and the driver doesn't implement shard.Server.  The
+// shard filters passed to reads partition files and blocks among the
+// clients that read them, e.g. the pods of a job; they're unrelated to the
+// shards that the sharder assigns to pachds.
 type driver struct {
 	blockClient pfs.BlockAPIClient
 	dbName      string
+	tablePrefix string
 	dbClient    *gorethink.Session
+	fileTypes   *fileTypeCache
+	// blockCache is nil if blocks aren't cached
+	blockCache *blockCache
+	staged     *stagedWrites
+	reporter   Reporter
+
+	// dedupBlocks is set if content is hashed locally so that blocks that
+	// the block server already has aren't uploaded again.
+	dedupBlocks bool
+	// verifyBlocks is set if the content of blocks is checked against their
+	// hashes when files are read.
+	verifyBlocks bool
+	// writeTimeout bounds how long a write to the database may take; zero
+	// means no bound.
+	writeTimeout time.Duration
+	// slowQueryThreshold is how long an operation may take before it's
+	// logged as slow; zero means operations are never logged.
+	slowQueryThreshold time.Duration
+
+	commitRetryInitialInterval time.Duration
+	commitRetryMaxInterval     time.Duration
+	commitRetryMaxAttempts     int
 }
 
-// NewDriver is used to create a new Driver instance
-func NewDriver(blockAddress string, dbAddress string, dbName string) (drive.Driver, error) {
-	clientConn, err := grpc.Dial(blockAddress, grpc.WithInsecure())
+// DriverOptions are the optional settings of a driver.  The zero value of
+// each field picks its default, so a nil *DriverOptions gives a driver with
+// all the defaults.
+type DriverOptions struct {
+	// TablePrefix is prepended to the names of the tables that the driver
+	// uses, so that multiple PFS instances can share a database; it must
+	// match the prefix passed to InitDB.  Defaults to no prefix.
+	TablePrefix string
+	// MaxIdle and MaxOpen size the rethinkdb connection pool; non-positive
+	// values fall back to DefaultMaxIdle and DefaultMaxOpen respectively.
+	MaxIdle int
+	MaxOpen int
+	// ConnectTimeout and ReadTimeout bound connecting to and reading from
+	// rethinkdb; see dbConnect for their defaults.
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	// WriteTimeout bounds each write to rethinkdb, so that a slow database
+	// can't block PutFile, StartCommit and the like indefinitely.  Writes
+	// that take longer fail with an ErrWriteTimeout.  A non-positive value
+	// means no bound.  Unlike ReadTimeout, it doesn't apply to the reads that
+	// wait on changefeeds, which may legitimately take arbitrarily long.
+	WriteTimeout time.Duration
+	// SlowQueryThreshold is how long a driver operation may take before it's
+	// logged as slow, along with the repo, commit and path that it was on.
+	// Zero falls back to DefaultSlowQueryThreshold, and a negative value
+	// disables the log.
+	SlowQueryThreshold time.Duration
+	// FileTypeCacheSize is the number of file types cached by the driver; a
+	// non-positive value falls back to DefaultFileTypeCacheSize.
+	FileTypeCacheSize int
+	// BlockCacheBytes is the number of bytes of block content cached by the
+	// driver, so that blocks that are read repeatedly are only fetched from
+	// the block server once.  Cached blocks are fetched whole, even when only
+	// part of them is read.  A non-positive value disables the cache.
+	BlockCacheBytes int64
+	// If DedupBlocks is set, the content of files is split into blocks and
+	// hashed by the driver, and only the blocks that the block server doesn't
+	// already have are uploaded.  That saves bandwidth on repeated content at
+	// the cost of hashing it before the upload.  Off by default.
+	DedupBlocks bool
+	// If VerifyBlocks is set, every block read is fetched whole and checked
+	// against its hash, and reads of corrupted blocks fail with an
+	// ErrBlockCorrupted.  That costs the CPU to hash the blocks, and the
+	// bandwidth to fetch the parts of them that aren't read.  Off by default.
+	VerifyBlocks bool
+	// Reporter, if not nil, is told how long each driver operation took.
+	Reporter Reporter
+	// DialOptions are used when connecting to the block server, e.g. to
+	// supply transport or per-RPC credentials.  If none are given, the
+	// connection is insecure.
+	DialOptions []grpc.DialOption
+}
+
+// NewDriver is used to create a new Driver instance.  opts may be nil, in
+// which case the defaults described in DriverOptions are used.
+func NewDriver(blockAddress string, dbAddress string, dbName string, opts *DriverOptions) (drive.Driver, error) {
+	if opts == nil {
+		opts = &DriverOptions{}
+	}
+	if err := validateTablePrefix(opts.TablePrefix); err != nil {
+		return nil, err
+	}
+	dialOptions := opts.DialOptions
+	if len(dialOptions) == 0 {
+		dialOptions = []grpc.DialOption{grpc.WithInsecure()}
+	}
+	clientConn, err := grpc.Dial(blockAddress, dialOptions...)
 	if err != nil {
 		return nil, err
 	}
 
-	dbClient, err := DbConnect(dbAddress)
+	dbClient, err := dbConnect(dbAddress, opts.MaxIdle, opts.MaxOpen, opts.ConnectTimeout, opts.ReadTimeout)
 	if err != nil {
 		return nil, err
 	}
+	if err := verifyIndexes(dbClient, dbName, opts.TablePrefix); err != nil {
+		dbClient.Close()
+		return nil, err
+	}
+	if err := verifySchemaVersion(dbClient, dbName, opts.TablePrefix); err != nil {
+		dbClient.Close()
+		return nil, err
+	}
+
+	fileTypeCacheSize := opts.FileTypeCacheSize
+	if fileTypeCacheSize <= 0 {
+		fileTypeCacheSize = DefaultFileTypeCacheSize
+	}
+	slowQueryThreshold := opts.SlowQueryThreshold
+	if slowQueryThreshold == 0 {
+		slowQueryThreshold = DefaultSlowQueryThreshold
+	} else if slowQueryThreshold < 0 {
+		slowQueryThreshold = 0
+	}
+	var cache *blockCache
+	if opts.BlockCacheBytes > 0 {
+		cache = newBlockCache(opts.BlockCacheBytes)
+	}
 
 	return &driver{
-		blockClient: pfs.NewBlockAPIClient(clientConn),
-		dbName:      dbName,
-		dbClient:    dbClient,
+		blockClient:  pfs.NewBlockAPIClient(clientConn),
+		dbName:       dbName,
+		tablePrefix:  opts.TablePrefix,
+		dbClient:     dbClient,
+		fileTypes:    newFileTypeCache(fileTypeCacheSize),
+		blockCache:   cache,
+		staged:       newStagedWrites(),
+		dedupBlocks:  opts.DedupBlocks,
+		verifyBlocks: opts.VerifyBlocks,
+		writeTimeout: opts.WriteTimeout,
+		reporter:     opts.Reporter,
+
+		slowQueryThreshold: slowQueryThreshold,
+
+		commitRetryInitialInterval: defaultCommitRetryInitialInterval,
+		commitRetryMaxInterval:     defaultCommitRetryMaxInterval,
+		commitRetryMaxAttempts:     defaultCommitRetryMaxAttempts,
 	}, nil
 }
 
+// verifyIndexes returns an error naming the indexes in Indexes that are
+// missing from the database, e.g. because it was initialized by an older
+// version of PFS.  Without them, queries would fail with confusing errors.
+func verifyIndexes(session *gorethink.Session, dbName string, tablePrefix string) error {
+	tableToIndexes := make(map[Table]map[string]bool)
+	var missing []string
+	for _, someIndex := range Indexes {
+		indexes, ok := tableToIndexes[someIndex.Table]
+		if !ok {
+			cursor, err := gorethink.DB(dbName).Table(prefixTable(tablePrefix, someIndex.Table)).IndexList().Run(session)
+			if err != nil {
+				return err
+			}
+			var names []string
+			err = cursor.All(&names)
+			cursor.Close()
+			if err != nil {
+				return err
+			}
+			indexes = make(map[string]bool)
+			for _, name := range names {
+				indexes[name] = true
+			}
+			tableToIndexes[someIndex.Table] = indexes
+		}
+		if !indexes[someIndex.Name] {
+			missing = append(missing, fmt.Sprintf("%s.%s", prefixTable(tablePrefix, someIndex.Table), someIndex.Name))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("database %s is missing the following indexes, which EnsureDB creates: %v", dbName, missing)
+	}
+	return nil
+}
+
+// verifySchemaVersion returns an error if the database wasn't stamped with
+// the schema version that this driver supports.
+func verifySchemaVersion(session *gorethink.Session, dbName string, tablePrefix string) error {
+	cursor, err := gorethink.DB(dbName).Table(prefixTable(tablePrefix, metaTable)).Get(schemaVersionID).Run(session)
+	if err != nil {
+		return fmt.Errorf("could not read the schema version of database %s: %v", dbName, err)
+	}
+	defer cursor.Close()
+	if cursor.IsNil() {
+		return fmt.Errorf("database %s has no schema version; it was initialized by an older version of PFS, and EnsureDB stamps it", dbName)
+	}
+	version := &schemaVersion{}
+	if err := cursor.One(version); err != nil {
+		return err
+	}
+	if version.Version != SchemaVersion {
+		return fmt.Errorf("database %s has schema version %d, but this version of PFS only supports schema version %d", dbName, version.Version, SchemaVersion)
+	}
+	return nil
+}
+
+// stampSchemaVersion records SchemaVersion in the database, unless it
+// already records a schema version.
+func stampSchemaVersion(session *gorethink.Session, dbName string, tablePrefix string) error {
+	_, err := gorethink.DB(dbName).Table(prefixTable(tablePrefix, metaTable)).Get(schemaVersionID).Replace(func(old gorethink.Term) gorethink.Term {
+		return gorethink.Branch(old.Eq(nil), gorethink.Expr(&schemaVersion{
+			ID:      schemaVersionID,
+			Version: SchemaVersion,
+		}), old)
+	}).RunWrite(session)
+	return err
+}
+
+// report tells the reporter, if any, how long a driver operation took, and
+// logs the operation if it took longer than the slow query threshold.
+// keyValues identify what the operation was on, e.g. its repo and commit.
+func (d *driver) report(method string, start time.Time, err error, keyValues ...interface{}) {
+	duration := time.Since(start)
+	if d.slowQueryThreshold > 0 && duration > d.slowQueryThreshold {
+		keyValues = append([]interface{}{"method", method, "duration", duration.String()}, keyValues...)
+		if err != nil {
+			keyValues = append(keyValues, "error", err.Error())
+		}
+		protolion.WithKeyValues(keyValues...).Warnf("slow driver operation")
+	}
+	if d.reporter == nil {
+		return
+	}
+	d.reporter.ReportDuration(method, duration, err)
+}
+
+func repoKeyValues(repo *pfs.Repo) []interface{} {
+	if repo == nil {
+		return nil
+	}
+	return []interface{}{"repo", repo.Name}
+}
+
+func commitKeyValues(commit *pfs.Commit) []interface{} {
+	if commit == nil {
+		return nil
+	}
+	return append(repoKeyValues(commit.Repo), "commit", commit.ID)
+}
+
+func fileKeyValues(file *pfs.File) []interface{} {
+	if file == nil {
+		return nil
+	}
+	return append(commitKeyValues(file.Commit), "path", file.Path)
+}
+
 // isDBCreated is used to tell when we are trying to initialize a database,
 // whether we are getting an error because the database has already been
 // initialized.
@@ -107,24 +410,78 @@ func isDBCreated(err error) bool {
 	return strings.Contains(err.Error(), "Database") && strings.Contains(err.Error(), "already exists")
 }
 
-//InitDB is used to setup the database with the tables and indices that PFS requires
-func InitDB(address string, dbName string) error {
-	session, err := DbConnect(address)
+// isTableCreated is the same as isDBCreated, except for tables.
+func isTableCreated(err error) bool {
+	return strings.Contains(err.Error(), "Table") && strings.Contains(err.Error(), "already exists")
+}
+
+// isIndexCreated is the same as isDBCreated, except for indexes.
+func isIndexCreated(err error) bool {
+	return strings.Contains(err.Error(), "Index") && strings.Contains(err.Error(), "already exists")
+}
+
+// isDBRemoved is used to tell when we are trying to remove tables, whether we
+// are getting an error because the database or the table doesn't exist.
+func isDBRemoved(err error) bool {
+	return (strings.Contains(err.Error(), "Database") || strings.Contains(err.Error(), "Table")) && strings.Contains(err.Error(), "does not exist")
+}
+
+// validateTablePrefix makes sure that the prefixed table names are valid
+// rethinkdb table names.
+func validateTablePrefix(tablePrefix string) error {
+	match, _ := regexp.MatchString("^[a-zA-Z0-9_]*$", tablePrefix)
+
+	if !match {
+		return fmt.Errorf("table prefix (%v) invalid: only alphanumeric and underscore characters allowed", tablePrefix)
+	}
+
+	return nil
+}
+
+// prefixTable returns the name of a table under the given prefix.
+func prefixTable(tablePrefix string, table Table) Table {
+	if tablePrefix == "" {
+		return table
+	}
+	return Table(tablePrefix + "_" + string(table))
+}
+
+// InitDB is used to setup the database with the tables and indices that PFS requires
+// The names of the tables are prefixed with tablePrefix, which may be empty.
+// The database is stamped with SchemaVersion, which NewDriver checks.
+func InitDB(address string, dbName string, tablePrefix string, connectTimeout time.Duration, readTimeout time.Duration) error {
+	if err := validateTablePrefix(tablePrefix); err != nil {
+		return err
+	}
+	session, err := dbConnect(address, DefaultMaxIdle, DefaultMaxOpen, connectTimeout, readTimeout)
 	if err != nil {
 		return err
 	}
 	defer session.Close()
 
-	return initDB(session, dbName)
+	return initDB(session, dbName, tablePrefix)
 }
 
-func initDB(session *gorethink.Session, dbName string) error {
+func initDB(session *gorethink.Session, dbName string, tablePrefix string) error {
 	_, err := gorethink.DBCreate(dbName).RunWrite(session)
 	if err != nil && !isDBCreated(err) {
 		return err
 	} else if err != nil && isDBCreated(err) {
-		// This function has already run so we abort.
-		return nil
+		// The database might be shared by PFS instances with different
+		// prefixes, so we only abort if this function has already run with
+		// this prefix.
+		cursor, err := gorethink.DB(dbName).TableList().Contains(prefixTable(tablePrefix, repoTable)).Run(session)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+		var initialized bool
+		if err := cursor.One(&initialized); err != nil {
+			return err
+		}
+		if initialized {
+			return nil
+		}
 	}
 
 	// There is a race here
@@ -144,7 +501,7 @@ func initDB(session *gorethink.Session, dbName string) error {
 	for _, table := range tables {
 		backoff.RetryNotify(func() error {
 			tableCreateOpts := tableToTableCreateOpts[table]
-			_, err := gorethink.DB(dbName).TableCreate(table, tableCreateOpts...).RunWrite(session)
+			_, err := gorethink.DB(dbName).TableCreate(prefixTable(tablePrefix, table), tableCreateOpts...).RunWrite(session)
 			return err
 		}, config, func(err error, d time.Duration) {
 			lion.Errorf("error creating table %v on database %v; retrying in %s: %v\n", table, dbName, d, err)
@@ -153,32 +510,73 @@ func initDB(session *gorethink.Session, dbName string) error {
 
 	// Create indexes
 	for _, someIndex := range Indexes {
-		if _, err := gorethink.DB(dbName).Table(someIndex.Table).IndexCreateFunc(someIndex.Name, someIndex.CreateFunction, someIndex.CreateOptions).RunWrite(session); err != nil {
+		if _, err := gorethink.DB(dbName).Table(prefixTable(tablePrefix, someIndex.Table)).IndexCreateFunc(someIndex.Name, someIndex.CreateFunction, someIndex.CreateOptions).RunWrite(session); err != nil {
 			return err
 		}
-		if _, err := gorethink.DB(dbName).Table(someIndex.Table).IndexWait(someIndex.Name).RunWrite(session); err != nil {
+		if _, err := gorethink.DB(dbName).Table(prefixTable(tablePrefix, someIndex.Table)).IndexWait(someIndex.Name).RunWrite(session); err != nil {
 			return err
 		}
 	}
-	return nil
+	return stampSchemaVersion(session, dbName, tablePrefix)
+}
+
+// EnsureDB is the same as InitDB, except that it creates whichever of the
+// database, tables and indexes are missing rather than assuming that a
+// database with the tables has been fully set up, and it stamps a database
+// that has no schema version with SchemaVersion.  It's safe to call
+// repeatedly, e.g. from deployment automation, and it finishes setting up a
+// database whose initialization was interrupted.
+func EnsureDB(address string, dbName string, tablePrefix string, connectTimeout time.Duration, readTimeout time.Duration) error {
+	if err := validateTablePrefix(tablePrefix); err != nil {
+		return err
+	}
+	session, err := dbConnect(address, DefaultMaxIdle, DefaultMaxOpen, connectTimeout, readTimeout)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	return ensureDB(session, dbName, tablePrefix)
+}
+
+func ensureDB(session *gorethink.Session, dbName string, tablePrefix string) error {
+	if _, err := gorethink.DBCreate(dbName).RunWrite(session); err != nil && !isDBCreated(err) {
+		return err
+	}
+	for _, table := range tables {
+		tableCreateOpts := tableToTableCreateOpts[table]
+		if _, err := gorethink.DB(dbName).TableCreate(prefixTable(tablePrefix, table), tableCreateOpts...).RunWrite(session); err != nil && !isTableCreated(err) {
+			return err
+		}
+	}
+	for _, someIndex := range Indexes {
+		table := gorethink.DB(dbName).Table(prefixTable(tablePrefix, someIndex.Table))
+		if _, err := table.IndexCreateFunc(someIndex.Name, someIndex.CreateFunction, someIndex.CreateOptions).RunWrite(session); err != nil && !isIndexCreated(err) {
+			return err
+		}
+		if _, err := table.IndexWait(someIndex.Name).RunWrite(session); err != nil {
+			return err
+		}
+	}
+	return stampSchemaVersion(session, dbName, tablePrefix)
 }
 
 // RemoveDB removes the tables in the database that are relavant to PFS
 // It keeps the database around tho, as it might contain other tables that
 // others created (e.g. PPS).
-func RemoveDB(address string, dbName string) error {
-	session, err := DbConnect(address)
+func RemoveDB(address string, dbName string, tablePrefix string, connectTimeout time.Duration, readTimeout time.Duration) error {
+	session, err := dbConnect(address, DefaultMaxIdle, DefaultMaxOpen, connectTimeout, readTimeout)
 	if err != nil {
 		return err
 	}
 	defer session.Close()
 
-	return removeDB(session, dbName)
+	return removeDB(session, dbName, tablePrefix)
 }
 
-func removeDB(session *gorethink.Session, dbName string) error {
+func removeDB(session *gorethink.Session, dbName string, tablePrefix string) error {
 	for _, table := range tables {
-		if _, err := gorethink.DB(dbName).TableDrop(table).RunWrite(session); err != nil {
+		if _, err := gorethink.DB(dbName).TableDrop(prefixTable(tablePrefix, table)).RunWrite(session); err != nil {
 			return err
 		}
 	}
@@ -186,31 +584,150 @@ func removeDB(session *gorethink.Session, dbName string) error {
 	return nil
 }
 
+// RemoveDBIfExists is the same as RemoveDB, except that it's not an error
+// for the database or any of the tables to be missing.
+func RemoveDBIfExists(address string, dbName string, tablePrefix string, connectTimeout time.Duration, readTimeout time.Duration) error {
+	session, err := dbConnect(address, DefaultMaxIdle, DefaultMaxOpen, connectTimeout, readTimeout)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	for _, table := range tables {
+		if _, err := gorethink.DB(dbName).TableDrop(prefixTable(tablePrefix, table)).RunWrite(session); err != nil && !isDBRemoved(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 // DbConnect returns a rethink DB session connected to the provided address
 func DbConnect(address string) (*gorethink.Session, error) {
+	return dbConnect(address, DefaultMaxIdle, DefaultMaxOpen, 0, 0)
+}
+
+// dbConnect is the same as DbConnect, except that it allows the caller to
+// size the connection pool and set timeouts.  A non-positive connectTimeout
+// falls back to DefaultConnectTimeout.  A non-positive readTimeout means that
+// reads never time out, which is what changefeeds (e.g. in FinishCommit)
+// need; a positive readTimeout should be longer than any changefeed is
+// expected to block.
+func dbConnect(address string, maxIdle int, maxOpen int, connectTimeout time.Duration, readTimeout time.Duration) (*gorethink.Session, error) {
+	if maxIdle <= 0 {
+		maxIdle = DefaultMaxIdle
+	}
+	if maxOpen <= 0 {
+		maxOpen = DefaultMaxOpen
+	}
+	if connectTimeout <= 0 {
+		connectTimeout = DefaultConnectTimeout
+	}
+	if readTimeout < 0 {
+		readTimeout = 0
+	}
 	return gorethink.Connect(gorethink.ConnectOpts{
-		Address: address,
-		Timeout: connectTimeoutSeconds * time.Second,
-		MaxIdle: maxIdle,
-		MaxOpen: maxOpen,
+		Address:     address,
+		Timeout:     connectTimeout,
+		ReadTimeout: readTimeout,
+		MaxIdle:     maxIdle,
+		MaxOpen:     maxOpen,
 	})
 }
 
 func validateRepoName(name string) error {
-	match, _ := regexp.MatchString("^[a-zA-Z0-9_]+$", name)
+	// Repo names are part of the primary keys of commits, and rethinkdb
+	// limits the size of primary keys.
+	if len(name) > maxRepoNameLength {
+		return fmt.Errorf("repo name (%v) invalid: repo names can be at most %d characters long", name, maxRepoNameLength)
+	}
+
+	match, _ := regexp.MatchString("^[a-zA-Z0-9_-][a-zA-Z0-9_.-]*$", name)
 
 	if !match {
-		return fmt.Errorf("repo name (%v) invalid: only alphanumeric and underscore characters allowed", name)
+		return fmt.Errorf("repo name (%v) invalid: only alphanumeric, underscore, hyphen and dot characters allowed, and the name cannot start with a dot", name)
 	}
 
 	return nil
 }
 
 func (d *driver) getTerm(table Table) gorethink.Term {
-	return gorethink.DB(d.dbName).Table(table)
+	return gorethink.DB(d.dbName).Table(prefixTable(d.tablePrefix, table))
+}
+
+func (d *driver) Health() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	// The checks run concurrently, so that a dependency that hangs until the
+	// deadline doesn't leave the other one without any time.
+	blockErrCh := make(chan error, 1)
+	go func() {
+		blockErrCh <- d.blockHealth(ctx)
+	}()
+	var unhealthy []string
+	if err := d.dbHealth(ctx); err != nil {
+		unhealthy = append(unhealthy, fmt.Sprintf("rethinkdb: %v", err))
+	}
+	if err := <-blockErrCh; err != nil {
+		unhealthy = append(unhealthy, fmt.Sprintf("block server: %v", err))
+	}
+	if len(unhealthy) > 0 {
+		return fmt.Errorf("unhealthy dependencies: %s", strings.Join(unhealthy, "; "))
+	}
+	return nil
+}
+
+// dbHealth runs a trivial query against rethinkdb.
+func (d *driver) dbHealth(ctx context.Context) error {
+	errCh := make(chan error, 1)
+	go func() {
+		cursor, err := gorethink.DB(d.dbName).TableList().Run(d.dbClient)
+		if err == nil {
+			err = cursor.Close()
+		}
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// blockHealth inspects a block that doesn't exist.  The block server
+// failing to find the block is fine; we only care about whether we can
+// reach it.
+func (d *driver) blockHealth(ctx context.Context) error {
+	_, err := d.blockClient.InspectBlock(ctx, &pfs.InspectBlockRequest{
+		Block: &pfs.Block{Hash: "health"},
+	})
+	switch grpc.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return err
+	}
+	return nil
+}
+
+// repoDocument is a repo as it's stored in the database: a persist.Repo
+// along with the tags attached to it, which aren't a field of persist.Repo
+// because it's generated from a proto.
+type repoDocument struct {
+	persist.Repo
+	Tags map[string]string `gorethink:",omitempty"`
+}
+
+func (d *driver) CreateRepo(repo *pfs.Repo, provenance []*pfs.Repo) (retErr error) {
+	defer func(start time.Time) { d.report("CreateRepo", start, retErr, repoKeyValues(repo)...) }(time.Now())
+	return d.createRepo(repo, provenance, nil)
+}
+
+func (d *driver) CreateRepoWithTags(repo *pfs.Repo, provenance []*pfs.Repo, tags map[string]string) (retErr error) {
+	defer func(start time.Time) { d.report("CreateRepoWithTags", start, retErr, repoKeyValues(repo)...) }(time.Now())
+	return d.createRepo(repo, provenance, tags)
 }
 
-func (d *driver) CreateRepo(repo *pfs.Repo, provenance []*pfs.Repo) error {
+func (d *driver) createRepo(repo *pfs.Repo, provenance []*pfs.Repo, tags map[string]string) error {
 	if repo == nil {
 		return fmt.Errorf("repo cannot be nil")
 	}
@@ -232,6 +749,7 @@ func (d *driver) CreateRepo(repo *pfs.Repo, provenance []*pfs.Repo) error {
 	if err != nil {
 		return err
 	}
+	defer cursor.Close()
 	if err := cursor.One(&numProvenantRepos); err != nil {
 		return err
 	}
@@ -239,17 +757,55 @@ func (d *driver) CreateRepo(repo *pfs.Repo, provenance []*pfs.Repo) error {
 		return fmt.Errorf("could not create repo %v, not all provenance repos exist", repo.Name)
 	}
 
-	_, err = d.getTerm(repoTable).Insert(&persist.Repo{
-		Name:       repo.Name,
-		Created:    now(),
-		Provenance: provenantIDs,
-	}).RunWrite(d.dbClient)
+	_, err = d.runWrite(d.getTerm(repoTable).Insert(&repoDocument{
+		Repo: persist.Repo{
+			Name:       repo.Name,
+			Created:    now(),
+			Provenance: provenantIDs,
+		},
+		Tags: tags,
+	}))
 	if err != nil && gorethink.IsConflictErr(err) {
 		return fmt.Errorf("repo %v exists", repo.Name)
 	}
 	return err
 }
 
+func (d *driver) UpdateRepo(repo *pfs.Repo, tags map[string]string) (retErr error) {
+	defer func(start time.Time) { d.report("UpdateRepo", start, retErr, repoKeyValues(repo)...) }(time.Now())
+	// Literal replaces the tags rather than merging them into the old ones
+	res, err := d.runWrite(d.getTerm(repoTable).Get(repo.Name).Update(map[string]interface{}{
+		"Tags": gorethink.Literal(tags),
+	}))
+	if err != nil {
+		return err
+	}
+	if res.Skipped > 0 {
+		return pfsserver.NewErrRepoNotFound(repo.Name)
+	}
+	return nil
+}
+
+func (d *driver) InspectRepoWithTags(repo *pfs.Repo) (*drive.RepoInfo, error) {
+	repoInfo, err := d.InspectRepo(repo)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := d.getTerm(repoTable).Get(repo.Name).Field("Tags").Default(nil).Run(d.dbClient)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var tags map[string]string
+	if err := cursor.One(&tags); err != nil && err != gorethink.ErrEmptyResult {
+		return nil, err
+	}
+	return &drive.RepoInfo{
+		RepoInfo: repoInfo,
+		Tags:     tags,
+	}, nil
+}
+
 func (d *driver) inspectRepo(repo *pfs.Repo) (r *persist.Repo, retErr error) {
 	defer func() {
 		if retErr == gorethink.ErrEmptyResult {
@@ -260,6 +816,7 @@ func (d *driver) inspectRepo(repo *pfs.Repo) (r *persist.Repo, retErr error) {
 	if err != nil {
 		return nil, err
 	}
+	defer cursor.Close()
 	rawRepo := &persist.Repo{}
 	if err := cursor.One(rawRepo); err != nil {
 		return nil, err
@@ -274,7 +831,8 @@ func (n byName) Len() int           { return len(n) }
 func (n byName) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
 func (n byName) Less(i, j int) bool { return n[i].Name < n[j].Name }
 
-func (d *driver) InspectRepo(repo *pfs.Repo) (*pfs.RepoInfo, error) {
+func (d *driver) InspectRepo(repo *pfs.Repo) (repoInfo *pfs.RepoInfo, retErr error) {
+	defer func(start time.Time) { d.report("InspectRepo", start, retErr, repoKeyValues(repo)...) }(time.Now())
 	rawRepo, err := d.inspectRepo(repo)
 	if err != nil {
 		return nil, err
@@ -306,95 +864,301 @@ func (d *driver) InspectRepo(repo *pfs.Repo) (*pfs.RepoInfo, error) {
 
 	sort.Sort(byName(provenance))
 
+	sizes, err := d.getRepoSizes([]string{rawRepo.Name})
+	if err != nil {
+		return nil, err
+	}
+
 	return &pfs.RepoInfo{
 		Repo: &pfs.Repo{
 			Name: rawRepo.Name,
 		},
 		Created:    rawRepo.Created,
-		SizeBytes:  rawRepo.Size,
+		SizeBytes:  sizes[rawRepo.Name],
 		Provenance: provenance,
 	}, nil
 }
 
-func (d *driver) ListRepo(provenance []*pfs.Repo) (repoInfos []*pfs.RepoInfo, retErr error) {
-	cursor, err := d.getTerm(repoTable).OrderBy("Name").Run(d.dbClient)
+func (d *driver) InspectRepoWithBranchSizes(repo *pfs.Repo) (retRepoInfo *drive.RepoInfo, retErr error) {
+	defer func(start time.Time) {
+		d.report("InspectRepoWithBranchSizes", start, retErr, repoKeyValues(repo)...)
+	}(time.Now())
+	repoInfo, err := d.InspectRepo(repo)
 	if err != nil {
 		return nil, err
 	}
-	var repos []*persist.Repo
-	if err := cursor.All(&repos); err != nil {
+	branches, err := d.ListBranch(repo, pfs.CommitStatus_ALL)
+	if err != nil {
 		return nil, err
 	}
-
-nextRepo:
-	for _, repo := range repos {
-		if len(provenance) != 0 {
-			// Filter out the repos that don't have the given provenance
-			repoInfo, err := d.InspectRepo(&pfs.Repo{Name: repo.Name})
-			if err != nil {
-				return nil, err
-			}
-			for _, p := range provenance {
-				var found bool
-				for _, r := range repoInfo.Provenance {
-					if p.Name == r.Name {
-						found = true
-						break
-					}
-				}
-				if !found {
-					continue nextRepo
-				}
-			}
+	branchSizes := make(map[string]uint64)
+	for _, branch := range branches {
+		commit := &persist.Commit{}
+		if err := d.getHeadOfBranch(repo.Name, branch, commit); err != nil {
+			return nil, err
 		}
-		repoInfos = append(repoInfos, &pfs.RepoInfo{
-			Repo: &pfs.Repo{
-				Name: repo.Name,
-			},
-			Created:   repo.Created,
-			SizeBytes: repo.Size,
-		})
+		branchSizes[branch] = commit.Size
 	}
-
-	return repoInfos, nil
+	numCommits, err := d.getNumCommits([]string{repo.Name})
+	if err != nil {
+		return nil, err
+	}
+	return &drive.RepoInfo{
+		RepoInfo:    repoInfo,
+		BranchSizes: branchSizes,
+		NumCommits:  numCommits[0],
+	}, nil
 }
 
-func (d *driver) DeleteRepo(repo *pfs.Repo, force bool) error {
-	if !force {
-		// Make sure that this repo is not the provenance of any other repo
-		repoInfos, err := d.ListRepo([]*pfs.Repo{repo})
-		if err != nil {
-			return err
-		}
-		if len(repoInfos) > 0 {
-			var repoNames []string
-			for _, repoInfo := range repoInfos {
-				repoNames = append(repoNames, repoInfo.Repo.Name)
-			}
-			return fmt.Errorf("cannot delete repo %v; it's the provenance of the following repos: %v", repo.Name, repoNames)
-		}
+// getNumCommits returns the number of commits in each of the given repos,
+// in the same order.
+func (d *driver) getNumCommits(repoNames []string) ([]uint64, error) {
+	if len(repoNames) == 0 {
+		return nil, nil
 	}
-
-	// Deleting in the order of repo -> commits -> diffs seems to make sense,
-	// since if one can't see the repo, one can't see the commits; if they can't
-	// see the commits, they can't see the diffs.  So in a way we are hiding
-	// potential inconsistency here.
-	_, err := d.getTerm(repoTable).Get(repo.Name).Delete().RunWrite(d.dbClient)
+	cursor, err := gorethink.Expr(repoNames).Map(func(repo gorethink.Term) gorethink.Term {
+		return d.getTerm(commitTable).GetAllByIndex(CommitRepoIndex.Name, repo).Count()
+	}).Run(d.dbClient)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	_, err = d.getTerm(commitTable).Filter(map[string]interface{}{
-		"Repo": repo.Name,
-	}).Delete().RunWrite(d.dbClient)
-	if err != nil {
+	defer cursor.Close()
+	var numCommits []uint64
+	if err := cursor.All(&numCommits); err != nil {
+		return nil, err
+	}
+	return numCommits, nil
+}
+
+// getRepoSizes returns the sizes of the given repos.  The size of a repo is
+// the total size of its finished commits.  We compute it on demand, as opposed
+// to storing it in the repo document, so that finishing a commit only takes
+// a single write.
+func (d *driver) getRepoSizes(repoNames []string) (map[string]uint64, error) {
+	sizes := make(map[string]uint64)
+	if len(repoNames) == 0 {
+		return sizes, nil
+	}
+
+	var keys []interface{}
+	for _, repoName := range repoNames {
+		keys = append(keys, repoName)
+	}
+	cursor, err := d.getTerm(commitTable).GetAllByIndex(CommitRepoIndex.Name, keys...).Filter(func(commit gorethink.Term) gorethink.Term {
+		return commit.Field("Finished").Ne(nil)
+	}).Group("Repo").Sum("Size").Ungroup().Run(d.dbClient)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var groups []struct {
+		Repo string `gorethink:"group"`
+		Size uint64 `gorethink:"reduction"`
+	}
+	if err := cursor.All(&groups); err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		sizes[group.Repo] = group.Size
+	}
+	return sizes, nil
+}
+
+func (d *driver) ListRepo(provenance []*pfs.Repo) (repoInfos []*pfs.RepoInfo, retErr error) {
+	defer func(start time.Time) { d.report("ListRepo", start, retErr) }(time.Now())
+	infos, err := d.listRepo(provenance, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, repoInfo := range infos {
+		repoInfos = append(repoInfos, repoInfo.RepoInfo)
+	}
+	return repoInfos, nil
+}
+
+func (d *driver) ListRepoWithTags(provenance []*pfs.Repo, tags map[string]string) (repoInfos []*drive.RepoInfo, retErr error) {
+	defer func(start time.Time) { d.report("ListRepoWithTags", start, retErr) }(time.Now())
+	return d.listRepo(provenance, tags)
+}
+
+// listRepo returns the repos that have the given provenance and tags, along
+// with all of their tags.
+func (d *driver) listRepo(provenance []*pfs.Repo, tags map[string]string) (repoInfos []*drive.RepoInfo, retErr error) {
+	query := d.getTerm(repoTable)
+	if len(tags) > 0 {
+		// Matching a nested object only compares the fields that it has, so
+		// repos with more tags match too
+		query = query.Filter(map[string]interface{}{
+			"Tags": tags,
+		})
+	}
+	cursor, err := query.OrderBy("Name").Run(d.dbClient)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var repos []*repoDocument
+	if err := cursor.All(&repos); err != nil {
+		return nil, err
+	}
+
+	var repoNames []string
+	for _, repo := range repos {
+		repoNames = append(repoNames, repo.Name)
+	}
+	sizes, err := d.getRepoSizes(repoNames)
+	if err != nil {
+		return nil, err
+	}
+
+nextRepo:
+	for _, repo := range repos {
+		if len(provenance) != 0 {
+			// Filter out the repos that don't have the given provenance
+			repoInfo, err := d.InspectRepo(&pfs.Repo{Name: repo.Name})
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range provenance {
+				var found bool
+				for _, r := range repoInfo.Provenance {
+					if p.Name == r.Name {
+						found = true
+						break
+					}
+				}
+				if !found {
+					continue nextRepo
+				}
+			}
+		}
+		repoInfos = append(repoInfos, &drive.RepoInfo{
+			RepoInfo: &pfs.RepoInfo{
+				Repo: &pfs.Repo{
+					Name: repo.Name,
+				},
+				Created:   repo.Created,
+				SizeBytes: sizes[repo.Name],
+			},
+			Tags: repo.Tags,
+		})
+	}
+
+	return repoInfos, nil
+}
+
+func (d *driver) ListRepoWithNumCommits(provenance []*pfs.Repo) (repoInfos []*drive.RepoInfo, retErr error) {
+	defer func(start time.Time) { d.report("ListRepoWithNumCommits", start, retErr) }(time.Now())
+	infos, err := d.ListRepo(provenance)
+	if err != nil {
+		return nil, err
+	}
+	var repoNames []string
+	for _, repoInfo := range infos {
+		repoNames = append(repoNames, repoInfo.Repo.Name)
+	}
+	numCommits, err := d.getNumCommits(repoNames)
+	if err != nil {
+		return nil, err
+	}
+	for i, repoInfo := range infos {
+		repoInfos = append(repoInfos, &drive.RepoInfo{
+			RepoInfo:   repoInfo,
+			NumCommits: numCommits[i],
+		})
+	}
+	return repoInfos, nil
+}
+
+func (d *driver) DeleteRepo(repo *pfs.Repo, force bool) (retErr error) {
+	defer func(start time.Time) { d.report("DeleteRepo", start, retErr, repoKeyValues(repo)...) }(time.Now())
+	if !force {
+		// Make sure that this repo is not the provenance of any other repo
+		repoInfos, err := d.ListRepo([]*pfs.Repo{repo})
+		if err != nil {
+			return err
+		}
+		if len(repoInfos) > 0 {
+			var repoNames []string
+			for _, repoInfo := range repoInfos {
+				repoNames = append(repoNames, repoInfo.Repo.Name)
+			}
+			return fmt.Errorf("cannot delete repo %v; it's the provenance of the following repos: %v", repo.Name, repoNames)
+		}
+	}
+
+	// Deleting in the order of repo -> commits -> diffs seems to make sense,
+	// since if one can't see the repo, one can't see the commits; if they can't
+	// see the commits, they can't see the diffs.  So in a way we are hiding
+	// potential inconsistency here.
+	_, err := d.runWrite(d.getTerm(repoTable).Get(repo.Name).Delete())
+	if err != nil {
+		return err
+	}
+
+	_, err = d.runWrite(d.getTerm(commitTable).GetAllByIndex(CommitRepoIndex.Name, repo.Name).Delete())
+	if err != nil {
 		return err
 	}
 
-	_, err = d.getTerm(diffTable).Filter(map[string]interface{}{
+	_, err = d.runWrite(d.getTerm(diffTable).Filter(map[string]interface{}{
 		"Repo": repo.Name,
-	}).Delete().RunWrite(d.dbClient)
-	return err
+	}).Delete())
+	if err != nil {
+		return err
+	}
+	// The repo might be recreated, in which case its commits would reuse the
+	// IDs of the deleted commits.
+	d.fileTypes.purge()
+	return nil
+}
+
+func (d *driver) DeleteRepoPreview(repo *pfs.Repo) (deletion *drive.RepoDeletion, retErr error) {
+	defer func(start time.Time) { d.report("DeleteRepoPreview", start, retErr, repoKeyValues(repo)...) }(time.Now())
+	if _, err := d.inspectRepo(repo); err != nil {
+		return nil, err
+	}
+	deletion = &drive.RepoDeletion{}
+	repoInfos, err := d.ListRepo([]*pfs.Repo{repo})
+	if err != nil {
+		return nil, err
+	}
+	for _, repoInfo := range repoInfos {
+		deletion.DependentRepos = append(deletion.DependentRepos, repoInfo.Repo.Name)
+	}
+
+	// These are the same selections that DeleteRepo deletes
+	commits := d.getTerm(commitTable).GetAllByIndex(CommitRepoIndex.Name, repo.Name)
+	if deletion.NumCommits, err = d.count(commits); err != nil {
+		return nil, err
+	}
+	if deletion.NumBranches, err = d.count(commits.Map(func(commit gorethink.Term) gorethink.Term {
+		return commit.Field("FullClock").Nth(-1).Field("Branch")
+	}).Distinct()); err != nil {
+		return nil, err
+	}
+	if deletion.NumDiffs, err = d.count(d.getTerm(diffTable).Filter(map[string]interface{}{
+		"Repo": repo.Name,
+	})); err != nil {
+		return nil, err
+	}
+	return deletion, nil
+}
+
+// count returns the number of elements in a sequence
+func (d *driver) count(seq gorethink.Term) (uint64, error) {
+	cursor, err := seq.Count().Run(d.dbClient)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+	var n uint64
+	if err := cursor.One(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
 }
 
 func (d *driver) getFullProvenance(repo *pfs.Repo, provenance []*pfs.Commit) (fullProvenance []*persist.ProvenanceCommit, archived bool, err error) {
@@ -408,44 +1172,62 @@ func (d *driver) getFullProvenance(repo *pfs.Repo, provenance []*pfs.Commit) (fu
 		repoSet[repoName] = true
 	}
 
+	// We compute the complete set of provenance.  That is, the provenance of this
+	// commit includes the provenance of its immediate provenance.
+	// This is so that running ListCommit with provenance is fast.
+	provenanceSet := make(map[string]*persist.ProvenanceCommit)
+	repoToIDs := make(map[string][]string)
 	for _, c := range provenance {
 		if !repoSet[c.Repo.Name] {
 			return nil, false, fmt.Errorf("cannot use %s/%s as provenance, %s is not provenance of %s", c.Repo.Name, c.ID, c.Repo.Name, repo.Name)
 		}
-		fullProvenance = append(fullProvenance, &persist.ProvenanceCommit{
-			ID:   c.ID,
-			Repo: c.Repo.Name,
-		})
+		repoToIDs[c.Repo.Name] = append(repoToIDs[c.Repo.Name], c.ID)
 	}
-	// We compute the complete set of provenance.  That is, the provenance of this
-	// commit includes the provenance of its immediate provenance.
-	// This is so that running ListCommit with provenance is fast.
-	provenanceSet := make(map[string]*pfs.Commit)
-	for _, c := range provenance {
-		commitInfo, err := d.InspectCommit(c)
-		// If any of the commit's provenance is archived, the commit should be
-		// archived
-		archived = archived || commitInfo.Archived
+	repoToCommits := make(map[string]map[string]*persist.Commit)
+	for repoName, ids := range repoToIDs {
+		repoToCommits[repoName], err = d.getRawCommits(repoName, ids)
 		if err != nil {
 			return nil, false, err
 		}
-
-		for _, p := range commitInfo.Provenance {
-			provenanceSet[fmt.Sprintf("%s:%s", p.Repo.Name, p.ID)] = p
+	}
+	var missing []string
+	directSet := make(map[string]bool)
+	for _, c := range provenance {
+		rawCommit, ok := repoToCommits[c.Repo.Name][c.ID]
+		if !ok {
+			missing = append(missing, fmt.Sprintf("%s/%s", c.Repo.Name, c.ID))
+			continue
+		}
+		// c.ID may be a branch name or a relative ID like master^, so we store
+		// the ID that the commit resolved to.
+		id := persist.FullClockHead(rawCommit.FullClock).ReadableCommitID()
+		if !directSet[fmt.Sprintf("%s:%s", c.Repo.Name, id)] {
+			directSet[fmt.Sprintf("%s:%s", c.Repo.Name, id)] = true
+			fullProvenance = append(fullProvenance, &persist.ProvenanceCommit{
+				ID:   id,
+				Repo: c.Repo.Name,
+			})
+		}
+		// If any of the commit's provenance is archived, the commit should be
+		// archived
+		archived = archived || rawCommit.Archived
+		for _, p := range rawCommit.Provenance {
+			provenanceSet[fmt.Sprintf("%s:%s", p.Repo, p.ID)] = p
 		}
 	}
+	if len(missing) > 0 {
+		return nil, false, fmt.Errorf("cannot use the following commits as provenance because they don't exist: %v", missing)
+	}
 
-	for _, c := range provenanceSet {
-		fullProvenance = append(fullProvenance, &persist.ProvenanceCommit{
-			ID:   c.ID,
-			Repo: c.Repo.Name,
-		})
+	for _, p := range provenanceSet {
+		fullProvenance = append(fullProvenance, p)
 	}
 
 	return fullProvenance, archived, nil
 }
 
-func (d *driver) ForkCommit(parent *pfs.Commit, branch string, provenance []*pfs.Commit) (*pfs.Commit, error) {
+func (d *driver) ForkCommit(parent *pfs.Commit, branch string, provenance []*pfs.Commit) (retCommit *pfs.Commit, retErr error) {
+	defer func(start time.Time) { d.report("ForkCommit", start, retErr, commitKeyValues(parent)...) }(time.Now())
 	fullProvenance, archived, err := d.getFullProvenance(parent.Repo, provenance)
 	if err != nil {
 		return nil, err
@@ -480,11 +1262,56 @@ func (d *driver) ForkCommit(parent *pfs.Commit, branch string, provenance []*pfs
 	}, nil
 }
 
+// pinCommit resolves a commit ID that refers to the head of a branch, e.g.
+// "master" or "master~1", to the ID of the commit that it currently refers
+// to.  Queries that use the returned commit keep reading the same commit
+// when new commits land on the branch.
+func (d *driver) pinCommit(commit *pfs.Commit) (*pfs.Commit, error) {
+	baseID, _, err := parseAncestry(commit.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !isBranchName(baseID) {
+		return commit, nil
+	}
+	rawCommit, err := d.getRawCommit(commit)
+	if err != nil {
+		return nil, err
+	}
+	return &pfs.Commit{
+		Repo: commit.Repo,
+		ID:   persist.FullClockHead(rawCommit.FullClock).ReadableCommitID(),
+	}, nil
+}
+
 func isBranchName(id string) bool {
-	return !strings.Contains(id, "/")
+	return !strings.ContainsAny(id, "/^~")
+}
+
+// commitDocument is a commit as it's stored in the database: a
+// persist.Commit along with the description and metadata attached to it,
+// which aren't fields of persist.Commit because it's generated from a proto.
+// Code that only needs the persist.Commit can decode commits into one and
+// ignore these fields, but code that rewrites commits has to preserve them.
+type commitDocument struct {
+	persist.Commit
+	Description string            `gorethink:",omitempty"`
+	Metadata    map[string]string `gorethink:",omitempty"`
+}
+
+func (d *driver) StartCommit(parent *pfs.Commit, provenance []*pfs.Commit) (retCommit *pfs.Commit, retErr error) {
+	defer func(start time.Time) { d.report("StartCommit", start, retErr, commitKeyValues(parent)...) }(time.Now())
+	return d.startCommitWithRetries(parent, provenance, "", nil)
+}
+
+func (d *driver) StartCommitWithMetadata(parent *pfs.Commit, provenance []*pfs.Commit, description string, metadata map[string]string) (retCommit *pfs.Commit, retErr error) {
+	defer func(start time.Time) { d.report("StartCommitWithMetadata", start, retErr, commitKeyValues(parent)...) }(time.Now())
+	return d.startCommitWithRetries(parent, provenance, description, metadata)
 }
 
-func (d *driver) StartCommit(parent *pfs.Commit, provenance []*pfs.Commit) (*pfs.Commit, error) {
+// startCommitWithRetries starts a commit on top of parent, retrying if other
+// commits are started on the same branch at the same time.
+func (d *driver) startCommitWithRetries(parent *pfs.Commit, provenance []*pfs.Commit, description string, metadata map[string]string) (*pfs.Commit, error) {
 	if parent.Repo.Name == "" || parent.ID == "" {
 		return nil, fmt.Errorf("Invalid parent commit: %s/%s", parent.Repo.Name, parent.ID)
 	}
@@ -494,6 +1321,38 @@ func (d *driver) StartCommit(parent *pfs.Commit, provenance []*pfs.Commit) (*pfs
 		return nil, err
 	}
 
+	// Concurrent commits started on the same branch race for the same clock,
+	// in which case all but one of them get a conflict.  The losers retry on
+	// top of the new head of the branch, backing off so that they don't
+	// starve each other.  Retrying only helps if the parent is a branch;
+	// the child of a specific commit always gets the same clock.
+	config := &backoff.ExponentialBackOff{
+		InitialInterval:     d.commitRetryInitialInterval,
+		RandomizationFactor: backoff.DefaultRandomizationFactor,
+		Multiplier:          2,
+		MaxInterval:         d.commitRetryMaxInterval,
+		Clock:               backoff.SystemClock,
+	}
+	config.Reset()
+	for attempt := 1; ; attempt++ {
+		commit, err := d.startCommit(parent, fullProvenance, archived, description, metadata)
+		if err == nil {
+			return commit, nil
+		}
+		errCommitExists, ok := err.(*pfsserver.ErrCommitExists)
+		if !ok || !isBranchName(parent.ID) {
+			return nil, err
+		}
+		if attempt >= d.commitRetryMaxAttempts {
+			return nil, fmt.Errorf("could not start a commit on branch %s/%s after %d attempts because of concurrent commits on the same branch: %v", parent.Repo.Name, parent.ID, attempt, errCommitExists)
+		}
+		time.Sleep(config.NextBackOff())
+	}
+}
+
+// startCommit makes a single attempt at starting a commit on top of parent.
+// It returns an ErrCommitExists if another commit took the clock first.
+func (d *driver) startCommit(parent *pfs.Commit, fullProvenance []*persist.ProvenanceCommit, archived bool, description string, metadata map[string]string) (*pfs.Commit, error) {
 	commit := &persist.Commit{
 		Repo:       parent.Repo.Name,
 		Started:    now(),
@@ -505,8 +1364,6 @@ func (d *driver) StartCommit(parent *pfs.Commit, provenance []*pfs.Commit) (*pfs
 	parentCommit, err := d.getRawCommit(parent)
 	if _, ok := err.(*pfsserver.ErrCommitNotFound); ok && isBranchName(parent.ID) {
 		makeNewBranch = true
-	} else if err == gorethink.ErrEmptyResult {
-		return nil, pfsserver.NewErrCommitNotFound(parent.Repo.Name, parent.ID)
 	} else if err != nil {
 		return nil, err
 	}
@@ -523,9 +1380,11 @@ func (d *driver) StartCommit(parent *pfs.Commit, provenance []*pfs.Commit) (*pfs
 		commit.ID = persist.NewCommitID(parent.Repo.Name, clock)
 	}
 
-	if err := d.insertMessage(commitTable, commit); err != nil {
-		// TODO: there can be a race if two threads concurrently start commit
-		// using a branch name.  We should automatically detect the race and retry.
+	if _, err := d.runWrite(d.getTerm(commitTable).Insert(&commitDocument{
+		Commit:      *commit,
+		Description: description,
+		Metadata:    metadata,
+	})); err != nil {
 		if gorethink.IsConflictErr(err) {
 			return nil, pfsserver.NewErrCommitExists(commit.Repo, commit.ID)
 		}
@@ -551,6 +1410,7 @@ func (d *driver) getKey(i *index, desiredOutputDocument interface{}) ([]interfac
 	if err != nil {
 		return nil, err
 	}
+	defer cursor.Close()
 	var key []interface{}
 	err = cursor.All(&key)
 	if err != nil {
@@ -599,6 +1459,7 @@ func (d *driver) getHeadOfBranch(repo string, branch string, retCommit *persist.
 	if err != nil {
 		return err
 	}
+	defer cursor.Close()
 	return cursor.One(retCommit)
 }
 
@@ -611,32 +1472,74 @@ func getClockID(repo string, c *persist.Clock) *persist.ClockID {
 	}
 }
 
-// parseClock takes a string of the form "branch/clock"
-// and returns a Clock object.
+// parseClock parses a commit ID of the form branch/clock.  It returns an
+// ErrInvalidCommitID if the ID isn't of that form.
 // For example:
 // "master/0" -> Clock{"master", 0}
 func parseClock(clock string) (*persist.Clock, error) {
 	parts := strings.Split(clock, "/")
 	if len(parts) != 2 {
-		return nil, fmt.Errorf("invalid commit ID %s", clock)
+		return nil, pfsserver.NewErrInvalidCommitID(clock, fmt.Sprintf("expected the form branch/clock, but found %d \"/\"-separated parts", len(parts)))
 	}
-	c, err := strconv.Atoi(parts[1])
+	c, err := strconv.ParseUint(parts[1], 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("invalid commit ID %s", clock)
+		return nil, pfsserver.NewErrInvalidCommitID(clock, fmt.Sprintf("clock %q is not a non-negative integer", parts[1]))
 	}
 	return &persist.Clock{
 		Branch: parts[0],
-		Clock:  uint64(c),
+		Clock:  c,
 	}, nil
 }
 
+// parseAncestry splits a commit ID with git-style ancestry suffixes into the
+// ID that the suffixes are relative to and the number of generations they
+// walk back.  "~n" walks back n generations, while "^" and "~" walk back one.
+// "master~2^" -> ("master", 3)
+func parseAncestry(id string) (string, uint64, error) {
+	i := strings.IndexAny(id, "^~")
+	if i < 0 {
+		return id, 0, nil
+	}
+	baseID, suffix := id[:i], id[i:]
+	if baseID == "" {
+		return "", 0, pfsserver.NewErrInvalidCommitID(id, "missing the commit that the ancestry is relative to")
+	}
+	var n uint64
+	for suffix != "" {
+		operator := suffix[0]
+		suffix = suffix[1:]
+		j := strings.IndexAny(suffix, "^~")
+		if j < 0 {
+			j = len(suffix)
+		}
+		digits := suffix[:j]
+		suffix = suffix[j:]
+		if digits == "" {
+			n++
+			continue
+		}
+		if operator == '^' {
+			// In git, ^n refers to the nth parent of a merge commit, but
+			// our commits only have one parent
+			return "", 0, pfsserver.NewErrInvalidCommitID(id, "^ can't be followed by a number; use ~ instead")
+		}
+		generations, err := strconv.ParseUint(digits, 10, 64)
+		if err != nil {
+			return "", 0, pfsserver.NewErrInvalidCommitID(id, fmt.Sprintf("%q is not a non-negative integer", digits))
+		}
+		n += generations
+	}
+	return baseID, n, nil
+}
+
 type commitChangeFeed struct {
 	NewVal *persist.Commit `gorethink:"new_val,omitempty"`
 }
 
-// Given a commitID (database primary key), compute the size of the commit
-// using diffs.
-func (d *driver) computeCommitSize(commit *persist.Commit) (uint64, error) {
+// recomputeCommitSize computes the size of a commit from scratch by summing
+// up the sizes of its diffs.  The size of a commit is maintained as diffs are
+// written; this is needed to reconcile the maintained size.
+func (d *driver) recomputeCommitSize(commit *persist.Commit) (uint64, error) {
 	head := persist.FullClockHead(commit.FullClock)
 	cursor, err := d.getTerm(diffTable).GetAllByIndex(
 		DiffClockIndex.Name,
@@ -649,6 +1552,7 @@ func (d *driver) computeCommitSize(commit *persist.Commit) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
+	defer cursor.Close()
 
 	var diff persist.Diff
 	if err := cursor.One(&diff); err != nil {
@@ -658,67 +1562,339 @@ func (d *driver) computeCommitSize(commit *persist.Commit) (uint64, error) {
 	return diff.Size, nil
 }
 
-// FinishCommit blocks until its parent has been finished/cancelled
-func (d *driver) FinishCommit(commit *pfs.Commit, cancel bool) error {
-	// TODO: may want to optimize this. Not ideal to jump to DB to validate repo exists. This is required by error strings test in server_test.go
-	_, err := d.inspectRepo(commit.Repo)
-	if err != nil {
-		return err
+// addCommitSize adds delta to the maintained size of a commit.  This is a
+// separate write from the diffs it accounts for, so the size of an open commit
+// can drift if the driver dies in between; finishCommit recomputes it.
+func (d *driver) addCommitSize(commitID string, delta int64) error {
+	if delta == 0 {
+		return nil
 	}
-	rawCommit, err := d.getRawCommit(commit)
+	_, err := d.runWrite(d.getTerm(commitTable).Get(commitID).Update(map[string]interface{}{
+		"Size": gorethink.Row.Field("Size").Default(0).Add(delta),
+	}))
+	return err
+}
+
+// reconcileCommitSize recomputes the size of a commit from its diffs and
+// stores it, fixing up any drift in the maintained size.
+func (d *driver) reconcileCommitSize(commit *persist.Commit) (uint64, error) {
+	size, err := d.recomputeCommitSize(commit)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if _, err := d.runWrite(d.getTerm(commitTable).Get(commit.ID).Update(map[string]interface{}{
+		"Size": size,
+	})); err != nil {
+		return 0, err
 	}
+	return size, nil
+}
 
-	rawCommit.Size, err = d.computeCommitSize(rawCommit)
+func (d *driver) ReconcileCommitSize(commit *pfs.Commit) (size uint64, retErr error) {
+	defer func(start time.Time) { d.report("ReconcileCommitSize", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	rawCommit, err := d.getRawCommit(commit)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	return d.reconcileCommitSize(rawCommit)
+}
 
-	parentClock := persist.FullClockParent(rawCommit.FullClock)
-	var parentCancelled bool
-	if parentClock != nil {
-		parentID := persist.NewCommitID(rawCommit.Repo, persist.FullClockHead(parentClock))
-		cursor, err := d.getTerm(commitTable).Get(parentID).Changes(gorethink.ChangesOpts{
-			IncludeInitial: true,
-		}).Run(d.dbClient)
+// FinishCommit blocks until its parent has been finished/cancelled
+func (d *driver) FinishCommit(commit *pfs.Commit, cancel bool) error {
+	return d.FinishCommitContext(context.Background(), commit, cancel)
+}
+
+// FinishCommitContext is the same as FinishCommit, except that it gives up
+// waiting for the parent once ctx is done.
+func (d *driver) FinishCommitContext(ctx context.Context, commit *pfs.Commit, cancel bool) (retErr error) {
+	defer func(start time.Time) { d.report("FinishCommit", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	return d.finishCommit(ctx, commit, cancel, true, nil)
+}
+
+func (d *driver) FinishCommitNoWait(commit *pfs.Commit, cancel bool) (retErr error) {
+	defer func(start time.Time) { d.report("FinishCommitNoWait", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	return d.finishCommit(context.Background(), commit, cancel, false, nil)
+}
+
+func (d *driver) FinishCommitWithMetadata(commit *pfs.Commit, cancel bool, description string, metadata map[string]string) (retErr error) {
+	defer func(start time.Time) { d.report("FinishCommitWithMetadata", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	fields := make(map[string]interface{})
+	if description != "" {
+		fields["Description"] = description
+	}
+	if len(metadata) > 0 {
+		// Rethink merges nested objects on update, so the keys are added
+		// to the ones given to StartCommitWithMetadata
+		fields["Metadata"] = metadata
+	}
+	return d.finishCommit(context.Background(), commit, cancel, true, fields)
+}
 
+func (d *driver) FinishCommitCompacted(commit *pfs.Commit, cancel bool) (retErr error) {
+	defer func(start time.Time) { d.report("FinishCommitCompacted", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	if !cancel {
+		rawCommit, err := d.getRawCommit(commit)
 		if err != nil {
 			return err
 		}
-
-		var change commitChangeFeed
-		for cursor.Next(&change) {
-			if change.NewVal != nil && change.NewVal.Finished != nil {
-				parentCancelled = change.NewVal.Cancelled
-				break
-			}
+		if rawCommit.Finished != nil {
+			return fmt.Errorf("commit %v/%v has already been finished", commit.Repo.Name, commit.ID)
 		}
-		if err = cursor.Err(); err != nil {
+		if err := d.compactCommit(rawCommit); err != nil {
 			return err
 		}
 	}
+	return d.finishCommit(context.Background(), commit, cancel, true, nil)
+}
 
-	// Update the size of the repo.  Note that there is a consistency issue here:
-	// If this transaction succeeds but the next one (updating Commit) fails,
-	// then the repo size will be wrong.  TODO
-	_, err = d.getTerm(repoTable).Get(rawCommit.Repo).Update(map[string]interface{}{
-		"Size": gorethink.Row.Field("Size").Add(rawCommit.Size),
-	}).RunWrite(d.dbClient)
+// compactCommit rewrites each file that was written to an open commit as
+// more than one blockref, so that it refers to fewer blocks.  Files that are
+// appended to repeatedly in a commit are otherwise made of a blockref per
+// append, which makes reading them slow.  Runs of blockrefs that fit in a
+// block together are re-uploaded as a single block.  Blocks are only cut
+// where the blockrefs were, so the content stays split on whatever
+// delimiter it was written with.  The content of the commit stays the same,
+// and so does its size.
+func (d *driver) compactCommit(rawCommit *persist.Commit) error {
+	clock := persist.FullClockHead(rawCommit.FullClock)
+	cursor, err := d.getTerm(diffTable).GetAllByIndex(DiffClockIndex.Name, diffClockIndexKey(rawCommit.Repo, clock.Branch, clock.Clock)).Filter(func(diff gorethink.Term) gorethink.Term {
+		return gorethink.And(
+			diff.Field("FileType").Eq(persist.FileType_FILE),
+			diff.Field("BlockRefs").Default([]interface{}{}).Count().Gt(1),
+		)
+	}).Run(d.dbClient)
 	if err != nil {
 		return err
 	}
-
-	rawCommit.Finished = now()
-	rawCommit.Cancelled = parentCancelled || cancel
-	_, err = d.getTerm(commitTable).Get(rawCommit.ID).Update(rawCommit).RunWrite(d.dbClient)
-
-	return err
+	defer cursor.Close()
+	var diffs []*persist.Diff
+	if err := cursor.All(&diffs); err != nil {
+		return err
+	}
+	for _, diff := range diffs {
+		groups := groupBlockRefs(diff.BlockRefs, pfsserver.BlockSize)
+		if len(groups) == len(diff.BlockRefs) {
+			continue
+		}
+		file := client.NewFile(rawCommit.Repo, clock.ReadableCommitID(), diff.Path)
+		var blockRefs []*persist.BlockRef
+		for _, group := range groups {
+			if len(group) == 1 {
+				blockRefs = append(blockRefs, group[0])
+				continue
+			}
+			groupRefs, err := d.compactBlockRefs(file, group)
+			if err != nil {
+				return err
+			}
+			blockRefs = append(blockRefs, groupRefs...)
+		}
+		// The blockrefs are only replaced if they're still the ones that were
+		// compacted, so that blockrefs appended by a concurrent PutFile
+		// aren't lost.  In that case the file is left as it is.
+		if _, err := d.runWrite(d.getTerm(diffTable).Get(diff.ID).Update(func(row gorethink.Term) interface{} {
+			return gorethink.Branch(
+				row.Field("BlockRefs").Eq(diff.BlockRefs),
+				map[string]interface{}{"BlockRefs": blockRefs},
+				map[string]interface{}{},
+			)
+		})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactBlockRefs re-uploads the content of blockRefs, which must fit in a
+// block, and returns the blockrefs of the new block.
+func (d *driver) compactBlockRefs(file *pfs.File, blockRefs []*persist.BlockRef) ([]*persist.BlockRef, error) {
+	var size uint64
+	for _, blockRef := range blockRefs {
+		size += blockRef.Size()
+	}
+	reader := d.newFileReader(blockRefs, file, 0, 0)
+	defer reader.Close()
+	newBlockRefs, newSize, err := d.putBlocks(pfs.Delimiter_NONE, []io.Reader{reader})
+	if err != nil {
+		return nil, err
+	}
+	if newSize != size {
+		return nil, fmt.Errorf("compacted %v to %d bytes instead of %d; this is likely a bug", file.Path, newSize, size)
+	}
+	var result []*persist.BlockRef
+	for _, blockRef := range newBlockRefs {
+		if blockRef.Size() > 0 {
+			result = append(result, blockRef)
+		}
+	}
+	return result, nil
+}
+
+// groupBlockRefs splits blockRefs into runs whose total size is at most
+// maxSize.  A blockref that's bigger than maxSize is a run of its own.
+func groupBlockRefs(blockRefs []*persist.BlockRef, maxSize uint64) [][]*persist.BlockRef {
+	var groups [][]*persist.BlockRef
+	var group []*persist.BlockRef
+	var size uint64
+	for _, blockRef := range blockRefs {
+		if len(group) > 0 && size+blockRef.Size() > maxSize {
+			groups = append(groups, group)
+			group = nil
+			size = 0
+		}
+		group = append(group, blockRef)
+		size += blockRef.Size()
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// finishCommit finishes commit.  If waitForParent is set, it first waits
+// for the parent of commit to be finished, and commit inherits the
+// parent's cancellation.  fields are set on the commit along with the ones
+// that finish it.
+func (d *driver) finishCommit(ctx context.Context, commit *pfs.Commit, cancel bool, waitForParent bool, fields map[string]interface{}) error {
+	// TODO: may want to optimize this. Not ideal to jump to DB to validate repo exists. This is required by error strings test in server_test.go
+	_, err := d.inspectRepo(commit.Repo)
+	if err != nil {
+		return err
+	}
+	rawCommit, err := d.getRawCommit(commit)
+	if err != nil {
+		return err
+	}
+
+	parentClock := persist.FullClockParent(rawCommit.FullClock)
+	var parentCancelled bool
+	if parentClock != nil && waitForParent {
+		parentID := persist.NewCommitID(rawCommit.Repo, persist.FullClockHead(parentClock))
+		cursor, err := d.getTerm(commitTable).Get(parentID).Changes(gorethink.ChangesOpts{
+			IncludeInitial: true,
+		}).Run(d.dbClient)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close()
+
+		// Closing the cursor unblocks the call to Next below
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				cursor.Close()
+			case <-done:
+			}
+		}()
+
+		var parentFinished bool
+		var change commitChangeFeed
+		for cursor.Next(&change) {
+			if change.NewVal != nil && change.NewVal.Finished != nil {
+				parentFinished = true
+				parentCancelled = change.NewVal.Cancelled
+				break
+			}
+		}
+		if !parentFinished && ctx.Err() != nil {
+			parent := persist.FullClockHead(parentClock)
+			return fmt.Errorf("commit %s/%s could not be finished because its parent commit %s/%d did not finish in time: %v", commit.Repo.Name, commit.ID, parent.Branch, parent.Clock, ctx.Err())
+		}
+		if err = cursor.Err(); err != nil {
+			return err
+		}
+	}
+
+	// The maintained size of the commit is written separately from its diffs,
+	// so it can be off if a write failed halfway.  Since the diffs of a
+	// finished commit don't change, we recompute the size once here.
+	// Note that we don't update the size of the repo here; it's computed from
+	// the sizes of the finished commits.
+	size, err := d.recomputeCommitSize(rawCommit)
+	if err != nil {
+		return err
+	}
+	update := map[string]interface{}{
+		"Finished":  now(),
+		"Cancelled": parentCancelled || cancel,
+		"Size":      size,
+	}
+	for field, value := range fields {
+		update[field] = value
+	}
+	_, err = d.runWrite(d.getTerm(commitTable).Get(rawCommit.ID).Update(update))
+	if err != nil {
+		return err
+	}
+
+	// Writes that are still staged under file handles can no longer be
+	// committed.
+	d.staged.removeCommit(rawCommit.ID)
+	return nil
+}
+
+func (d *driver) CancelCommit(commit *pfs.Commit) (retErr error) {
+	defer func(start time.Time) { d.report("CancelCommit", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	rawCommit, err := d.getRawCommit(commit)
+	if err != nil {
+		return err
+	}
+
+	// We cancel the descendants first, so that a failure doesn't leave a
+	// cancelled commit with open descendants.
+	res, err := d.runWrite(d.getTerm(commitTable).GetAllByIndex(CommitRepoIndex.Name, rawCommit.Repo).Filter(func(r gorethink.Term) gorethink.Term {
+		return gorethink.And(
+			r.Field("Finished").Default(nil).Eq(nil),
+			persist.DBClockDescendent(r.Field("FullClock"), gorethink.Expr(rawCommit.FullClock)),
+		)
+	}).Update(map[string]interface{}{
+		"Finished":  now(),
+		"Cancelled": true,
+	}, gorethink.UpdateOpts{
+		ReturnChanges: true,
+	}))
+	if err != nil {
+		return err
+	}
+	for _, change := range res.Changes {
+		if newVal, ok := change.NewValue.(map[string]interface{}); ok {
+			if id, ok := newVal["ID"].(string); ok {
+				d.staged.removeCommit(id)
+			}
+		}
+	}
+
+	// The commit keeps its finish time if it's already finished
+	_, err = d.runWrite(d.getTerm(commitTable).Get(rawCommit.ID).Update(map[string]interface{}{
+		"Finished":  gorethink.Row.Field("Finished").Default(now()),
+		"Cancelled": true,
+	}))
+	if err != nil {
+		return err
+	}
+	d.staged.removeCommit(rawCommit.ID)
+	return nil
 }
 
 // ArchiveCommits archives the given commits and all commits that have any of the
 // given commits as provenance
-func (d *driver) ArchiveCommit(commits []*pfs.Commit) error {
+func (d *driver) ArchiveCommit(commits []*pfs.Commit) (retErr error) {
+	defer func(start time.Time) { d.report("ArchiveCommit", start, retErr) }(time.Now())
+	return d.setArchived(commits, true)
+}
+
+// UnarchiveCommit reverses ArchiveCommit: it unarchives the given commits and
+// all commits that have any of the given commits as provenance
+func (d *driver) UnarchiveCommit(commits []*pfs.Commit) (retErr error) {
+	defer func(start time.Time) { d.report("UnarchiveCommit", start, retErr) }(time.Now())
+	return d.setArchived(commits, false)
+}
+
+// setArchived sets whether the given commits, and all commits that have any
+// of them as provenance, are archived.
+func (d *driver) setArchived(commits []*pfs.Commit, archived bool) error {
 	var provenanceIDs []interface{}
 	for _, commit := range commits {
 		provenanceIDs = append(provenanceIDs, commit.ID)
@@ -738,10 +1914,10 @@ func (d *driver) ArchiveCommit(commits []*pfs.Commit) error {
 		// provenance
 		return gorethink.Or(commit.Field("Provenance").Field("ID").SetIntersection(gorethink.Expr(provenanceIDs)).Count().Ne(0), gorethink.Expr(rawIDs).Contains(commit.Field("ID")))
 	}).Update(map[string]interface{}{
-		"Archived": true,
+		"Archived": archived,
 	})
 
-	_, err := query.RunWrite(d.dbClient)
+	_, err := d.runWrite(query)
 	if err != nil {
 		return err
 	}
@@ -749,21 +1925,110 @@ func (d *driver) ArchiveCommit(commits []*pfs.Commit) error {
 	return nil
 }
 
-func (d *driver) InspectCommit(commit *pfs.Commit) (*pfs.CommitInfo, error) {
+func (d *driver) InspectCommit(commit *pfs.Commit) (commitInfo *pfs.CommitInfo, retErr error) {
+	defer func(start time.Time) { d.report("InspectCommit", start, retErr, commitKeyValues(commit)...) }(time.Now())
 	rawCommit, err := d.getRawCommit(commit)
 	if err != nil {
 		return nil, err
 	}
 
-	commitInfo := d.rawCommitToCommitInfo(rawCommit)
-	if commitInfo.Finished == nil {
-		commitInfo.SizeBytes, err = d.computeCommitSize(rawCommit)
-		if err != nil {
-			return nil, err
+	return d.rawCommitToCommitInfo(rawCommit), nil
+}
+
+func (d *driver) InspectCommitWithHead(commit *pfs.Commit) (commitInfo *drive.CommitInfo, retErr error) {
+	defer func(start time.Time) { d.report("InspectCommitWithHead", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	rawCommit, err := d.getRawCommit(commit)
+	if err != nil {
+		return nil, err
+	}
+	head := &persist.Commit{}
+	if err := d.getHeadOfBranch(rawCommit.Repo, persist.FullClockBranch(rawCommit.FullClock), head); err != nil {
+		return nil, err
+	}
+	return &drive.CommitInfo{
+		CommitInfo: d.rawCommitToCommitInfo(rawCommit),
+		IsHead:     head.ID == rawCommit.ID,
+	}, nil
+}
+
+func (d *driver) InspectCommitWithNumDiffs(commit *pfs.Commit) (commitInfo *drive.CommitInfo, retErr error) {
+	defer func(start time.Time) {
+		d.report("InspectCommitWithNumDiffs", start, retErr, commitKeyValues(commit)...)
+	}(time.Now())
+	rawCommit, err := d.getRawCommit(commit)
+	if err != nil {
+		return nil, err
+	}
+	clock := persist.FullClockHead(rawCommit.FullClock)
+	numDiffs, err := d.count(d.getTerm(diffTable).GetAllByIndex(DiffClockIndex.Name, diffClockIndexKey(rawCommit.Repo, clock.Branch, clock.Clock)))
+	if err != nil {
+		return nil, err
+	}
+	return &drive.CommitInfo{
+		CommitInfo: d.rawCommitToCommitInfo(rawCommit),
+		NumDiffs:   numDiffs,
+	}, nil
+}
+
+func (d *driver) InspectCommitWithMetadata(commit *pfs.Commit) (commitInfo *drive.CommitInfo, retErr error) {
+	defer func(start time.Time) {
+		d.report("InspectCommitWithMetadata", start, retErr, commitKeyValues(commit)...)
+	}(time.Now())
+	rawCommit, err := d.getRawCommit(commit)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := d.getTerm(commitTable).Get(rawCommit.ID).Run(d.dbClient)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	doc := &commitDocument{}
+	if err := cursor.One(doc); err != nil {
+		if err == gorethink.ErrEmptyResult {
+			return nil, pfsserver.NewErrCommitNotFound(commit.Repo.Name, commit.ID)
 		}
+		return nil, err
+	}
+	return &drive.CommitInfo{
+		CommitInfo:  d.rawCommitToCommitInfo(&doc.Commit),
+		Description: doc.Description,
+		Metadata:    doc.Metadata,
+	}, nil
+}
+
+func (d *driver) InspectAncestorCommit(commit *pfs.Commit, n int) (commitInfo *pfs.CommitInfo, retErr error) {
+	defer func(start time.Time) { d.report("InspectAncestorCommit", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	if n < 0 {
+		return nil, fmt.Errorf("invalid number of generations %d; it must not be negative", n)
+	}
+	ancestor, err := d.getAncestorRawCommit(commit, uint64(n), fmt.Sprintf("%s~%d", commit.ID, n))
+	if err != nil {
+		return nil, err
+	}
+	return d.rawCommitToCommitInfo(ancestor), nil
+}
+
+// getAncestorRawCommit returns the commit n generations before commit.
+// ancestorID is how the ancestor is referred to in the error returned if
+// commit has fewer than n ancestors.
+func (d *driver) getAncestorRawCommit(commit *pfs.Commit, n uint64, ancestorID string) (*persist.Commit, error) {
+	rawCommit, err := d.getRawCommit(commit)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return rawCommit, nil
 	}
 
-	return commitInfo, nil
+	ancestorClock := persist.FullClockAncestor(rawCommit.FullClock, n)
+	if ancestorClock == nil {
+		return nil, pfsserver.NewErrCommitNotFound(commit.Repo.Name, ancestorID)
+	}
+	return d.getRawCommit(&pfs.Commit{
+		Repo: commit.Repo,
+		ID:   persist.FullClockHead(ancestorClock).ReadableCommitID(),
+	})
 }
 
 func (d *driver) rawCommitToCommitInfo(rawCommit *persist.Commit) *pfs.CommitInfo {
@@ -816,14 +2081,156 @@ func (d *driver) rawCommitToCommitInfo(rawCommit *persist.Commit) *pfs.CommitInf
 	}
 }
 
-func (d *driver) ListCommit(include []*pfs.Commit, exclude []*pfs.Commit, provenance []*pfs.Commit, commitType pfs.CommitType, status pfs.CommitStatus, block bool) ([]*pfs.CommitInfo, error) {
+func (d *driver) ListCommit(include []*pfs.Commit, exclude []*pfs.Commit, provenance []*pfs.Commit, commitType pfs.CommitType, status pfs.CommitStatus, cancelledOnly bool, since *google_protobuf.Timestamp, until *google_protobuf.Timestamp, block bool) (commitInfos []*pfs.CommitInfo, retErr error) {
+	defer func(start time.Time) { d.report("ListCommit", start, retErr) }(time.Now())
+	query, err := d.listCommitQuery(include, exclude, provenance, commitType, status, cancelledOnly, since, until, drive.CommitOrderNONE)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := query.Run(d.dbClient)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var commits []*persist.Commit
+	if err := cursor.All(&commits); err != nil {
+		return nil, err
+	}
+
+	if len(commits) > 0 {
+		for _, commit := range commits {
+			commitInfos = append(commitInfos, d.rawCommitToCommitInfo(commit))
+		}
+	} else if block {
+		query = query.Changes(gorethink.ChangesOpts{
+			IncludeInitial: true,
+		}).Field("new_val")
+		cursor, err := query.Run(d.dbClient)
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close()
+		var commit persist.Commit
+		cursor.Next(&commit)
+		if err := cursor.Err(); err != nil {
+			return nil, err
+		}
+		commitInfos = append(commitInfos, d.rawCommitToCommitInfo(&commit))
+	}
+
+	return commitInfos, nil
+}
+
+func (d *driver) ListCommitOrdered(include []*pfs.Commit, exclude []*pfs.Commit, provenance []*pfs.Commit, commitType pfs.CommitType, status pfs.CommitStatus, cancelledOnly bool, since *google_protobuf.Timestamp, until *google_protobuf.Timestamp, order drive.CommitOrder) (commitInfos []*pfs.CommitInfo, retErr error) {
+	defer func(start time.Time) { d.report("ListCommitOrdered", start, retErr) }(time.Now())
+	query, err := d.listCommitQuery(include, exclude, provenance, commitType, status, cancelledOnly, since, until, order)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := query.Run(d.dbClient)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var commits []*persist.Commit
+	if err := cursor.All(&commits); err != nil {
+		return nil, err
+	}
+	for _, commit := range commits {
+		commitInfos = append(commitInfos, d.rawCommitToCommitInfo(commit))
+	}
+	return commitInfos, nil
+}
+
+func (d *driver) WatchCommit(ctx context.Context, include []*pfs.Commit, exclude []*pfs.Commit, provenance []*pfs.Commit, commitType pfs.CommitType, status pfs.CommitStatus) (<-chan *pfs.CommitInfo, <-chan error) {
+	commitInfoCh := make(chan *pfs.CommitInfo)
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(errCh)
+		defer close(commitInfoCh)
+		errCh <- d.watchCommit(ctx, include, exclude, provenance, commitType, status, commitInfoCh)
+	}()
+	return commitInfoCh, errCh
+}
+
+func (d *driver) WatchCommitByProvenance(ctx context.Context, repo *pfs.Repo, provenance []*pfs.Commit, from *pfs.Commit) (<-chan *pfs.CommitInfo, <-chan error) {
+	include := []*pfs.Commit{{Repo: repo}}
+	var exclude []*pfs.Commit
+	if from != nil {
+		if from.Repo.Name != repo.Name {
+			commitInfoCh := make(chan *pfs.CommitInfo)
+			errCh := make(chan error, 1)
+			close(commitInfoCh)
+			errCh <- fmt.Errorf("commit %s/%s is not in repo %s", from.Repo.Name, from.ID, repo.Name)
+			close(errCh)
+			return commitInfoCh, errCh
+		}
+		exclude = append(exclude, from)
+	}
+	return d.WatchCommit(ctx, include, exclude, provenance, pfs.CommitType_COMMIT_TYPE_READ, pfs.CommitStatus_NORMAL)
+}
+
+func (d *driver) watchCommit(ctx context.Context, include []*pfs.Commit, exclude []*pfs.Commit, provenance []*pfs.Commit, commitType pfs.CommitType, status pfs.CommitStatus, commitInfoCh chan<- *pfs.CommitInfo) error {
+	query, err := d.listCommitQuery(include, exclude, provenance, commitType, status, false, nil, nil, drive.CommitOrderNONE)
+	if err != nil {
+		return err
+	}
+
+	cursor, err := query.Changes(gorethink.ChangesOpts{
+		IncludeInitial: true,
+	}).Filter(func(change gorethink.Term) gorethink.Term {
+		// Commits that stop matching the query have a null new_val
+		return change.Field("new_val").Ne(nil)
+	}).Field("new_val").Run(d.dbClient)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	// Closing the cursor unblocks the call to Next below
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cursor.Close()
+		case <-done:
+		}
+	}()
+
+	// A commit shows up in the changefeed every time it's updated, but we
+	// only want to deliver it once.
+	seen := make(map[string]bool)
+	commit := &persist.Commit{}
+	for cursor.Next(commit) {
+		if !seen[commit.ID] {
+			seen[commit.ID] = true
+			select {
+			case commitInfoCh <- d.rawCommitToCommitInfo(commit):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		commit = &persist.Commit{}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return cursor.Err()
+}
+
+// listCommitQuery returns a query for the commits that match the arguments of
+// ListCommit, in the given order.  Only CommitOrderNONE yields a query that
+// supports changefeeds.
+func (d *driver) listCommitQuery(include []*pfs.Commit, exclude []*pfs.Commit, provenance []*pfs.Commit, commitType pfs.CommitType, status pfs.CommitStatus, cancelledOnly bool, since *google_protobuf.Timestamp, until *google_protobuf.Timestamp, order drive.CommitOrder) (nilTerm gorethink.Term, retErr error) {
 	repoToQuery := make(map[string]gorethink.Term)
 
 	for i, commit := range append(include, exclude...) {
 		// make sure that the repos exist
 		_, err := d.inspectRepo(commit.Repo)
 		if err != nil {
-			return nil, err
+			return nilTerm, err
 		}
 		query, ok := repoToQuery[commit.Repo.Name]
 		if !ok {
@@ -839,7 +2246,7 @@ func (d *driver) ListCommit(include []*pfs.Commit, exclude []*pfs.Commit, proven
 		}
 		fullClock, err := d.getFullClock(commit)
 		if err != nil {
-			return nil, err
+			return nilTerm, err
 		}
 		if i < len(include) {
 			query = query.Filter(func(r gorethink.Term) gorethink.Term {
@@ -853,9 +2260,16 @@ func (d *driver) ListCommit(include []*pfs.Commit, exclude []*pfs.Commit, proven
 		repoToQuery[commit.Repo.Name] = query
 	}
 
+	// Union the repos in a fixed order, so that the result doesn't depend
+	// on map iteration
+	var repoNames []string
+	for repoName := range repoToQuery {
+		repoNames = append(repoNames, repoName)
+	}
+	sort.Strings(repoNames)
 	var queries []interface{}
-	for _, query := range repoToQuery {
-		queries = append(queries, query)
+	for _, repoName := range repoNames {
+		queries = append(queries, repoToQuery[repoName])
 	}
 
 	var query gorethink.Term
@@ -867,7 +2281,11 @@ func (d *driver) ListCommit(include []*pfs.Commit, exclude []*pfs.Commit, proven
 		})
 	}
 
-	if status != pfs.CommitStatus_ALL && status != pfs.CommitStatus_CANCELLED {
+	if cancelledOnly {
+		query = query.Filter(map[string]interface{}{
+			"Cancelled": true,
+		})
+	} else if status != pfs.CommitStatus_ALL && status != pfs.CommitStatus_CANCELLED {
 		query = query.Filter(map[string]interface{}{
 			"Cancelled": false,
 		})
@@ -887,6 +2305,16 @@ func (d *driver) ListCommit(include []*pfs.Commit, exclude []*pfs.Commit, proven
 			return commit.Field("Finished").Eq(nil)
 		})
 	}
+	if since != nil {
+		query = query.Filter(func(commit gorethink.Term) gorethink.Term {
+			return gorethink.Not(timestampBefore(commit.Field("Started"), since))
+		})
+	}
+	if until != nil {
+		query = query.Filter(func(commit gorethink.Term) gorethink.Term {
+			return timestampBefore(commit.Field("Started"), until)
+		})
+	}
 	var provenanceIDs []interface{}
 	for _, commit := range provenance {
 		// TODO: we need to validate the provenanceIDs: 1) they must actually
@@ -901,41 +2329,17 @@ func (d *driver) ListCommit(include []*pfs.Commit, exclude []*pfs.Commit, proven
 			return commit.Field("Provenance").Contains(provenanceIDs...)
 		})
 	}
-
-	cursor, err := query.Run(d.dbClient)
-	if err != nil {
-		return nil, err
+	switch order {
+	case drive.CommitOrderASCENDING:
+		query = query.OrderBy(gorethink.Asc(startedSeconds), gorethink.Asc(startedNanos), gorethink.Asc("ID"))
+	case drive.CommitOrderDESCENDING:
+		query = query.OrderBy(gorethink.Desc(startedSeconds), gorethink.Desc(startedNanos), gorethink.Desc("ID"))
 	}
-	var commits []*persist.Commit
-	if err := cursor.All(&commits); err != nil {
-		return nil, err
-	}
-
-	var commitInfos []*pfs.CommitInfo
-	if len(commits) > 0 {
-		for _, commit := range commits {
-			commitInfos = append(commitInfos, d.rawCommitToCommitInfo(commit))
-		}
-	} else if block {
-		query = query.Changes(gorethink.ChangesOpts{
-			IncludeInitial: true,
-		}).Field("new_val")
-		cursor, err := query.Run(d.dbClient)
-		if err != nil {
-			return nil, err
-		}
-		var commit persist.Commit
-		cursor.Next(&commit)
-		if err := cursor.Err(); err != nil {
-			return nil, err
-		}
-		commitInfos = append(commitInfos, d.rawCommitToCommitInfo(&commit))
-	}
-
-	return commitInfos, nil
+	return query, nil
 }
 
-func (d *driver) FlushCommit(fromCommits []*pfs.Commit, toRepos []*pfs.Repo) ([]*pfs.CommitInfo, error) {
+func (d *driver) FlushCommit(fromCommits []*pfs.Commit, toRepos []*pfs.Repo) (commitInfos []*pfs.CommitInfo, retErr error) {
+	defer func(start time.Time) { d.report("FlushCommit", start, retErr) }(time.Now())
 	var result []*pfs.CommitInfo
 	repoSet1 := make(map[string]bool)
 	repoToProvenance := make(map[string][]*persist.ProvenanceCommit)
@@ -1027,309 +2431,1625 @@ func (d *driver) FlushCommit(fromCommits []*pfs.Commit, toRepos []*pfs.Repo) ([]
 	return result, nil
 }
 
-func (d *driver) ListBranch(repo *pfs.Repo, status pfs.CommitStatus) ([]string, error) {
-	// Get all branches
+func (d *driver) ListBranch(repo *pfs.Repo, status pfs.CommitStatus) (branches []string, retErr error) {
+	defer func(start time.Time) { d.report("ListBranch", start, retErr, repoKeyValues(repo)...) }(time.Now())
+	if status == pfs.CommitStatus_ALL {
+		return d.listBranches(repo)
+	}
+
+	heads, err := d.listBranchHeads(repo, status)
+	if err != nil {
+		return nil, err
+	}
+	for _, head := range heads {
+		branches = append(branches, persist.FullClockBranch(head.FullClock))
+	}
+	return branches, nil
+}
+
+func (d *driver) ListBranchHeads(repo *pfs.Repo, status pfs.CommitStatus) (commitInfos []*pfs.CommitInfo, retErr error) {
+	defer func(start time.Time) { d.report("ListBranchHeads", start, retErr, repoKeyValues(repo)...) }(time.Now())
+	heads, err := d.listBranchHeads(repo, status)
+	if err != nil {
+		return nil, err
+	}
+	for _, head := range heads {
+		commitInfos = append(commitInfos, d.rawCommitToCommitInfo(head))
+	}
+	return commitInfos, nil
+}
+
+// listBranches returns the names of all branches in repo, in order.
+func (d *driver) listBranches(repo *pfs.Repo) ([]string, error) {
 	cursor, err := d.getTerm(commitTable).Distinct(gorethink.DistinctOpts{
 		Index: CommitBranchIndex.Name,
 	}).Filter(gorethink.Row.Nth(0).Eq(repo.Name)).OrderBy(gorethink.Row.Nth(1)).Map(gorethink.Row.Nth(1)).Run(d.dbClient)
 	if err != nil {
 		return nil, err
 	}
+	defer cursor.Close()
 
 	var branches []string
 	if err := cursor.All(&branches); err != nil {
 		return nil, err
 	}
+	return branches, nil
+}
 
-	if status == pfs.CommitStatus_ALL {
-		return branches, nil
+// listBranchHeads returns the head commits of the branches in repo, in the
+// order of the branch names, skipping those that status excludes.
+func (d *driver) listBranchHeads(repo *pfs.Repo, status pfs.CommitStatus) ([]*persist.Commit, error) {
+	branches, err := d.listBranches(repo)
+	if err != nil {
+		return nil, err
 	}
 
-	var res []string
+	var heads []*persist.Commit
 	for _, branch := range branches {
 		commit := &persist.Commit{}
 		if err := d.getHeadOfBranch(repo.Name, branch, commit); err != nil {
 			return nil, err
 		}
-		// Check if we should skip the commit based on status
-		if status != pfs.CommitStatus_ALL {
-			if commit.Cancelled && status != pfs.CommitStatus_CANCELLED {
-				continue
-			}
-			if commit.Archived && status != pfs.CommitStatus_ARCHIVED {
-				continue
-			}
+		if !headMatchesStatus(commit, status) {
+			continue
 		}
-		res = append(res, branch)
+		heads = append(heads, commit)
 	}
-	return res, nil
+	return heads, nil
 }
 
-// DeleteCommit deletes a commit.  Currently it only works if the commit is 1) the
-// head of a branch (i.e. it doesnt' have any descendents), and 2) it's not finished.
-// Note that currently DeleteCommit is not atomic/transactional.  You should only
-// use DeleteCommit if you are sure that no other client is operating on the same
-// branch.
-func (d *driver) DeleteCommit(commit *pfs.Commit) error {
-	rawCommit, err := d.getRawCommit(commit)
-	if err != nil {
-		return err
+// headMatchesStatus returns false if status excludes the head of a branch
+// from ListBranch.
+func headMatchesStatus(head *persist.Commit, status pfs.CommitStatus) bool {
+	if status == pfs.CommitStatus_ALL {
+		return true
 	}
-	if rawCommit.Finished != nil {
-		return fmt.Errorf("commit %s is closed; only open commits can be deleted", commit.ID)
+	if head.Cancelled && status != pfs.CommitStatus_CANCELLED {
+		return false
 	}
+	if head.Archived && status != pfs.CommitStatus_ARCHIVED {
+		return false
+	}
+	return true
+}
 
-	// if the commit ID is of the full form (e.g. master/2), we make sure that
-	// it's the head of a branch
-	if _, err = parseClock(commit.ID); err == nil {
-		head := &persist.Commit{}
-		branch := persist.FullClockBranch(rawCommit.FullClock)
-		if err := d.getHeadOfBranch(rawCommit.Repo, branch, head); err != nil {
-			return err
-		}
-		if head.ID != rawCommit.ID {
-			return fmt.Errorf("commit %s is not the head of branch %s; only the head of a branch can be deleted", commit.ID, branch)
-		}
+func (d *driver) ListAllBranchHeads(status pfs.CommitStatus) (repoToHeads map[string][]*pfs.CommitInfo, retErr error) {
+	defer func(start time.Time) { d.report("ListAllBranchHeads", start, retErr) }(time.Now())
+	// The head of a branch is the commit with the highest clock on it
+	cursor, err := d.getTerm(commitTable).GroupByIndex(CommitBranchIndex.Name).Max(func(commit gorethink.Term) gorethink.Term {
+		return commit.Field("FullClock").Nth(-1).Field("Clock")
+	}).Ungroup().OrderBy("group").Run(d.dbClient)
+	if err != nil {
+		return nil, err
 	}
+	defer cursor.Close()
 
-	clock := persist.FullClockHead(rawCommit.FullClock)
-	if _, err := d.getTerm(diffTable).GetAllByIndex(DiffClockIndex.Name, diffClockIndexKey(rawCommit.Repo, clock.Branch, clock.Clock)).Delete().RunWrite(d.dbClient); err != nil {
-		return err
+	var groups []struct {
+		RepoAndBranch []string        `gorethink:"group"`
+		Head          *persist.Commit `gorethink:"reduction"`
+	}
+	if err := cursor.All(&groups); err != nil {
+		return nil, err
 	}
 
-	return d.deleteMessageByPrimaryKey(commitTable, rawCommit.ID)
+	repoToHeads = make(map[string][]*pfs.CommitInfo)
+	for _, group := range groups {
+		if !headMatchesStatus(group.Head, status) {
+			continue
+		}
+		repoToHeads[group.Head.Repo] = append(repoToHeads[group.Head.Repo], d.rawCommitToCommitInfo(group.Head))
+	}
+	return repoToHeads, nil
 }
 
-// checkFileType returns an error if the given type conflicts with the preexisting
-// type.  TODO: cache file types
-func (d *driver) checkFileType(repo string, commit string, path string, typ persist.FileType) (err error) {
-	diff, err := d.inspectFile(&pfs.File{
-		Commit: &pfs.Commit{
-			Repo: &pfs.Repo{
-				Name: repo,
-			},
-			ID: commit,
-		},
-		Path: path,
-	}, nil, nil)
+func (d *driver) CommitGraph(repo *pfs.Repo) (graph *drive.CommitGraph, retErr error) {
+	defer func(start time.Time) { d.report("CommitGraph", start, retErr, repoKeyValues(repo)...) }(time.Now())
+	if _, err := d.inspectRepo(repo); err != nil {
+		return nil, err
+	}
+	// Ordering by full clock puts parents before their children
+	cursor, err := d.betweenIndex(
+		commitTable, CommitFullClockIndex.Name,
+		[]interface{}{repo.Name, gorethink.MinVal},
+		[]interface{}{repo.Name, gorethink.MaxVal},
+		false,
+	).Run(d.dbClient)
 	if err != nil {
-		_, ok := err.(*pfsserver.ErrFileNotFound)
-		if ok {
-			// If the file was not found, then there's no type conflict
-			return nil
+		return nil, err
+	}
+	defer cursor.Close()
+	var rawCommits []*persist.Commit
+	if err := cursor.All(&rawCommits); err != nil {
+		return nil, err
+	}
+
+	graph = &drive.CommitGraph{
+		Heads: make(map[string]string),
+	}
+	parents := make(map[string]string)
+	for _, rawCommit := range rawCommits {
+		commitInfo := d.rawCommitToCommitInfo(rawCommit)
+		graph.Commits = append(graph.Commits, commitInfo)
+		// Commits come in clock order within a branch, so the last one
+		// seen is the head
+		graph.Heads[commitInfo.Branch] = commitInfo.Commit.ID
+		if commitInfo.ParentCommit != nil {
+			parents[commitInfo.Commit.ID] = commitInfo.ParentCommit.ID
 		}
-		return err
 	}
-	if diff.FileType != typ && diff.FileType != persist.FileType_NONE {
-		return errors.New(ErrConflictFileTypeMsg)
+	for _, commitInfo := range graph.Commits {
+		parentID, ok := parents[commitInfo.Commit.ID]
+		if !ok {
+			continue
+		}
+		parentClock, err := persist.StringToClock(parentID)
+		if err != nil {
+			return nil, err
+		}
+		graph.Edges = append(graph.Edges, &drive.CommitEdge{
+			Child:  commitInfo.Commit.ID,
+			Parent: parentID,
+			Fork:   parentClock.Branch != commitInfo.Branch,
+		})
 	}
-	return nil
+	if err := checkAcyclic(parents); err != nil {
+		return nil, err
+	}
+	return graph, nil
 }
 
-// checkPath checks if a file path is legal
-func checkPath(path string) error {
-	if strings.Contains(path, "\x00") {
-		return fmt.Errorf("filename cannot contain null character: %s", path)
+// checkAcyclic returns an error if following parents from any commit leads
+// back to it.  Parents derived from clocks can't form a cycle, so this only
+// guards clients walking the graph against corrupted clocks.
+func checkAcyclic(parents map[string]string) error {
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[string]int)
+	for commitID := range parents {
+		// Only the commits on the current path are being visited
+		id := commitID
+		var path []string
+		for state[id] != visited {
+			if state[id] == visiting {
+				return fmt.Errorf("commit %s is its own ancestor", id)
+			}
+			state[id] = visiting
+			path = append(path, id)
+			parentID, ok := parents[id]
+			if !ok {
+				break
+			}
+			id = parentID
+		}
+		for _, id := range path {
+			state[id] = visited
+		}
 	}
 	return nil
 }
 
-func (d *driver) PutFile(file *pfs.File, delimiter pfs.Delimiter, reader io.Reader) (retErr error) {
-	fixPath(file)
-	if err := checkPath(file.Path); err != nil {
+// DeleteBranch deletes all commits on a branch, along with their diffs.  It
+// refuses to delete a branch that other branches have been forked off of,
+// since the commits on those branches depend on the clocks of this branch.
+func (d *driver) DeleteBranch(repo *pfs.Repo, branch string) (retErr error) {
+	defer func(start time.Time) {
+		d.report("DeleteBranch", start, retErr, append(repoKeyValues(repo), "branch", branch)...)
+	}(time.Now())
+	if _, err := d.inspectRepo(repo); err != nil {
 		return err
 	}
-
-	// TODO: eventually optimize this with a cache so that we don't have to
-	// go to the database to figure out if the commit exists
-	commit, err := d.getRawCommit(file.Commit)
+	numCommits, err := d.count(d.getTerm(commitTable).GetAllByIndex(
+		CommitBranchIndex.Name,
+		commitBranchIndexKey(repo.Name, branch),
+	))
 	if err != nil {
 		return err
 	}
-	if commit.Finished != nil {
-		return pfsserver.NewErrCommitFinished(commit.Repo, commit.ID)
+	if numCommits == 0 {
+		return pfsserver.NewErrCommitNotFound(repo.Name, branch)
 	}
-	_client := client.APIClient{BlockAPIClient: d.blockClient}
-	blockrefs, err := _client.PutBlock(delimiter, reader)
+
+	forkedBranches, err := d.listForkedBranches(repo.Name, branch)
 	if err != nil {
 		return err
 	}
-
-	var refs []*persist.BlockRef
-	var size uint64
-	for _, blockref := range blockrefs.BlockRef {
-		ref := &persist.BlockRef{
-			Hash:  blockref.Block.Hash,
-			Upper: blockref.Range.Upper,
-			Lower: blockref.Range.Lower,
-		}
-		refs = append(refs, ref)
-		size += ref.Size()
+	if len(forkedBranches) > 0 {
+		return fmt.Errorf("cannot delete branch %s; the following branches were forked off of it: %v", branch, forkedBranches)
 	}
 
-	var diffs []*persist.Diff
-	// the ancestor directories
-	for _, prefix := range getPrefixes(file.Path) {
-		diffs = append(diffs, &persist.Diff{
-			ID:       getDiffID(commit.Repo, commit.ID, prefix),
-			Repo:     commit.Repo,
-			Delete:   false,
-			Path:     prefix,
-			Clock:    commit.FullClock,
-			FileType: persist.FileType_DIR,
-			Modified: now(),
-		})
+	// We delete commits before diffs for the same reason as in DeleteRepo.
+	if _, err := d.runWrite(d.getTerm(commitTable).GetAllByIndex(
+		CommitBranchIndex.Name,
+		commitBranchIndexKey(repo.Name, branch),
+	).Delete()); err != nil {
+		return err
 	}
 
-	// the file itself
-	diffs = append(diffs, &persist.Diff{
-		ID:        getDiffID(commit.Repo, commit.ID, file.Path),
-		Repo:      commit.Repo,
-		Delete:    false,
-		Path:      file.Path,
-		BlockRefs: refs,
-		Size:      size,
-		Clock:     commit.FullClock,
-		FileType:  persist.FileType_FILE,
-		Modified:  now(),
-	})
-
-	// Make sure that there's no type conflict
-	for _, diff := range diffs {
-		if err := d.checkFileType(file.Commit.Repo.Name, file.Commit.ID, diff.Path, diff.FileType); err != nil {
-			return err
-		}
+	if _, err := d.runWrite(d.betweenIndex(
+		diffTable, DiffClockIndex.Name,
+		diffClockIndexKey(repo.Name, branch, gorethink.MinVal),
+		diffClockIndexKey(repo.Name, branch, gorethink.MaxVal),
+		false,
+	).Delete()); err != nil {
+		return err
 	}
-
-	// Actually, we don't know if Rethink actually inserts these documents in
-	// order.  If it doesn't, then we might end up with "/foo/bar" but not
-	// "/foo", which is kinda problematic.
-	_, err = d.getTerm(diffTable).Insert(diffs, gorethink.InsertOpts{
-		Conflict: func(id gorethink.Term, oldDoc gorethink.Term, newDoc gorethink.Term) gorethink.Term {
-			return gorethink.Branch(
-				// We throw an error if the new diff is of a different file type
-				// than the old diff, unless the old diff is NONE
-				oldDoc.Field("FileType").Ne(persist.FileType_NONE).And(oldDoc.Field("FileType").Ne(newDoc.Field("FileType"))),
-				gorethink.Error(ErrConflictFileTypeMsg),
-				oldDoc.Merge(map[string]interface{}{
-					"BlockRefs": oldDoc.Field("BlockRefs").Add(newDoc.Field("BlockRefs")),
-					"Size":      oldDoc.Field("Size").Add(newDoc.Field("Size")),
-					// Overwrite the file type in case the old file type is NONE
-					"FileType": newDoc.Field("FileType"),
-					// Update modification time
-					"Modified": newDoc.Field("Modified"),
-				}),
-			)
-		},
-	}).RunWrite(d.dbClient)
-	return err
+	// The branch might be recreated, in which case its commits would reuse
+	// the IDs of the deleted commits.
+	d.fileTypes.purge()
+	return nil
 }
 
-func now() *google_protobuf.Timestamp {
-	return prototime.TimeToTimestamp(time.Now())
+// listForkedBranches returns the branches in repo that were forked off of
+// branch, directly or not.
+func (d *driver) listForkedBranches(repo string, branch string) ([]string, error) {
+	cursor, err := d.getTerm(commitTable).GetAllByIndex(CommitRepoIndex.Name, repo).Filter(func(commit gorethink.Term) gorethink.Term {
+		return gorethink.And(
+			commit.Field("FullClock").Nth(-1).Field("Branch").Ne(branch),
+			commit.Field("FullClock").Field("Branch").Contains(branch),
+		)
+	}).Map(func(commit gorethink.Term) gorethink.Term {
+		return commit.Field("FullClock").Nth(-1).Field("Branch")
+	}).Distinct().Run(d.dbClient)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var branches []string
+	if err := cursor.All(&branches); err != nil {
+		return nil, err
+	}
+	return branches, nil
 }
 
-func getPrefixes(path string) []string {
-	prefix := ""
-	parts := strings.Split(path, "/")
-	var res []string
-	// skip the last part; we only want prefixes
-	for i := 0; i < len(parts)-1; i++ {
-		if parts[i] != "" {
-			prefix += "/" + parts[i]
-			res = append(res, prefix)
+// listDownstreamRepos returns the repos that have repo in their provenance,
+// directly or not.
+func (d *driver) listDownstreamRepos(repo string) ([]string, error) {
+	cursor, err := d.getTerm(repoTable).Run(d.dbClient)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var repos []*persist.Repo
+	if err := cursor.All(&repos); err != nil {
+		return nil, err
+	}
+
+	downstream := map[string]bool{repo: true}
+	for changed := true; changed; {
+		changed = false
+		for _, r := range repos {
+			if downstream[r.Name] {
+				continue
+			}
+			for _, p := range r.Provenance {
+				if downstream[p] {
+					downstream[r.Name] = true
+					changed = true
+					break
+				}
+			}
 		}
 	}
-	return res
+	delete(downstream, repo)
+	var names []string
+	for name := range downstream {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
 }
 
-func getDiffID(repo string, commitID string, path string) string {
-	s := fmt.Sprintf("%s:%s:%s", repo, commitID, path)
-	hash := sha256.Sum256([]byte(s))
-	return hex.EncodeToString(hash[:])
+// sameCommitCopy returns true if b could be a as copied by RenameBranch.
+func sameCommitCopy(a *commitDocument, b *commitDocument) bool {
+	if a.ID != b.ID || len(a.FullClock) != len(b.FullClock) {
+		return false
+	}
+	for i, clock := range a.FullClock {
+		if clock.Branch != b.FullClock[i].Branch || clock.Clock != b.FullClock[i].Clock {
+			return false
+		}
+	}
+	if a.Started == nil || b.Started == nil {
+		return a.Started == b.Started
+	}
+	return a.Started.Seconds == b.Started.Seconds && a.Started.Nanos == b.Started.Nanos
 }
 
-func (d *driver) MakeDirectory(file *pfs.File) (retErr error) {
-	fixPath(file)
-	commit, err := d.getRawCommit(file.Commit)
-	if err != nil {
+// RenameBranch renames a branch.  Since the IDs of commits and diffs are
+// derived from the branch name, the commits and diffs on the branch are
+// reinserted under new IDs.  Note that RenameBranch is not atomic; you
+// should only use it if you are sure that no other client is operating on
+// the same repo.  Each step can be redone, and the commits under the old name
+// are only deleted at the end, so if RenameBranch fails halfway, calling it
+// again with the same arguments completes the rename.
+func (d *driver) RenameBranch(repo *pfs.Repo, oldName string, newName string) (retErr error) {
+	defer func(start time.Time) {
+		d.report("RenameBranch", start, retErr, append(repoKeyValues(repo), "branch", oldName)...)
+	}(time.Now())
+	if newName == "" || !isBranchName(newName) {
+		return fmt.Errorf("invalid branch name: %s", newName)
+	}
+	if _, err := d.inspectRepo(repo); err != nil {
 		return err
 	}
-	if commit.Finished != nil {
-		return pfsserver.NewErrCommitFinished(commit.Repo, commit.ID)
+	getCommits := func(branch string) ([]*commitDocument, error) {
+		cursor, err := d.getTerm(commitTable).GetAllByIndex(
+			CommitBranchIndex.Name,
+			commitBranchIndexKey(repo.Name, branch),
+		).Run(d.dbClient)
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close()
+		// Decoding into commitDocuments keeps the descriptions and metadata
+		var commits []*commitDocument
+		if err := cursor.All(&commits); err != nil {
+			return nil, err
+		}
+		return commits, nil
 	}
-
-	if err := d.checkFileType(file.Commit.Repo.Name, file.Commit.ID, file.Path, persist.FileType_DIR); err != nil {
+	commits, err := getCommits(oldName)
+	if err != nil {
 		return err
 	}
-
-	diff := &persist.Diff{
-		ID:       getDiffID(commit.Repo, commit.ID, file.Path),
-		Repo:     commit.Repo,
-		Delete:   false,
-		Path:     file.Path,
-		Clock:    commit.FullClock,
-		FileType: persist.FileType_DIR,
-		Modified: now(),
+	if len(commits) == 0 {
+		return pfsserver.NewErrCommitNotFound(repo.Name, oldName)
 	}
-	_, err = d.getTerm(diffTable).Insert(diff).RunWrite(d.dbClient)
-	return err
-}
-
-func reverseSlice(s []*persist.ClockRange) {
-	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
-		s[i], s[j] = s[j], s[i]
+	if oldName == newName {
+		return nil
 	}
-}
 
-// fixPath prepends a slash to the file path if there isn't one,
-// and removes the trailing slash if there is one.
-func fixPath(file *pfs.File) {
-	if len(file.Path) == 0 || file.Path[0] != '/' {
-		file.Path = "/" + file.Path
+	renameClocks := func(fullClock []*persist.Clock) {
+		for _, clock := range fullClock {
+			if clock.Branch == oldName {
+				clock.Branch = newName
+			}
+		}
 	}
-	if len(file.Path) > 1 && file.Path[len(file.Path)-1] == '/' {
-		file.Path = file.Path[:len(file.Path)-1]
+	var oldCommitIDs []interface{}
+	newCommitIDs := make(map[string]string)
+	renamedCommits := make(map[string]*commitDocument)
+	for _, commit := range commits {
+		oldCommitIDs = append(oldCommitIDs, commit.ID)
+		renameClocks(commit.FullClock)
+		newCommitIDs[commit.ID] = persist.NewCommitID(repo.Name, persist.FullClockHead(commit.FullClock))
+		commit.ID = newCommitIDs[commit.ID]
+		renamedCommits[commit.ID] = commit
 	}
-}
 
-func (d *driver) GetFile(file *pfs.File, filterShard *pfs.Shard, offset int64,
-	size int64, diffMethod *pfs.DiffMethod) (io.ReadCloser, error) {
-	fixPath(file)
-	diff, err := d.inspectFile(file, filterShard, diffMethod)
+	// The new branch may only exist because a previous call failed halfway,
+	// in which case its commits are copies of the ones we're renaming.
+	existing, err := getCommits(newName)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if diff.FileType == persist.FileType_DIR {
-		return nil, fmt.Errorf("file %s/%s/%s is directory", file.Commit.Repo.Name, file.Commit.ID, file.Path)
+	for _, commit := range existing {
+		if renamed, ok := renamedCommits[commit.ID]; !ok || !sameCommitCopy(renamed, commit) {
+			return fmt.Errorf("branch %s already exists in repo %s", newName, repo.Name)
+		}
 	}
-	return d.newFileReader(diff.BlockRefs, file, offset, size), nil
-}
-
-type fileReader struct {
-	blockClient pfs.BlockAPIClient
-	reader      io.Reader
-	offset      int64
-	size        int64 // how much data to read
-	sizeRead    int64 // how much data has been read
-	blockRefs   []*persist.BlockRef
-	file        *pfs.File
-}
+
+	// Reinsert the commits on the branch under their new IDs
+	if _, err := d.runWrite(d.getTerm(commitTable).Insert(commits, gorethink.InsertOpts{
+		Conflict: "replace",
+	})); err != nil {
+		return err
+	}
+
+	// Reinsert the diffs on the branch.  Diffs written by PutFile have IDs
+	// derived from their commit IDs; other diffs keep their IDs.
+	diffs, err := d.getDiffs(d.betweenIndex(
+		diffTable, DiffClockIndex.Name,
+		diffClockIndexKey(repo.Name, oldName, gorethink.MinVal),
+		diffClockIndexKey(repo.Name, oldName, gorethink.MaxVal),
+		false,
+	))
+	if err != nil {
+		return err
+	}
+	var oldDiffIDs []interface{}
+	for _, diff := range diffs {
+		oldCommitID := persist.NewCommitID(repo.Name, persist.FullClockHead(diff.Clock))
+		renameClocks(diff.Clock)
+		if diff.ID == getDiffID(repo.Name, oldCommitID, diff.Path) {
+			oldDiffIDs = append(oldDiffIDs, diff.ID)
+			diff.ID = getDiffID(repo.Name, newCommitIDs[oldCommitID], diff.Path)
+		}
+	}
+	if len(diffs) > 0 {
+		// The new diffs are written before the old ones are deleted, so that
+		// a failure doesn't lose any of them.  Diffs that keep their IDs are
+		// replaced in place.
+		if _, err := d.runWrite(d.getTerm(diffTable).Insert(diffs, gorethink.InsertOpts{
+			Conflict: "replace",
+		})); err != nil {
+			return err
+		}
+		if len(oldDiffIDs) > 0 {
+			if _, err := d.runWrite(d.getTerm(diffTable).GetAll(oldDiffIDs...).Delete()); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Commits and diffs on branches that were forked off of this branch still
+	// refer to it in their clocks.  We rename the clocks of the diffs first,
+	// since the forked branches are found through their commits.
+	forkedBranches, err := d.listForkedBranches(repo.Name, oldName)
+	if err != nil {
+		return err
+	}
+	renameFullClock := func(fullClock gorethink.Term) gorethink.Term {
+		return fullClock.Map(func(clock gorethink.Term) gorethink.Term {
+			return gorethink.Branch(
+				clock.Field("Branch").Eq(oldName),
+				clock.Merge(map[string]interface{}{
+					"Branch": newName,
+				}),
+				clock,
+			)
+		})
+	}
+	var forkedBranchKeys []interface{}
+	for _, branch := range forkedBranches {
+		forkedBranchKeys = append(forkedBranchKeys, commitBranchIndexKey(repo.Name, branch))
+		if _, err := d.runWrite(d.betweenIndex(
+			diffTable, DiffClockIndex.Name,
+			diffClockIndexKey(repo.Name, branch, gorethink.MinVal),
+			diffClockIndexKey(repo.Name, branch, gorethink.MaxVal),
+			false,
+		).Update(func(diff gorethink.Term) interface{} {
+			return map[string]interface{}{
+				"Clock": renameFullClock(diff.Field("Clock")),
+			}
+		})); err != nil {
+			return err
+		}
+	}
+	if len(forkedBranchKeys) > 0 {
+		if _, err := d.runWrite(d.getTerm(commitTable).GetAllByIndex(CommitBranchIndex.Name, forkedBranchKeys...).Update(func(commit gorethink.Term) interface{} {
+			return map[string]interface{}{
+				"FullClock": renameFullClock(commit.Field("FullClock")),
+			}
+		})); err != nil {
+			return err
+		}
+	}
+
+	// Commits in downstream repos refer to the commits on this branch in
+	// their provenance.
+	if err := d.renameProvenance(repo.Name, oldName, newName); err != nil {
+		return err
+	}
+
+	if _, err := d.runWrite(d.getTerm(commitTable).GetAll(oldCommitIDs...).Delete()); err != nil {
+		return err
+	}
+	d.fileTypes.purge()
+	return nil
+}
+
+// renameProvenance rewrites the provenance of the commits in the repos
+// downstream of repo that refer to commits on branch oldName, so that they
+// refer to the same commits on branch newName.
+func (d *driver) renameProvenance(repo string, oldName string, newName string) error {
+	downstreamRepos, err := d.listDownstreamRepos(repo)
+	if err != nil {
+		return err
+	}
+	if len(downstreamRepos) == 0 {
+		return nil
+	}
+	var keys []interface{}
+	for _, repoName := range downstreamRepos {
+		keys = append(keys, repoName)
+	}
+	cursor, err := d.getTerm(commitTable).GetAllByIndex(CommitRepoIndex.Name, keys...).Filter(func(commit gorethink.Term) gorethink.Term {
+		return commit.Field("Provenance").Field("Repo").Contains(repo)
+	}).Pluck("ID", "Provenance").Run(d.dbClient)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	var commits []*persist.Commit
+	if err := cursor.All(&commits); err != nil {
+		return err
+	}
+
+	for _, commit := range commits {
+		var renamed bool
+		for _, p := range commit.Provenance {
+			if p.Repo != repo {
+				continue
+			}
+			// Provenance recorded before it was stored by readable IDs may
+			// be a branch name or a relative ID, which we can't resolve
+			// once the branch is renamed anyway.
+			clock, err := parseClock(p.ID)
+			if err != nil {
+				continue
+			}
+			if clock.Branch == oldName {
+				clock.Branch = newName
+				p.ID = clock.ReadableCommitID()
+				renamed = true
+			}
+		}
+		if !renamed {
+			continue
+		}
+		if _, err := d.runWrite(d.getTerm(commitTable).Get(commit.ID).Update(map[string]interface{}{
+			"Provenance": commit.Provenance,
+		})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListDescendants returns the commits whose full clocks are reachable from
+// that of commit, in full clock order.
+func (d *driver) ListDescendants(commit *pfs.Commit) (commitInfos []*pfs.CommitInfo, retErr error) {
+	defer func(start time.Time) { d.report("ListDescendants", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	rawCommit, err := d.getRawCommit(commit)
+	if err != nil {
+		return nil, err
+	}
+	// Ordering by full clock puts parents before their children
+	cursor, err := d.betweenIndex(
+		commitTable, CommitFullClockIndex.Name,
+		[]interface{}{rawCommit.Repo, gorethink.MinVal},
+		[]interface{}{rawCommit.Repo, gorethink.MaxVal},
+		false,
+	).Filter(func(r gorethink.Term) gorethink.Term {
+		return persist.DBClockReachable(r.Field("FullClock"), gorethink.Expr(rawCommit.FullClock))
+	}).Run(d.dbClient)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var rawCommits []*persist.Commit
+	if err := cursor.All(&rawCommits); err != nil {
+		return nil, err
+	}
+	for _, rawCommit := range rawCommits {
+		commitInfos = append(commitInfos, d.rawCommitToCommitInfo(rawCommit))
+	}
+	return commitInfos, nil
+}
+
+// DeleteCommit deletes a commit.  Currently it only works if the commit is 1) the
+// head of a branch (i.e. it doesnt' have any descendents), and 2) it's not finished.
+// Note that currently DeleteCommit is not atomic/transactional.  You should only
+// use DeleteCommit if you are sure that no other client is operating on the same
+// branch.
+func (d *driver) DeleteCommit(commit *pfs.Commit) (retErr error) {
+	defer func(start time.Time) { d.report("DeleteCommit", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	rawCommit, err := d.getRawCommit(commit)
+	if err != nil {
+		return err
+	}
+	if rawCommit.Finished != nil {
+		return fmt.Errorf("commit %s is closed; only open commits can be deleted", commit.ID)
+	}
+
+	// if the commit ID is not just a branch name (e.g. master/2 or master^),
+	// we make sure that it's the head of a branch
+	if !isBranchName(commit.ID) {
+		head := &persist.Commit{}
+		branch := persist.FullClockBranch(rawCommit.FullClock)
+		if err := d.getHeadOfBranch(rawCommit.Repo, branch, head); err != nil {
+			return err
+		}
+		if head.ID != rawCommit.ID {
+			return fmt.Errorf("commit %s is not the head of branch %s; only the head of a branch can be deleted", commit.ID, branch)
+		}
+	}
+
+	clock := persist.FullClockHead(rawCommit.FullClock)
+	if _, err := d.runWrite(d.getTerm(diffTable).GetAllByIndex(DiffClockIndex.Name, diffClockIndexKey(rawCommit.Repo, clock.Branch, clock.Clock)).Delete()); err != nil {
+		return err
+	}
+	// A new commit might be created with the same ID as the deleted commit,
+	// so we can't trust any file types we cached for it.
+	d.fileTypes.purge()
+
+	return d.deleteMessageByPrimaryKey(commitTable, rawCommit.ID)
+}
+
+func (d *driver) RepairDiffs(repo *pfs.Repo) (removed int, retErr error) {
+	defer func(start time.Time) { d.report("RepairDiffs", start, retErr, repoKeyValues(repo)...) }(time.Now())
+	if _, err := d.inspectRepo(repo); err != nil {
+		return 0, err
+	}
+	res, err := d.runWrite(d.getTerm(diffTable).Filter(func(diff gorethink.Term) gorethink.Term {
+		return diff.Field("Repo").Eq(repo.Name).And(d.isOrphanedDiff(diff))
+	}).Delete())
+	if err != nil {
+		return 0, err
+	}
+	if res.Deleted > 0 {
+		// The removed diffs might have been cached as file types
+		d.fileTypes.purge()
+	}
+	return res.Deleted, nil
+}
+
+// isOrphanedDiff returns a term that's true if no commit has the clock of
+// diff.  See RepairDiffs for how diffs get orphaned.
+func (d *driver) isOrphanedDiff(diff gorethink.Term) gorethink.Term {
+	clock := diff.Field("Clock").Nth(-1)
+	return d.getTerm(commitTable).GetAllByIndex(CommitClockIndex.Name, commitClockIndexKey(diff.Field("Repo"), clock.Field("Branch"), clock.Field("Clock"))).IsEmpty()
+}
+
+// checkFileType returns an error if the given type conflicts with the preexisting
+// type.  File types are cached, so we only go to the database on a cache miss.
+func (d *driver) checkFileType(commit *persist.Commit, path string, typ persist.FileType) (err error) {
+	fileType, ok := d.fileTypes.get(commit.Repo, commit.ID, path)
+	if !ok {
+		diff, err := d.inspectFile(&pfs.File{
+			Commit: &pfs.Commit{
+				Repo: &pfs.Repo{
+					Name: commit.Repo,
+				},
+				ID: persist.FullClockHead(commit.FullClock).ReadableCommitID(),
+			},
+			Path: path,
+		}, nil, nil)
+		if err != nil {
+			_, ok := err.(*pfsserver.ErrFileNotFound)
+			if ok {
+				// If the file was not found, then there's no type conflict
+				return nil
+			}
+			return err
+		}
+		fileType = diff.FileType
+		if fileType != persist.FileType_NONE {
+			d.fileTypes.add(commit.Repo, commit.ID, path, fileType)
+		}
+	}
+	if fileType != typ && fileType != persist.FileType_NONE {
+		return newErrFileTypeConflict(path, fileType, typ)
+	}
+	return nil
+}
+
+// checkPath checks if a file path is legal
+func checkPath(path string) error {
+	if strings.Contains(path, "\x00") {
+		return fmt.Errorf("filename cannot contain null character: %s", path)
+	}
+	return nil
+}
+
+// checkShard checks that the file and block numbers of a shard filter are
+// within their moduli.  Otherwise the filter would silently match nothing.
+func checkShard(shard *pfs.Shard) error {
+	if shard == nil {
+		return nil
+	}
+	if shard.FileModulus != 0 && shard.FileNumber >= shard.FileModulus {
+		return pfsserver.NewErrInvalidShard(shard, fmt.Sprintf("file number %d is not less than file modulus %d", shard.FileNumber, shard.FileModulus))
+	}
+	if shard.BlockModulus != 0 && shard.BlockNumber >= shard.BlockModulus {
+		return pfsserver.NewErrInvalidShard(shard, fmt.Sprintf("block number %d is not less than block modulus %d", shard.BlockNumber, shard.BlockModulus))
+	}
+	return nil
+}
+
+// checkDelimiter checks that a delimiter is one of the values of
+// pfs.Delimiter.  The block server splits content by line for any value that
+// it doesn't know, which is unlikely to be what the caller meant.  The zero
+// value is Delimiter_NONE, so an unset delimiter is valid.
+func checkDelimiter(delimiter pfs.Delimiter) error {
+	if _, ok := pfs.Delimiter_name[int32(delimiter)]; !ok {
+		return pfsserver.NewErrInvalidDelimiter(delimiter)
+	}
+	return nil
+}
+
+func (d *driver) PutFile(file *pfs.File, delimiter pfs.Delimiter, reader io.Reader) (retErr error) {
+	defer func(start time.Time) { d.report("PutFile", start, retErr, fileKeyValues(file)...) }(time.Now())
+	_, err := d.putFile(file, delimiter, []io.Reader{reader}, false)
+	return err
+}
+
+func (d *driver) PutFileWithInfo(file *pfs.File, delimiter pfs.Delimiter, reader io.Reader) (fileInfo *pfs.FileInfo, retErr error) {
+	defer func(start time.Time) { d.report("PutFileWithInfo", start, retErr, fileKeyValues(file)...) }(time.Now())
+	commit, err := d.putFile(file, delimiter, []io.Reader{reader}, false)
+	if err != nil {
+		return nil, err
+	}
+	// The diff that was just written only holds the content written in this
+	// commit, so it's folded with those of the ancestors.  That's done in
+	// the commit that was written to, rather than in the current head of
+	// its branch.
+	fileInfo, _, err = d.inspectFileInfo(&pfs.File{
+		Commit: &pfs.Commit{
+			Repo: file.Commit.Repo,
+			ID:   persist.FullClockHead(commit.FullClock).ReadableCommitID(),
+		},
+		Path: file.Path,
+	}, nil, nil, false, false)
+	return fileInfo, err
+}
+
+func (d *driver) PutFileOverwrite(file *pfs.File, delimiter pfs.Delimiter, reader io.Reader) (retErr error) {
+	defer func(start time.Time) { d.report("PutFileOverwrite", start, retErr, fileKeyValues(file)...) }(time.Now())
+	_, err := d.putFile(file, delimiter, []io.Reader{reader}, true)
+	return err
+}
+
+func (d *driver) PutFileSplit(file *pfs.File, delimiter pfs.Delimiter, readers []io.Reader) (retErr error) {
+	defer func(start time.Time) { d.report("PutFileSplit", start, retErr, fileKeyValues(file)...) }(time.Now())
+	_, err := d.putFile(file, delimiter, readers, false)
+	return err
+}
+
+func (d *driver) PutFiles(commit *pfs.Commit, files []*drive.PutFileRequest) (retErr error) {
+	defer func(start time.Time) { d.report("PutFiles", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	rawCommit, err := d.getRawCommit(commit)
+	if err != nil {
+		return err
+	}
+	if rawCommit.Finished != nil {
+		return pfsserver.NewErrCommitFinished(rawCommit.Repo, rawCommit.ID)
+	}
+	paths := make([]string, len(files))
+	for i, file := range files {
+		_file := &pfs.File{Commit: commit, Path: file.Path}
+		fixPath(_file)
+		if err := checkPath(_file.Path); err != nil {
+			return err
+		}
+		if err := checkDelimiter(file.Delimiter); err != nil {
+			return err
+		}
+		paths[i] = _file.Path
+	}
+
+	refs := make([][]*persist.BlockRef, len(files))
+	sizes := make([]uint64, len(files))
+	errs := make([]error, len(files))
+	var wg sync.WaitGroup
+	for i, file := range files {
+		wg.Add(1)
+		go func(i int, file *drive.PutFileRequest) {
+			defer wg.Done()
+			refs[i], sizes[i], errs[i] = d.putBlocks(file.Delimiter, []io.Reader{file.Reader})
+		}(i, file)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	// Requests for the same path are merged so that each path is inserted
+	// once, with its content in the order of the requests.
+	var stagedFiles []*stagedFile
+	byPath := make(map[string]*stagedFile)
+	for i, path := range paths {
+		file, ok := byPath[path]
+		if !ok {
+			file = &stagedFile{path: path}
+			byPath[path] = file
+			stagedFiles = append(stagedFiles, file)
+		}
+		file.blockRefs = append(file.blockRefs, refs[i]...)
+		file.size += sizes[i]
+	}
+	if len(stagedFiles) == 0 {
+		return nil
+	}
+	return d.writeFiles(rawCommit, stagedFiles, false)
+}
+
+func (d *driver) PutFileHandle(file *pfs.File, handle string, delimiter pfs.Delimiter, reader io.Reader) (retErr error) {
+	defer func(start time.Time) { d.report("PutFileHandle", start, retErr, fileKeyValues(file)...) }(time.Now())
+	commit, err := d.getOpenRawCommitForFile(file)
+	if err != nil {
+		return err
+	}
+	refs, size, err := d.putBlocks(delimiter, []io.Reader{reader})
+	if err != nil {
+		return err
+	}
+	d.staged.add(commit.ID, handle, file.Path, refs, size)
+	// The commit may have been finished while the content was uploaded, in
+	// which case finishCommit has already discarded the content staged for
+	// it, and nothing would discard what we just staged.
+	current := &persist.Commit{}
+	if err := d.getMessageByPrimaryKey(commitTable, commit.ID, current); err != nil {
+		d.staged.remove(commit.ID, handle)
+		return err
+	}
+	if current.Finished != nil {
+		d.staged.remove(commit.ID, handle)
+		return pfsserver.NewErrCommitFinished(commit.Repo, commit.ID)
+	}
+	return nil
+}
+
+func (d *driver) CommitFileHandle(commit *pfs.Commit, handle string) (retErr error) {
+	defer func(start time.Time) { d.report("CommitFileHandle", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	rawCommit, err := d.getRawCommit(commit)
+	if err != nil {
+		return err
+	}
+	if rawCommit.Finished != nil {
+		return pfsserver.NewErrCommitFinished(rawCommit.Repo, rawCommit.ID)
+	}
+	files := d.staged.remove(rawCommit.ID, handle)
+	if len(files) == 0 {
+		return pfsserver.NewErrHandleNotFound(handle, rawCommit.Repo, commit.ID)
+	}
+	return d.writeFiles(rawCommit, files, false)
+}
+
+func (d *driver) AbortFileHandle(commit *pfs.Commit, handle string) (retErr error) {
+	defer func(start time.Time) { d.report("AbortFileHandle", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	rawCommit, err := d.getRawCommit(commit)
+	if err != nil {
+		return err
+	}
+	d.staged.remove(rawCommit.ID, handle)
+	return nil
+}
+
+// putFile writes the content of readers to file, concatenated in the order
+// of the readers.  The readers are uploaded concurrently.  By default, the
+// content is appended to whatever was written to the file so far.  If
+// overwrite is set, the content replaces what was written to the file in
+// this commit, and the diff is marked as a deletion so that foldDiffs
+// discards the content of the file in previous commits as well.  The
+// commit that the file was written to is returned.
+func (d *driver) putFile(file *pfs.File, delimiter pfs.Delimiter, readers []io.Reader, overwrite bool) (*persist.Commit, error) {
+	commit, err := d.getOpenRawCommitForFile(file)
+	if err != nil {
+		return nil, err
+	}
+	refs, size, err := d.putBlocks(delimiter, readers)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.writeFiles(commit, []*stagedFile{{
+		path:      file.Path,
+		blockRefs: refs,
+		size:      size,
+	}}, overwrite); err != nil {
+		return nil, err
+	}
+	return commit, nil
+}
+
+// getOpenRawCommitForFile fixes the path of a file that's about to be
+// written, and returns the commit that it's written to, which must be open.
+func (d *driver) getOpenRawCommitForFile(file *pfs.File) (*persist.Commit, error) {
+	fixPath(file)
+	if err := checkPath(file.Path); err != nil {
+		return nil, err
+	}
+
+	// TODO: eventually optimize this with a cache so that we don't have to
+	// go to the database to figure out if the commit exists
+	commit, err := d.getRawCommit(file.Commit)
+	if err != nil {
+		return nil, err
+	}
+	if commit.Finished != nil {
+		return nil, pfsserver.NewErrCommitFinished(commit.Repo, commit.ID)
+	}
+	return commit, nil
+}
+
+// putBlocks uploads the content of readers to the block server concurrently,
+// and returns the resulting blockrefs in the order of the readers, along
+// with their total size.
+func (d *driver) putBlocks(delimiter pfs.Delimiter, readers []io.Reader) ([]*persist.BlockRef, uint64, error) {
+	if err := checkDelimiter(delimiter); err != nil {
+		return nil, 0, err
+	}
+	_client := client.APIClient{BlockAPIClient: d.blockClient}
+	blockRefs := make([]*pfs.BlockRefs, len(readers))
+	errs := make([]error, len(readers))
+	var wg sync.WaitGroup
+	for i, reader := range readers {
+		wg.Add(1)
+		go func(i int, reader io.Reader) {
+			defer wg.Done()
+			if d.dedupBlocks {
+				blockRefs[i], errs[i] = d.putBlockDedup(delimiter, reader)
+			} else {
+				blockRefs[i], errs[i] = _client.PutBlock(delimiter, reader)
+			}
+		}(i, reader)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var refs []*persist.BlockRef
+	var size uint64
+	for _, blockrefs := range blockRefs {
+		for _, blockref := range blockrefs.BlockRef {
+			ref := &persist.BlockRef{
+				Hash:  blockref.Block.Hash,
+				Upper: blockref.Range.Upper,
+				Lower: blockref.Range.Lower,
+			}
+			refs = append(refs, ref)
+			size += ref.Size()
+		}
+	}
+	return refs, size, nil
+}
+
+// putBlockDedup is the same as PutBlock, except that it splits the content
+// into blocks and hashes them locally, and only uploads the blocks that the
+// block server doesn't have yet.  Empty blocks are left out, since they
+// don't contribute to the content.
+func (d *driver) putBlockDedup(delimiter pfs.Delimiter, reader io.Reader) (*pfs.BlockRefs, error) {
+	_client := client.APIClient{BlockAPIClient: d.blockClient}
+	result := &pfs.BlockRefs{}
+	bufReader := bufio.NewReader(reader)
+	if _, err := bufReader.Peek(1); err == io.EOF {
+		return result, nil
+	}
+	decoder := json.NewDecoder(bufReader)
+	for {
+		blockRef, data, err := pfsserver.ReadBlock(delimiter, bufReader, decoder)
+		if err != nil {
+			return nil, err
+		}
+		size := blockRef.Range.Upper - blockRef.Range.Lower
+		if size > 0 {
+			// InspectBlock fails if the block doesn't exist
+			if _, err := _client.InspectBlock(blockRef.Block.Hash); err != nil {
+				if _, err := _client.PutBlock(delimiter, bytes.NewReader(data)); err != nil {
+					return nil, err
+				}
+			}
+			result.BlockRef = append(result.BlockRef, blockRef)
+		}
+		if size < pfsserver.BlockSize {
+			break
+		}
+	}
+	return result, nil
+}
+
+// writeFiles inserts the diffs of files, along with those of their ancestor
+// directories, into an open commit.  See putFile for the meaning of
+// overwrite.
+//
+// Rethink doesn't insert the documents of a single write in any particular
+// order, so the directories are inserted one level at a time, from the root
+// down, and the files last.  That way a path never exists without its
+// ancestors.  If an insert fails, the diffs written by the previous ones are
+// rolled back.
+func (d *driver) writeFiles(commit *persist.Commit, files []*stagedFile, overwrite bool) error {
+	var diffs []*persist.Diff
+	var size uint64
+	// the ancestor directories, grouped by depth
+	dirsByDepth := make(map[int][]*persist.Diff)
+	var depths []int
+	seen := make(map[string]bool)
+	for _, file := range files {
+		for _, prefix := range getPrefixes(file.path) {
+			if seen[prefix] {
+				continue
+			}
+			seen[prefix] = true
+			diff := &persist.Diff{
+				ID:       getDiffID(commit.Repo, commit.ID, prefix),
+				Repo:     commit.Repo,
+				Delete:   false,
+				Path:     prefix,
+				Clock:    commit.FullClock,
+				FileType: persist.FileType_DIR,
+				Modified: now(),
+			}
+			diffs = append(diffs, diff)
+			depth := strings.Count(prefix, "/")
+			if _, ok := dirsByDepth[depth]; !ok {
+				depths = append(depths, depth)
+			}
+			dirsByDepth[depth] = append(dirsByDepth[depth], diff)
+		}
+	}
+	sort.Ints(depths)
+	var batches [][]*persist.Diff
+	for _, depth := range depths {
+		batches = append(batches, dirsByDepth[depth])
+	}
+
+	// the files themselves
+	var fileDiffs []*persist.Diff
+	for _, file := range files {
+		diff := &persist.Diff{
+			ID:        getDiffID(commit.Repo, commit.ID, file.path),
+			Repo:      commit.Repo,
+			Delete:    overwrite,
+			Path:      file.path,
+			BlockRefs: file.blockRefs,
+			Size:      file.size,
+			Clock:     commit.FullClock,
+			FileType:  persist.FileType_FILE,
+			Modified:  now(),
+		}
+		diffs = append(diffs, diff)
+		fileDiffs = append(fileDiffs, diff)
+		size += file.size
+	}
+	batches = append(batches, fileDiffs)
+
+	// Make sure that there's no type conflict
+	for _, diff := range diffs {
+		if err := d.checkFileType(commit, diff.Path, diff.FileType); err != nil {
+			return err
+		}
+	}
+
+	var changes []gorethink.ChangeResponse
+	for _, batch := range batches {
+		res, err := d.insertDiffs(batch, overwrite)
+		changes = append(changes, res.Changes...)
+		if err != nil {
+			err = asFileTypeConflict(err)
+			if rollbackErr := d.rollbackDiffs(changes); rollbackErr != nil {
+				return fmt.Errorf("%v; additionally, the diffs that were already written could not be rolled back: %v", err, rollbackErr)
+			}
+			return err
+		}
+	}
+	// When overwriting, the data previously written to the file in this
+	// commit no longer counts towards the size of the commit.
+	var replaced uint64
+	if overwrite {
+		replaced = replacedSize(changes)
+	}
+	if err := d.addCommitSize(commit.ID, int64(size)-int64(replaced)); err != nil {
+		return err
+	}
+
+	for _, diff := range diffs {
+		d.fileTypes.add(commit.Repo, commit.ID, diff.Path, diff.FileType)
+	}
+	return nil
+}
+
+// insertDiffs inserts diffs in a single write, merging each of them into the
+// existing diff with the same ID, if any.  The changes of the write are
+// returned even if it fails, since some of the diffs might have been written.
+func (d *driver) insertDiffs(diffs []*persist.Diff, overwrite bool) (gorethink.WriteResponse, error) {
+	return d.runWrite(d.getTerm(diffTable).Insert(diffs, gorethink.InsertOpts{
+		Conflict: func(id gorethink.Term, oldDoc gorethink.Term, newDoc gorethink.Term) gorethink.Term {
+			merged := map[string]interface{}{
+				"BlockRefs": oldDoc.Field("BlockRefs").Add(newDoc.Field("BlockRefs")),
+				"Size":      oldDoc.Field("Size").Add(newDoc.Field("Size")),
+				// Overwrite the file type in case the old file type is NONE
+				"FileType": newDoc.Field("FileType"),
+				// Update modification time
+				"Modified": newDoc.Field("Modified"),
+			}
+			if overwrite {
+				merged["BlockRefs"] = newDoc.Field("BlockRefs").Default([]interface{}{})
+				merged["Size"] = newDoc.Field("Size").Default(0)
+				merged["Delete"] = oldDoc.Field("Delete").Default(false).Or(newDoc.Field("Delete").Default(false))
+			}
+			return gorethink.Branch(
+				// We throw an error if the new diff is of a different file type
+				// than the old diff, unless the old diff is NONE
+				oldDoc.Field("FileType").Ne(persist.FileType_NONE).And(oldDoc.Field("FileType").Ne(newDoc.Field("FileType"))),
+				fileTypeConflict(oldDoc.Field("Path"), oldDoc.Field("FileType"), newDoc.Field("FileType")),
+				oldDoc.Merge(merged),
+			)
+		},
+		ReturnChanges: true,
+	}))
+}
+
+// rollbackDiffs undoes the changes made by insertDiffs: new diffs are
+// deleted and merged diffs are restored to their old value.  Writes made to
+// the same diffs in the meantime are lost.
+func (d *driver) rollbackDiffs(changes []gorethink.ChangeResponse) error {
+	var insertedIDs []interface{}
+	var oldDocs []interface{}
+	for _, change := range changes {
+		newVal, ok := change.NewValue.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if change.OldValue == nil {
+			insertedIDs = append(insertedIDs, newVal["ID"])
+		} else {
+			oldDocs = append(oldDocs, change.OldValue)
+		}
+	}
+	if len(insertedIDs) > 0 {
+		if _, err := d.runWrite(d.getTerm(diffTable).GetAll(insertedIDs...).Delete()); err != nil {
+			return err
+		}
+	}
+	if len(oldDocs) > 0 {
+		if _, err := d.runWrite(d.getTerm(diffTable).Insert(oldDocs, gorethink.InsertOpts{Conflict: "replace"})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timestampBefore returns a term that's true if the timestamp stored in ts is
+// strictly before t.  Timestamps are compared field by field because their
+// total number of nanoseconds doesn't fit exactly in a rethinkdb number.
+func timestampBefore(ts gorethink.Term, t *google_protobuf.Timestamp) gorethink.Term {
+	// The fields are omitted from the database when they are zero
+	seconds := ts.Field("seconds").Default(0)
+	nanos := ts.Field("nanos").Default(0)
+	return seconds.Lt(t.Seconds).Or(seconds.Eq(t.Seconds).And(nanos.Lt(t.Nanos)))
+}
+
+// startedSeconds and startedNanos return the parts of the time a commit was
+// started, for ordering commits by it.
+func startedSeconds(commit gorethink.Term) gorethink.Term {
+	// The fields are omitted from the database when they are zero
+	return commit.Field("Started").Field("seconds").Default(0)
+}
+
+func startedNanos(commit gorethink.Term) gorethink.Term {
+	return commit.Field("Started").Field("nanos").Default(0)
+}
+
+func now() *google_protobuf.Timestamp {
+	return prototime.TimeToTimestamp(time.Now())
+}
+
+// getPrefixes returns the ancestor directories of a path, excluding the
+// root, from the outermost in.  The path must be canonical; see fixPath.
+func getPrefixes(path string) []string {
+	prefix := ""
+	parts := strings.Split(path, "/")
+	var res []string
+	// skip the last part; we only want prefixes
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] != "" {
+			prefix += "/" + parts[i]
+			res = append(res, prefix)
+		}
+	}
+	return res
+}
+
+func getDiffID(repo string, commitID string, path string) string {
+	s := fmt.Sprintf("%s:%s:%s", repo, commitID, path)
+	hash := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(hash[:])
+}
+
+func (d *driver) MakeDirectory(file *pfs.File) (retErr error) {
+	defer func(start time.Time) { d.report("MakeDirectory", start, retErr, fileKeyValues(file)...) }(time.Now())
+	fixPath(file)
+	commit, err := d.getRawCommit(file.Commit)
+	if err != nil {
+		return err
+	}
+	if commit.Finished != nil {
+		return pfsserver.NewErrCommitFinished(commit.Repo, commit.ID)
+	}
+
+	// Materialize the directory along with its ancestors, so that it shows
+	// up even if it's empty.
+	var diffs []*persist.Diff
+	for _, path := range append(getPrefixes(file.Path), file.Path) {
+		diffs = append(diffs, &persist.Diff{
+			ID:       getDiffID(commit.Repo, commit.ID, path),
+			Repo:     commit.Repo,
+			Delete:   false,
+			Path:     path,
+			Clock:    commit.FullClock,
+			FileType: persist.FileType_DIR,
+			Modified: now(),
+		})
+	}
+
+	for _, diff := range diffs {
+		if err := d.checkFileType(commit, diff.Path, diff.FileType); err != nil {
+			return err
+		}
+	}
+
+	_, err = d.runWrite(d.getTerm(diffTable).Insert(diffs, gorethink.InsertOpts{
+		Conflict: func(id gorethink.Term, oldDoc gorethink.Term, newDoc gorethink.Term) gorethink.Term {
+			return gorethink.Branch(
+				oldDoc.Field("FileType").Ne(persist.FileType_NONE).And(oldDoc.Field("FileType").Ne(newDoc.Field("FileType"))),
+				fileTypeConflict(oldDoc.Field("Path"), oldDoc.Field("FileType"), newDoc.Field("FileType")),
+				oldDoc.Merge(map[string]interface{}{
+					"FileType": newDoc.Field("FileType"),
+					"Modified": newDoc.Field("Modified"),
+				}),
+			)
+		},
+	}))
+	if err != nil {
+		return asFileTypeConflict(err)
+	}
+
+	for _, diff := range diffs {
+		d.fileTypes.add(commit.Repo, commit.ID, diff.Path, diff.FileType)
+	}
+	return nil
+}
+
+func (d *driver) CopyFile(src *pfs.File, dst *pfs.File) (retErr error) {
+	defer func(start time.Time) { d.report("CopyFile", start, retErr, fileKeyValues(src)...) }(time.Now())
+	fixPath(src)
+	commit, err := d.getOpenRawCommitForFile(dst)
+	if err != nil {
+		return err
+	}
+	files, err := d.getCopiedFiles(src, dst.Path)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return d.MakeDirectory(dst)
+	}
+	return d.writeFiles(commit, files, true)
+}
+
+// MoveFile copies src to dst like CopyFile, and then deletes src.  Both must
+// be in the same open commit.
+//
+// The copy and the deletion are separate writes, so that the content is
+// never missing: if the copy fails, it's rolled back and src is untouched,
+// but if the deletion fails, dst has been written and src may be partially
+// deleted.  Retrying the move finishes it in that case, since copying
+// overwrites dst.
+func (d *driver) MoveFile(src *pfs.File, dst *pfs.File) (retErr error) {
+	defer func(start time.Time) { d.report("MoveFile", start, retErr, fileKeyValues(src)...) }(time.Now())
+	fixPath(src)
+	commit, err := d.getOpenRawCommitForFile(dst)
+	if err != nil {
+		return err
+	}
+	srcCommit, err := d.getRawCommit(src.Commit)
+	if err != nil {
+		return err
+	}
+	if srcCommit.ID != commit.ID {
+		return fmt.Errorf("cannot move %s/%s/%s to another commit", src.Commit.Repo.Name, src.Commit.ID, src.Path)
+	}
+	if src.Path == "/" || dst.Path == src.Path || strings.HasPrefix(dst.Path, src.Path+"/") {
+		return fmt.Errorf("cannot move %s to %s", src.Path, dst.Path)
+	}
+
+	files, err := d.getCopiedFiles(src, dst.Path)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		err = d.MakeDirectory(dst)
+	} else {
+		err = d.writeFiles(commit, files, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	paths, err := d.getDescendantPaths(commit.Repo, src)
+	if err != nil {
+		return err
+	}
+	return d.deletePaths(commit, append(paths, src.Path))
+}
+
+// getCopiedFiles returns the regular files that copying src to dstPath
+// writes: src itself if it's a regular file, or the regular files under it
+// if it's a directory.
+func (d *driver) getCopiedFiles(src *pfs.File, dstPath string) ([]*stagedFile, error) {
+	// src is read with several queries, which must see the same commit
+	srcCommit, err := d.pinCommit(src.Commit)
+	if err != nil {
+		return nil, err
+	}
+	src = &pfs.File{
+		Commit: srcCommit,
+		Path:   src.Path,
+	}
+	diff, err := d.inspectFile(src, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if diff.FileType != persist.FileType_DIR {
+		return []*stagedFile{{
+			path:      dstPath,
+			blockRefs: diff.BlockRefs,
+			size:      diff.Size,
+		}}, nil
+	}
+
+	diffs, err := d.getDescendantFiles(src.Commit.Repo.Name, src)
+	if err != nil {
+		return nil, err
+	}
+	var files []*stagedFile
+	for _, diff := range diffs {
+		files = append(files, &stagedFile{
+			path:      path.Join(dstPath, strings.TrimPrefix(diff.Path, src.Path)),
+			blockRefs: diff.BlockRefs,
+			size:      diff.Size,
+		})
+	}
+	return files, nil
+}
+
+func reverseSlice(s []*persist.ClockRange) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
+
+// fixPath canonicalizes the file path: it prepends a slash if there isn't
+// one, removes the trailing slash if there is one, collapses repeated
+// slashes, and resolves "." and ".." components, e.g. "a//b/../c/" becomes
+// "/a/c".  ".." components can't go above the root.
+func fixPath(file *pfs.File) {
+	file.Path = path.Clean("/" + file.Path)
+}
+
+func (d *driver) GetFile(file *pfs.File, filterShard *pfs.Shard, offset int64,
+	size int64, diffMethod *pfs.DiffMethod, concatDir bool) (reader io.ReadCloser, retErr error) {
+	defer func(start time.Time) { d.report("GetFile", start, retErr, fileKeyValues(file)...) }(time.Now())
+	fixPath(file)
+	// A directory is read with several queries, which must all see the
+	// same commit even if new commits land on the branch meanwhile
+	commit, err := d.pinCommit(file.Commit)
+	if err != nil {
+		return nil, err
+	}
+	file = &pfs.File{
+		Commit: commit,
+		Path:   file.Path,
+	}
+	diff, err := d.inspectFile(file, filterShard, diffMethod)
+	if err != nil {
+		return nil, err
+	}
+	if diff.FileType == persist.FileType_DIR {
+		if !concatDir {
+			return nil, fmt.Errorf("file %s/%s/%s is directory", file.Commit.Repo.Name, file.Commit.ID, file.Path)
+		}
+		blockRefs, err := d.getDirBlockRefs(file, filterShard, diffMethod)
+		if err != nil {
+			return nil, err
+		}
+		return d.newRangeReader(blockRefs, file, offset, size)
+	}
+	return d.newRangeReader(diff.BlockRefs, file, offset, size)
+}
+
+// newRangeReader is the same as newFileReader, except that it checks the
+// range to read against the size of the content: a range that starts past
+// the end is an error, and one that ends past the end is shortened.
+func (d *driver) newRangeReader(blockRefs []*persist.BlockRef, file *pfs.File, offset int64, size int64) (*fileReader, error) {
+	var totalSize uint64
+	for _, blockRef := range blockRefs {
+		totalSize += blockRef.Size()
+	}
+	if offset < 0 || offset > int64(totalSize) {
+		return nil, pfsserver.NewErrRangeOutOfBounds(file.Path, offset, totalSize)
+	}
+	if size > int64(totalSize)-offset {
+		size = int64(totalSize) - offset
+	}
+	return d.newFileReader(blockRefs, file, offset, size), nil
+}
+
+func (d *driver) GetFiles(commit *pfs.Commit, glob string, filterShard *pfs.Shard) (readers map[string]io.ReadCloser, retErr error) {
+	defer func(start time.Time) { d.report("GetFiles", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	if err := checkShard(filterShard); err != nil {
+		return nil, err
+	}
+	patternComponents, root, err := parseGlob(glob)
+	if err != nil {
+		return nil, err
+	}
+	diffs, err := d.getDescendantFiles(commit.Repo.Name, &pfs.File{
+		Commit: commit,
+		Path:   root,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	readers = make(map[string]io.ReadCloser)
+	for _, diff := range diffs {
+		if !globMatch(patternComponents, strings.Split(diff.Path, "/")) {
+			continue
+		}
+		file := &pfs.File{
+			Commit: commit,
+			Path:   diff.Path,
+		}
+		if !pfsserver.FileInShard(filterShard, file) {
+			continue
+		}
+		diff, err := filterBlocks(diff, filterShard, file)
+		if err != nil {
+			if _, ok := err.(*pfsserver.ErrFileNotFound); ok {
+				continue
+			}
+			return nil, err
+		}
+		readers[diff.Path] = d.newFileReader(diff.BlockRefs, file, 0, 0)
+	}
+	return readers, nil
+}
+
+// parseGlob splits a glob into its path components and returns them along
+// with the longest directory that the glob spells out literally, which is
+// the only directory that paths matching the glob can be under.
+func parseGlob(glob string) ([]string, string, error) {
+	pattern := &pfs.File{Path: glob}
+	fixPath(pattern)
+	patternComponents := strings.Split(pattern.Path, "/")
+	for _, component := range patternComponents {
+		if _, err := path.Match(component, ""); err != nil {
+			return nil, "", fmt.Errorf("invalid glob %s: %v", glob, err)
+		}
+	}
+
+	root := "/"
+	for _, component := range patternComponents[1 : len(patternComponents)-1] {
+		if strings.ContainsAny(component, "*?[\\") {
+			break
+		}
+		root = path.Join(root, component)
+	}
+	return patternComponents, root, nil
+}
+
+// globMatch reports whether the components of a path match the components of
+// a glob.  A "**" component matches any number of path components, including
+// none, and other components are matched with path.Match.
+func globMatch(patternComponents []string, pathComponents []string) bool {
+	if len(patternComponents) == 0 {
+		return len(pathComponents) == 0
+	}
+	if patternComponents[0] == "**" {
+		for i := 0; i <= len(pathComponents); i++ {
+			if globMatch(patternComponents[1:], pathComponents[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(pathComponents) == 0 {
+		return false
+	}
+	// We've checked that the pattern is well-formed, so Match doesn't fail
+	if match, _ := path.Match(patternComponents[0], pathComponents[0]); !match {
+		return false
+	}
+	return globMatch(patternComponents[1:], pathComponents[1:])
+}
+
+func (d *driver) GetFileBlockRefs(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) (blockRefs []*persist.BlockRef, retErr error) {
+	defer func(start time.Time) { d.report("GetFileBlockRefs", start, retErr, fileKeyValues(file)...) }(time.Now())
+	fixPath(file)
+	diff, err := d.inspectFile(file, filterShard, diffMethod)
+	if err != nil {
+		return nil, err
+	}
+	if diff.FileType == persist.FileType_DIR {
+		return nil, fmt.Errorf("file %s/%s/%s is directory", file.Commit.Repo.Name, file.Commit.ID, file.Path)
+	}
+	return diff.BlockRefs, nil
+}
+
+// getDirBlockRefs returns the blockrefs of all regular files directly under
+// the given directory, concatenated in path order.
+func (d *driver) getDirBlockRefs(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) ([]*persist.BlockRef, error) {
+	diffs, err := d.getChildrenRecursive(file.Commit.Repo.Name, file, diffMethod, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var blockRefs []*persist.BlockRef
+	for _, diff := range diffs {
+		if diff.FileType != persist.FileType_FILE {
+			continue
+		}
+		child := &pfs.File{
+			Commit: file.Commit,
+			Path:   diff.Path,
+		}
+		if !pfsserver.FileInShard(filterShard, child) {
+			continue
+		}
+		diff, err := filterBlocks(diff, filterShard, child)
+		if err != nil {
+			if _, ok := err.(*pfsserver.ErrFileNotFound); ok {
+				continue
+			}
+			return nil, err
+		}
+		blockRefs = append(blockRefs, diff.BlockRefs...)
+	}
+	return blockRefs, nil
+}
+
+type fileReader struct {
+	blockClient pfs.BlockAPIClient
+	blockCache  *blockCache
+	reader      io.Reader
+	offset      int64
+	size        int64 // how much data to read
+	sizeRead    int64 // how much data has been read
+	blockRefs   []*persist.BlockRef
+	file        *pfs.File
+	// verifyBlocks is set if blocks are checked against their hashes
+	verifyBlocks bool
+	// ctx is cancelled when the reader is closed, which aborts any in-flight
+	// block fetch.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
 
 func (d *driver) newFileReader(blockRefs []*persist.BlockRef, file *pfs.File, offset int64, size int64) *fileReader {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &fileReader{
-		blockClient: d.blockClient,
-		blockRefs:   blockRefs,
-		offset:      offset,
-		size:        size,
-		file:        file,
+		blockClient:  d.blockClient,
+		blockCache:   d.blockCache,
+		blockRefs:    coalesceBlockRefs(blockRefs),
+		offset:       offset,
+		size:         size,
+		file:         file,
+		verifyBlocks: d.verifyBlocks,
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+// coalesceBlockRefs merges each run of blockrefs that are adjacent ranges
+// of the same block into a single blockref, so that the run is fetched with
+// one GetBlock.  The content of the blockrefs stays the same.
+func coalesceBlockRefs(blockRefs []*persist.BlockRef) []*persist.BlockRef {
+	var result []*persist.BlockRef
+	for _, blockRef := range blockRefs {
+		if len(result) > 0 {
+			last := result[len(result)-1]
+			if last.Hash == blockRef.Hash && last.Upper == blockRef.Lower {
+				// Copy, since the blockref may be shared with the diff
+				result[len(result)-1] = &persist.BlockRef{
+					Hash:  last.Hash,
+					Lower: last.Lower,
+					Upper: blockRef.Upper,
+				}
+				continue
+			}
+		}
+		result = append(result, blockRef)
 	}
+	return result
 }
 
 // filterBlocks filters out blockrefs for a given diff, or return a FileNotFound
 // error if all of the blockrefs have been figured out, except that we want to
 // make sure that there's at least one shard that matches a given empty diff
 func filterBlocks(diff *persist.Diff, filterShard *pfs.Shard, file *pfs.File) (*persist.Diff, error) {
+	if filterShard == nil || filterShard.BlockModulus <= 1 {
+		// Every block is in the shard, so there's no need to hash them
+		return diff, nil
+	}
 	if len(diff.BlockRefs) == 0 {
 		// If the file is empty, we want to make sure that it's seen by one shard.
 		if !pfsserver.BlockInShard(filterShard, file, nil) {
@@ -1359,36 +4079,55 @@ func filterBlocks(diff *persist.Diff, filterShard *pfs.Shard, file *pfs.File) (*
 	return diff, nil
 }
 
+// seekToOffset returns the index of the blockref that holds the byte at
+// offset in the content of blockRefs, along with the offset of that byte
+// within the blockref.  Empty blockrefs never hold a byte, so they're
+// skipped.  If offset is at or past the end of the content, the index is
+// len(blockRefs) and the offset is how far past the end it is.
+func seekToOffset(blockRefs []*persist.BlockRef, offset int64) (int, int64) {
+	for i, blockRef := range blockRefs {
+		size := int64(blockRef.Size())
+		if offset < size {
+			return i, offset
+		}
+		offset -= size
+	}
+	return len(blockRefs), offset
+}
+
 func (r *fileReader) Read(data []byte) (int, error) {
-	var err error
+	if r.ctx.Err() != nil {
+		return 0, ErrReaderClosed
+	}
 	if r.reader == nil {
-		var blockRef *persist.BlockRef
-		for {
-			if len(r.blockRefs) == 0 {
-				return 0, io.EOF
-			}
-			blockRef = r.blockRefs[0]
-			r.blockRefs = r.blockRefs[1:]
-			blockSize := int64(blockRef.Size())
-			if r.offset >= blockSize {
-				r.offset -= blockSize
-				continue
-			}
-			break
+		i, offset := seekToOffset(r.blockRefs, r.offset)
+		if i == len(r.blockRefs) {
+			return 0, io.EOF
 		}
-		client := client.APIClient{BlockAPIClient: r.blockClient}
-		sizeLeft := r.size
-		// e.g. sometimes a reader is constructed of size 0
-		if sizeLeft != 0 {
-			sizeLeft -= r.sizeRead
+		blockRef := r.blockRefs[i]
+		r.blockRefs = r.blockRefs[i+1:]
+		r.offset = offset
+		// Only fetch the part of the block that's read: the rest of the
+		// block, unless the read ends before that.  A reader of size 0 reads
+		// until the end of the file.
+		size := int64(blockRef.Size()) - r.offset
+		if r.size != 0 && r.size-r.sizeRead < size {
+			size = r.size - r.sizeRead
 		}
-		r.reader, err = client.GetBlock(blockRef.Hash, uint64(r.offset), uint64(sizeLeft))
+		reader, err := getBlockRange(r.ctx, r.blockClient, r.blockCache, blockRef.Hash, r.offset, size, r.verifyBlocks)
 		if err != nil {
 			return 0, err
 		}
+		r.reader = reader
 		r.offset = 0
 	}
 	size, err := r.reader.Read(data)
+	if r.ctx.Err() != nil {
+		// The reader was closed during the read, but the data that was read
+		// before that is still good.
+		r.sizeRead += int64(size)
+		return size, ErrReaderClosed
+	}
 	if err != nil && err != io.EOF {
 		return size, err
 	}
@@ -1405,15 +4144,219 @@ func (r *fileReader) Read(data []byte) (int, error) {
 	return size, nil
 }
 
+// Close cancels any in-flight block fetch.  Subsequent calls to Read return
+// ErrReaderClosed.
 func (r *fileReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+func (d *driver) GetFileReaderAt(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) (readerAt io.ReaderAt, retErr error) {
+	defer func(start time.Time) { d.report("GetFileReaderAt", start, retErr, fileKeyValues(file)...) }(time.Now())
+	blockRefs, err := d.GetFileBlockRefs(file, filterShard, diffMethod)
+	if err != nil {
+		return nil, err
+	}
+	return newFileReaderAt(d.blockClient, d.blockCache, blockRefs, d.verifyBlocks), nil
+}
+
+// fileReaderAt reads arbitrary ranges of a file.  It never changes after
+// it's constructed, so concurrent calls to ReadAt are safe.
+type fileReaderAt struct {
+	blockClient pfs.BlockAPIClient
+	blockCache  *blockCache
+	blockRefs   []*persist.BlockRef
+	// offsets[i] is the offset in the file at which blockRefs[i] starts
+	offsets      []int64
+	size         int64
+	verifyBlocks bool
+}
+
+func newFileReaderAt(blockClient pfs.BlockAPIClient, blockCache *blockCache, blockRefs []*persist.BlockRef, verifyBlocks bool) *fileReaderAt {
+	r := &fileReaderAt{
+		blockClient:  blockClient,
+		blockCache:   blockCache,
+		blockRefs:    blockRefs,
+		verifyBlocks: verifyBlocks,
+	}
+	for _, blockRef := range blockRefs {
+		r.offsets = append(r.offsets, r.size)
+		r.size += int64(blockRef.Size())
+	}
+	return r
+}
+
+func (r *fileReaderAt) ReadAt(data []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+	// Find the last block that starts at or before off
+	i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > off }) - 1
+	var n int
+	for ; i >= 0 && i < len(r.blockRefs) && n < len(data); i++ {
+		blockRef := r.blockRefs[i]
+		blockOffset := off + int64(n) - r.offsets[i]
+		size := int64(blockRef.Size()) - blockOffset
+		if size <= 0 {
+			continue
+		}
+		if size > int64(len(data)-n) {
+			size = int64(len(data) - n)
+		}
+		reader, err := getBlockRange(context.Background(), r.blockClient, r.blockCache, blockRef.Hash, blockOffset, size, r.verifyBlocks)
+		if err != nil {
+			return n, err
+		}
+		read, err := io.ReadFull(reader, data[n:int64(n)+size])
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(data) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// getBlockRange returns a reader for size bytes of a block, starting at
+// offset; a size of 0 reads until the end of the block.  If verify is set,
+// the whole block is fetched and checked against its hash first.  If cache
+// is not nil, the whole block is read through it.
+func getBlockRange(ctx context.Context, blockClient pfs.BlockAPIClient, cache *blockCache, hash string, offset int64, size int64, verify bool) (io.Reader, error) {
+	if !verify && cache == nil {
+		getBlockClient, err := blockClient.GetBlock(ctx, &pfs.GetBlockRequest{
+			Block:       client.NewBlock(hash),
+			OffsetBytes: uint64(offset),
+			SizeBytes:   uint64(size),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return protostream.NewStreamingBytesReader(getBlockClient), nil
+	}
+	data, err := getBlock(ctx, blockClient, cache, hash, verify)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 && offset <= int64(len(data)) {
+		size = int64(len(data)) - offset
+	}
+	if offset+size > int64(len(data)) {
+		return nil, fmt.Errorf("range [%d, %d) is past the end of block %s, which is %d bytes long", offset, offset+size, hash, len(data))
+	}
+	return bytes.NewReader(data[offset : offset+size]), nil
+}
+
+func (d *driver) GetBlockByHash(hash string, offset uint64, size uint64) (readCloser io.ReadCloser, retErr error) {
+	defer func(start time.Time) { d.report("GetBlockByHash", start, retErr, "hash", hash) }(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err := getBlockRange(ctx, d.blockClient, d.blockCache, hash, int64(offset), int64(size), d.verifyBlocks)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &blockReader{reader, cancel}, nil
+}
+
+// blockReader reads a range of a block.  Closing it cancels the fetch of
+// the block.
+type blockReader struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *blockReader) Close() error {
+	r.cancel()
 	return nil
 }
 
-func (d *driver) InspectFile(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) (*pfs.FileInfo, error) {
+// getBlock returns the content of a whole block, from cache if it's there.
+// Blocks fetched from the block server are added to cache, after they're
+// checked against their hash if verify is set.
+func getBlock(ctx context.Context, blockClient pfs.BlockAPIClient, cache *blockCache, hash string, verify bool) ([]byte, error) {
+	if cache != nil {
+		if data, ok := cache.get(hash); ok {
+			return data, nil
+		}
+	}
+	getBlockClient, err := blockClient.GetBlock(ctx, &pfs.GetBlockRequest{
+		Block: client.NewBlock(hash),
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(protostream.NewStreamingBytesReader(getBlockClient))
+	if err != nil {
+		return nil, err
+	}
+	if verify {
+		if actualHash := pfsserver.HashBlock(data); actualHash != hash {
+			return nil, pfsserver.NewErrBlockCorrupted(hash, actualHash)
+		}
+	}
+	if cache != nil {
+		cache.add(hash, data)
+	}
+	return data, nil
+}
+
+func (d *driver) InspectFile(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) (fileInfo *pfs.FileInfo, retErr error) {
+	defer func(start time.Time) { d.report("InspectFile", start, retErr, fileKeyValues(file)...) }(time.Now())
+	fileInfo, _, err := d.inspectFileInfo(file, filterShard, diffMethod, false, false)
+	return fileInfo, err
+}
+
+func (d *driver) InspectFileWithNumChildren(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) (retFileInfo *drive.FileInfo, retErr error) {
+	defer func(start time.Time) {
+		d.report("InspectFileWithNumChildren", start, retErr, fileKeyValues(file)...)
+	}(time.Now())
+	fileInfo, numChildren, err := d.inspectFileInfo(file, filterShard, diffMethod, true, false)
+	if err != nil {
+		return nil, err
+	}
+	return &drive.FileInfo{
+		FileInfo:    fileInfo,
+		NumChildren: numChildren,
+	}, nil
+}
+
+func (d *driver) InspectFileWithRecursiveSize(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) (retFileInfo *pfs.FileInfo, retErr error) {
+	defer func(start time.Time) {
+		d.report("InspectFileWithRecursiveSize", start, retErr, fileKeyValues(file)...)
+	}(time.Now())
+	fileInfo, _, err := d.inspectFileInfo(file, filterShard, diffMethod, false, true)
+	return fileInfo, err
+}
+
+// GetFileType returns the type of file from the diff that inspectFile
+// folds, without querying the children of a directory.
+func (d *driver) GetFileType(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) (fileType pfs.FileType, retErr error) {
+	defer func(start time.Time) { d.report("GetFileType", start, retErr, fileKeyValues(file)...) }(time.Now())
 	fixPath(file)
 	diff, err := d.inspectFile(file, filterShard, diffMethod)
 	if err != nil {
-		return nil, err
+		return pfs.FileType_FILE_TYPE_NONE, err
+	}
+	switch diff.FileType {
+	case persist.FileType_FILE, persist.FileType_DIR:
+		return toPFSFileType(diff.FileType), nil
+	case persist.FileType_NONE:
+		return pfs.FileType_FILE_TYPE_NONE, pfsserver.NewErrFileNotFound(file.Path, file.Commit.Repo.Name, file.Commit.ID)
+	default:
+		return pfs.FileType_FILE_TYPE_NONE, fmt.Errorf("unrecognized file type: %d; this is likely a bug", diff.FileType)
+	}
+}
+
+// inspectFileInfo returns the FileInfo of file.  If countChildren is set and
+// file is a directory, the children are counted in the database rather than
+// listed in the FileInfo.  If recursiveSize is set and file is a directory,
+// the size of the FileInfo is the total size of the files under it.
+func (d *driver) inspectFileInfo(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod, countChildren bool, recursiveSize bool) (*pfs.FileInfo, uint64, error) {
+	fixPath(file)
+	diff, err := d.inspectFile(file, filterShard, diffMethod)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	res := &pfs.FileInfo{
@@ -1433,9 +4376,22 @@ func (d *driver) InspectFile(file *pfs.File, filterShard *pfs.Shard, diffMethod
 	case persist.FileType_DIR:
 		res.FileType = pfs.FileType_FILE_TYPE_DIR
 		res.Modified = diff.Modified
-		childrenDiffs, err := d.getChildren(file.Commit.Repo.Name, file, diffMethod)
+		if recursiveSize {
+			res.SizeBytes, err = d.getRecursiveSize(file.Commit.Repo.Name, file, diffMethod)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		if countChildren {
+			numChildren, err := d.countChildren(file.Commit.Repo.Name, file, diffMethod)
+			if err != nil {
+				return nil, 0, err
+			}
+			return res, numChildren, nil
+		}
+		childrenDiffs, err := d.getChildren(file.Commit.Repo.Name, file, diffMethod, 0, 0)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		for _, diff := range childrenDiffs {
 			res.Children = append(res.Children, &pfs.File{
@@ -1446,12 +4402,124 @@ func (d *driver) InspectFile(file *pfs.File, filterShard *pfs.Shard, diffMethod
 				Path: diff.Path,
 			})
 		}
+	case persist.FileType_NONE:
+		return nil, 0, pfsserver.NewErrFileNotFound(file.Path, file.Commit.Repo.Name, file.Commit.ID)
+	default:
+		return nil, 0, fmt.Errorf("unrecognized file type: %d; this is likely a bug", diff.FileType)
+	}
+	return res, uint64(len(res.Children)), nil
+}
+
+func (d *driver) DiffFile(file *pfs.File, fromCommit *pfs.Commit, toCommit *pfs.Commit) (retChange *drive.FileChange, retErr error) {
+	defer func(start time.Time) { d.report("DiffFile", start, retErr, fileKeyValues(file)...) }(time.Now())
+	fixPath(file)
+	from, err := d.inspectFileIfExists(&pfs.File{Commit: fromCommit, Path: file.Path})
+	if err != nil {
+		return nil, err
+	}
+	to, err := d.inspectFileIfExists(&pfs.File{Commit: toCommit, Path: file.Path})
+	if err != nil {
+		return nil, err
+	}
+
+	change := &drive.FileChange{}
+	switch {
+	case from == nil && to == nil:
+		change.Type = drive.FileUnchanged
+		return change, nil
+	case from == nil:
+		change.Type = drive.FileAdded
+		from = &persist.Diff{}
+	case to == nil:
+		change.Type = drive.FileDeleted
+		to = &persist.Diff{}
+	}
+	change.SizeDelta = int64(to.Size) - int64(from.Size)
+
+	// Compare the blockrefs as multisets
+	counts := make(map[persist.BlockRef]int)
+	for _, blockRef := range from.BlockRefs {
+		counts[*blockRef]++
+	}
+	for _, blockRef := range to.BlockRefs {
+		if counts[*blockRef] > 0 {
+			counts[*blockRef]--
+		} else {
+			change.BlockRefsAdded = append(change.BlockRefsAdded, blockRef)
+		}
+	}
+	for _, blockRef := range from.BlockRefs {
+		if counts[*blockRef] > 0 {
+			counts[*blockRef]--
+			change.BlockRefsRemoved = append(change.BlockRefsRemoved, blockRef)
+		}
+	}
+
+	if change.Type == drive.FileUnchanged {
+		if from.FileType != to.FileType || len(change.BlockRefsAdded) > 0 || len(change.BlockRefsRemoved) > 0 {
+			change.Type = drive.FileModified
+		}
+	}
+	return change, nil
+}
+
+// inspectFileIfExists is the same as inspectFile, except that it returns nil
+// if the file doesn't exist.
+func (d *driver) inspectFileIfExists(file *pfs.File) (*persist.Diff, error) {
+	diff, err := d.inspectFile(file, nil, nil)
+	if err != nil {
+		if _, ok := err.(*pfsserver.ErrFileNotFound); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if diff.FileType == persist.FileType_NONE {
+		return nil, nil
+	}
+	return diff, nil
+}
+
+func (d *driver) OpenFile(file *pfs.File) (fileHandle *drive.FileHandle, retErr error) {
+	defer func(start time.Time) { d.report("OpenFile", start, retErr, fileKeyValues(file)...) }(time.Now())
+	fixPath(file)
+	diff, err := d.inspectFile(file, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch diff.FileType {
+	case persist.FileType_FILE:
+	case persist.FileType_DIR:
+		return nil, fmt.Errorf("file %s/%s/%s is directory", file.Commit.Repo.Name, file.Commit.ID, file.Path)
 	case persist.FileType_NONE:
 		return nil, pfsserver.NewErrFileNotFound(file.Path, file.Commit.Repo.Name, file.Commit.ID)
 	default:
 		return nil, fmt.Errorf("unrecognized file type: %d; this is likely a bug", diff.FileType)
 	}
-	return res, nil
+
+	info := &pfs.FileInfo{
+		File:      file,
+		FileType:  pfs.FileType_FILE_TYPE_REGULAR,
+		SizeBytes: diff.Size,
+		Modified:  diff.Modified,
+		CommitModified: &pfs.Commit{
+			Repo: file.Commit.Repo,
+			ID:   persist.FullClockHead(diff.Clock).ReadableCommitID(),
+		},
+	}
+	return drive.NewFileHandle(info, blockRefsHash(diff.BlockRefs), func() io.ReadCloser {
+		return d.newFileReader(diff.BlockRefs, file, 0, 0)
+	}), nil
+}
+
+// blockRefsHash returns a hash that identifies the content referred to by
+// the given blockrefs.
+func blockRefsHash(blockRefs []*persist.BlockRef) string {
+	hash := sha256.New()
+	for _, blockRef := range blockRefs {
+		fmt.Fprintf(hash, "%s:%d:%d;", blockRef.Hash, blockRef.Lower, blockRef.Upper)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
 }
 
 func (d *driver) getRangesToMerge(commits []*pfs.Commit, to *pfs.Commit) (*persist.ClockRangeList, error) {
@@ -1545,7 +4613,8 @@ func (d *driver) getCommitsToMerge(commits []*pfs.Commit, to *pfs.Commit) (nilTe
 	return query, nil
 }
 
-func (d *driver) SquashCommit(fromCommits []*pfs.Commit, toCommit *pfs.Commit) error {
+func (d *driver) SquashCommit(fromCommits []*pfs.Commit, toCommit *pfs.Commit) (retErr error) {
+	defer func(start time.Time) { d.report("SquashCommit", start, retErr, commitKeyValues(toCommit)...) }(time.Now())
 	if len(fromCommits) == 0 || toCommit == nil {
 		return fmt.Errorf("Invalid arguments: fromCommits: %v; toCommit: %v", fromCommits, toCommit)
 	}
@@ -1590,6 +4659,7 @@ func (d *driver) SquashCommit(fromCommits []*pfs.Commit, toCommit *pfs.Commit) e
 	if err != nil {
 		return err
 	}
+	defer cursor.Close()
 
 	var provenanceUnion []*persist.ProvenanceCommit
 	if err := cursor.All(&provenanceUnion); err != nil {
@@ -1601,13 +4671,17 @@ func (d *driver) SquashCommit(fromCommits []*pfs.Commit, toCommit *pfs.Commit) e
 		return err
 	}
 
-	if _, err := d.getTerm(commitTable).Get(rawCommitID).Update(map[string]interface{}{
+	if _, err := d.runWrite(d.getTerm(commitTable).Get(rawCommitID).Update(map[string]interface{}{
 		"Provenance": provenanceUnion,
-	}).RunWrite(d.dbClient); err != nil {
+	})); err != nil {
 		return err
 	}
 
 	cursor, err = d.getTerm(commitTable).Get(rawCommitID).Run(d.dbClient)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
 	var newPersistCommit persist.Commit
 	if err := cursor.One(&newPersistCommit); err != nil {
 		return err
@@ -1618,7 +4692,7 @@ func (d *driver) SquashCommit(fromCommits []*pfs.Commit, toCommit *pfs.Commit) e
 		return err
 	}
 
-	_, err = d.getTerm(diffTable).Insert(diffs.Merge(func(diff gorethink.Term) map[string]interface{} {
+	_, err = d.runWrite(d.getTerm(diffTable).Insert(diffs.Merge(func(diff gorethink.Term) map[string]interface{} {
 		return map[string]interface{}{
 			// the ID doesn't matter anymore, because the only reason why it had
 			// to be a hash of (repo+commit+path) in PutFile is that we want
@@ -1628,20 +4702,144 @@ func (d *driver) SquashCommit(fromCommits []*pfs.Commit, toCommit *pfs.Commit) e
 			"ID":    gorethink.UUID(),
 			"Clock": newPersistCommit.FullClock,
 		}
-	})).RunWrite(d.dbClient)
+	})))
 	if err != nil {
 		return err
 	}
+	// The squashed diffs might have changed the types of any number of paths
+	// in toCommit.
+	d.fileTypes.purge()
+
+	if _, err := d.reconcileCommitSize(&newPersistCommit); err != nil {
+		return err
+	}
 
 	return nil
 }
 
-func (d *driver) ReplayCommit(fromCommits []*pfs.Commit, toBranch string) ([]*pfs.Commit, error) {
+func (d *driver) Squash(repo *pfs.Repo, fromCommit string, toCommit string, targetBranch string) (retCommit *pfs.Commit, retErr error) {
+	defer func(start time.Time) {
+		d.report("Squash", start, retErr, append(repoKeyValues(repo), "branch", targetBranch)...)
+	}(time.Now())
+	if fromCommit == "" || toCommit == "" || targetBranch == "" {
+		return nil, fmt.Errorf("Invalid arguments: fromCommit: %v; toCommit: %v; targetBranch: %v", fromCommit, toCommit, targetBranch)
+	}
+
+	from, err := d.getRawCommit(&pfs.Commit{Repo: repo, ID: fromCommit})
+	if err != nil {
+		return nil, err
+	}
+	to, err := d.getRawCommit(&pfs.Commit{Repo: repo, ID: toCommit})
+	if err != nil {
+		return nil, err
+	}
+	fromClock := persist.FullClockHead(from.FullClock)
+	toClock := persist.FullClockHead(to.FullClock)
+	if fromClock.Branch != toClock.Branch {
+		return nil, fmt.Errorf("you can only squash commits on the same branch; found %s and %s", fromClock.Branch, toClock.Branch)
+	}
+	if fromClock.Clock > toClock.Clock {
+		return nil, fmt.Errorf("commit %s/%s comes after commit %s/%s", repo.Name, fromCommit, repo.Name, toCommit)
+	}
+
+	// The provenance of the squashed commit is the union of the provenance
+	// of the commits in the range.
+	cursor, err := d.betweenIndex(
+		commitTable, CommitClockIndex.Name,
+		commitClockIndexKey(repo.Name, fromClock.Branch, fromClock.Clock),
+		commitClockIndexKey(repo.Name, toClock.Branch, toClock.Clock),
+		false,
+		gorethink.BetweenOpts{
+			LeftBound:  "closed",
+			RightBound: "closed",
+		},
+	).Map(func(commit gorethink.Term) gorethink.Term {
+		return commit.Field("Provenance").Default([]interface{}{})
+	}).Fold(gorethink.Expr([]interface{}{}), func(acc, provenance gorethink.Term) gorethink.Term {
+		return acc.SetUnion(provenance)
+	}).Run(d.dbClient)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var provenanceUnion []*persist.ProvenanceCommit
+	if err := cursor.All(&provenanceUnion); err != nil {
+		return nil, err
+	}
+
+	newCommit, err := d.StartCommit(&pfs.Commit{
+		Repo: repo,
+		ID:   targetBranch,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	// If squashing fails, we don't want to leave a half-filled commit at the
+	// head of the target branch, where later commits would build on it.  The
+	// commit is deleted if it's still open, and cancelled otherwise.
+	defer func() {
+		if retErr == nil {
+			return
+		}
+		if err := d.DeleteCommit(newCommit); err != nil {
+			if err := d.CancelCommit(newCommit); err != nil {
+				retErr = fmt.Errorf("%v; additionally, the squashed commit %s/%s could not be cleaned up: %v", retErr, repo.Name, newCommit.ID, err)
+			}
+		}
+	}()
+	rawCommitID, err := getRawCommitID(repo.Name, newCommit.ID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.runWrite(d.getTerm(commitTable).Get(rawCommitID).Update(map[string]interface{}{
+		"Provenance": provenanceUnion,
+	})); err != nil {
+		return nil, err
+	}
+	var newPersistCommit persist.Commit
+	if err := d.getMessageByPrimaryKey(commitTable, rawCommitID, &newPersistCommit); err != nil {
+		return nil, err
+	}
+
+	// Fold the diffs of each path over the range, dropping the paths that
+	// end up deleted.
+	diffs := d.betweenIndex(
+		diffTable, DiffClockIndex.Name,
+		diffClockIndexKey(repo.Name, fromClock.Branch, fromClock.Clock),
+		diffClockIndexKey(repo.Name, toClock.Branch, toClock.Clock),
+		false,
+		gorethink.BetweenOpts{
+			LeftBound:  "closed",
+			RightBound: "closed",
+		},
+	).Group("Path").Ungroup().Field("reduction").Map(foldDiffs).Filter(func(diff gorethink.Term) gorethink.Term {
+		return diff.Field("FileType").Ne(persist.FileType_NONE)
+	})
+
+	if _, err := d.runWrite(d.getTerm(diffTable).Insert(diffs.Merge(func(diff gorethink.Term) map[string]interface{} {
+		return map[string]interface{}{
+			"ID":    gorethink.UUID(),
+			"Clock": newPersistCommit.FullClock,
+		}
+	}))); err != nil {
+		return nil, err
+	}
+	if _, err := d.reconcileCommitSize(&newPersistCommit); err != nil {
+		return nil, err
+	}
+
+	if err := d.FinishCommit(newCommit, false); err != nil {
+		return nil, err
+	}
+	return newCommit, nil
+}
+
+func (d *driver) ReplayCommit(fromCommits []*pfs.Commit, toBranch string) (retCommits []*pfs.Commit, retErr error) {
+	defer func(start time.Time) { d.report("ReplayCommit", start, retErr) }(time.Now())
 	if len(fromCommits) == 0 || toBranch == "" {
 		return nil, fmt.Errorf("Invalid arguments: fromCommits: %v; toBranch: %v", fromCommits, toBranch)
 	}
 
-	var retCommits []*pfs.Commit
 	// Make sure that all fromCommits are from the same repo
 	var repo string
 	for _, commit := range fromCommits {
@@ -1666,6 +4864,7 @@ func (d *driver) ReplayCommit(fromCommits []*pfs.Commit, toBranch string) ([]*pf
 	if err != nil {
 		return nil, err
 	}
+	defer cursor.Close()
 
 	var rawCommit persist.Commit
 	for cursor.Next(&rawCommit) {
@@ -1685,23 +4884,25 @@ func (d *driver) ReplayCommit(fromCommits []*pfs.Commit, toBranch string) ([]*pf
 			return nil, err
 		}
 
-		cursor, err := d.getTerm(commitTable).Get(rawCommitID).Run(d.dbClient)
 		var newPersistCommit persist.Commit
-		if err := cursor.One(&newPersistCommit); err != nil {
+		if err := d.getMessageByPrimaryKey(commitTable, rawCommitID, &newPersistCommit); err != nil {
 			return nil, err
 		}
 		oldClock := persist.FullClockHead(rawCommit.FullClock)
 
 		// TODO: conflict detection
-		_, err = d.getTerm(diffTable).Insert(d.getTerm(diffTable).GetAllByIndex(DiffClockIndex.Name, diffClockIndexKey(repo, oldClock.Branch, oldClock.Clock)).Merge(func(diff gorethink.Term) map[string]interface{} {
+		_, err = d.runWrite(d.getTerm(diffTable).Insert(d.getTerm(diffTable).GetAllByIndex(DiffClockIndex.Name, diffClockIndexKey(repo, oldClock.Branch, oldClock.Clock)).Merge(func(diff gorethink.Term) map[string]interface{} {
 			return map[string]interface{}{
 				"ID":    gorethink.UUID(),
 				"Clock": newPersistCommit.FullClock,
 			}
-		})).RunWrite(d.dbClient)
+		})))
 		if err != nil {
 			return nil, err
 		}
+		if err := d.addCommitSize(newPersistCommit.ID, int64(rawCommit.Size)); err != nil {
+			return nil, err
+		}
 
 		err = d.FinishCommit(newCommit, false)
 		retCommits = append(retCommits, newCommit)
@@ -1714,6 +4915,57 @@ func (d *driver) ReplayCommit(fromCommits []*pfs.Commit, toBranch string) ([]*pf
 	return retCommits, nil
 }
 
+// fileTypeConflict returns a term that raises a file type conflict at path.
+// The details of the conflict are encoded in the error message as JSON, so
+// that asFileTypeConflict can turn the error back into an
+// ErrFileTypeConflict.
+func fileTypeConflict(path gorethink.Term, existingType gorethink.Term, attemptedType gorethink.Term) gorethink.Term {
+	return gorethink.Error(gorethink.Expr(ErrConflictFileTypeMsg + ": ").Add(gorethink.Expr(map[string]interface{}{
+		"Path":          path,
+		"ExistingType":  existingType,
+		"AttemptedType": attemptedType,
+	}).ToJSON()))
+}
+
+// asFileTypeConflict translates an error raised by fileTypeConflict into an
+// ErrFileTypeConflict.  Other errors are returned as is.
+func asFileTypeConflict(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	i := strings.Index(msg, ErrConflictFileTypeMsg+": ")
+	if i < 0 {
+		return err
+	}
+	var conflict struct {
+		Path          string
+		ExistingType  persist.FileType
+		AttemptedType persist.FileType
+	}
+	// The message may be followed by the query that raised it, which the
+	// decoder ignores
+	if json.NewDecoder(strings.NewReader(msg[i+len(ErrConflictFileTypeMsg)+2:])).Decode(&conflict) != nil {
+		return err
+	}
+	return newErrFileTypeConflict(conflict.Path, conflict.ExistingType, conflict.AttemptedType)
+}
+
+func newErrFileTypeConflict(path string, existingType persist.FileType, attemptedType persist.FileType) error {
+	return pfsserver.NewErrFileTypeConflict(path, toPFSFileType(existingType), toPFSFileType(attemptedType))
+}
+
+func toPFSFileType(fileType persist.FileType) pfs.FileType {
+	switch fileType {
+	case persist.FileType_FILE:
+		return pfs.FileType_FILE_TYPE_REGULAR
+	case persist.FileType_DIR:
+		return pfs.FileType_FILE_TYPE_DIR
+	default:
+		return pfs.FileType_FILE_TYPE_NONE
+	}
+}
+
 // foldDiffs takes an ordered stream of diffs for a given path, and return
 // a single diff that represents the aggregation of these diffs.
 func foldDiffs(diffs gorethink.Term) gorethink.Term {
@@ -1725,7 +4977,7 @@ func foldDiffs(diffs gorethink.Term) gorethink.Term {
 			// If neither the acc nor the new diff has FileType_NONE, and they have
 			// different FileTypes, then it's a file type conflict.
 			acc.Field("FileType").Ne(persist.FileType_NONE).And(diff.Field("FileType").Ne(persist.FileType_NONE).And(acc.Field("FileType").Ne(diff.Field("FileType")))),
-			gorethink.Error(ErrConflictFileTypeMsg),
+			fileTypeConflict(diff.Field("Path"), acc.Field("FileType"), diff.Field("FileType")),
 			gorethink.Branch(
 				diff.Field("Delete"),
 				acc.Merge(diff).Merge(map[string]interface{}{
@@ -1752,7 +5004,7 @@ func foldDiffsWithoutDelete(diffs gorethink.Term) gorethink.Term {
 			// If neither the acc nor the new diff has FileType_NONE, and they have
 			// different FileTypes, then it's a file type conflict.
 			acc.Field("FileType").Ne(persist.FileType_NONE).And(diff.Field("FileType").Ne(persist.FileType_NONE).And(acc.Field("FileType").Ne(diff.Field("FileType")))),
-			gorethink.Error(ErrConflictFileTypeMsg),
+			fileTypeConflict(diff.Field("Path"), acc.Field("FileType"), diff.Field("FileType")),
 			acc.Merge(diff).Merge(map[string]interface{}{
 				"Delete":    acc.Field("Delete").Or(diff.Field("Delete")),
 				"BlockRefs": acc.Field("BlockRefs").Add(diff.Field("BlockRefs")),
@@ -1764,64 +5016,126 @@ func foldDiffsWithoutDelete(diffs gorethink.Term) gorethink.Term {
 
 // getChildrenFast is the same as getChildren except that it only computes the
 // presence of children, but not their sizes, blockrefs, etc.
-func (d *driver) getChildrenFast(repo string, file *pfs.File, diffMethod *pfs.DiffMethod) ([]*persist.Diff, error) {
+func (d *driver) getChildrenFast(repo string, file *pfs.File, diffMethod *pfs.DiffMethod, offset int, limit int) ([]*persist.Diff, error) {
+	query, err := d.getChildrenFastQuery(repo, file, diffMethod, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	return d.getDiffs(query)
+}
+
+func (d *driver) getChildrenFastQuery(repo string, file *pfs.File, diffMethod *pfs.DiffMethod, offset int, limit int) (nilTerm gorethink.Term, retErr error) {
 	query, err := d.getDiffsInCommitRange(diffMethod, file, false, DiffParentIndex.Name, func(clock interface{}) interface{} {
 		return diffParentIndexKey(repo, file.Path, clock)
 	})
 	if err != nil {
-		return nil, err
+		return nilTerm, err
 	}
 
-	cursor, err := query.Group("Path").Reduce(func(left, right gorethink.Term) gorethink.Term {
+	return page(query.Group("Path").Reduce(func(left, right gorethink.Term) gorethink.Term {
 		return gorethink.Branch(persist.DBClockDescendent(left.Field("Clock"), right.Field("Clock")),
 			right,
 			left)
 	}).Ungroup().Field("reduction").Filter(func(diff gorethink.Term) gorethink.Term {
 		return diff.Field("FileType").Ne(persist.FileType_NONE)
-	}).Without("BlockRefs", "Size").OrderBy("Path").Run(d.dbClient)
+	}).Without("BlockRefs", "Size").OrderBy("Path"), offset, limit), nil
+}
+
+// getRecursiveSize returns the total size of the regular files under a
+// directory, at any depth.
+func (d *driver) getRecursiveSize(repo string, file *pfs.File, diffMethod *pfs.DiffMethod) (uint64, error) {
+	query, err := d.getDiffsInCommitRange(diffMethod, file, false, DiffPrefixIndex.Name, func(clock interface{}) interface{} {
+		return diffPrefixIndexKey(repo, file.Path, clock)
+	})
+	if err != nil {
+		return 0, err
+	}
+	cursor, err := query.Group("Path").Ungroup().Field("reduction").Map(foldDiffs).Filter(func(diff gorethink.Term) gorethink.Term {
+		return diff.Field("FileType").Eq(persist.FileType_FILE)
+	}).Sum("Size").Run(d.dbClient, gorethink.RunOpts{ArrayLimit: 10000000})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+	var size uint64
+	if err := cursor.One(&size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// getDescendantFiles returns the regular files under a directory, at any
+// depth, ordered by path.
+func (d *driver) getDescendantFiles(repo string, file *pfs.File) ([]*persist.Diff, error) {
+	query, err := d.getDiffsInCommitRange(nil, file, false, DiffPrefixIndex.Name, func(clock interface{}) interface{} {
+		return diffPrefixIndexKey(repo, file.Path, clock)
+	})
 	if err != nil {
 		return nil, err
 	}
+	return d.getDiffs(query.Group("Path").Ungroup().Field("reduction").Map(foldDiffs).Filter(func(diff gorethink.Term) gorethink.Term {
+		return diff.Field("FileType").Eq(persist.FileType_FILE)
+	}).OrderBy("Path"))
+}
 
-	var diffs []*persist.Diff
-	if err := cursor.All(&diffs); err != nil {
+// countChildren returns the number of children of a directory without
+// reading them.
+func (d *driver) countChildren(repo string, file *pfs.File, diffMethod *pfs.DiffMethod) (uint64, error) {
+	query, err := d.getChildrenFastQuery(repo, file, diffMethod, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	cursor, err := query.Count().Run(d.dbClient, gorethink.RunOpts{ArrayLimit: 10000000})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+	var count uint64
+	if err := cursor.One(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (d *driver) getChildren(repo string, file *pfs.File, diffMethod *pfs.DiffMethod, offset int, limit int) ([]*persist.Diff, error) {
+	query, err := d.getChildrenQuery(repo, file, diffMethod, offset, limit)
+	if err != nil {
 		return nil, err
 	}
-	return diffs, nil
+	return d.getDiffs(query)
 }
 
-func (d *driver) getChildren(repo string, file *pfs.File, diffMethod *pfs.DiffMethod) ([]*persist.Diff, error) {
+func (d *driver) getChildrenQuery(repo string, file *pfs.File, diffMethod *pfs.DiffMethod, offset int, limit int) (nilTerm gorethink.Term, retErr error) {
 	query, err := d.getDiffsInCommitRange(diffMethod, file, false, DiffParentIndex.Name, func(clock interface{}) interface{} {
 		return diffParentIndexKey(repo, file.Path, clock)
 	})
 	if err != nil {
-		return nil, err
+		return nilTerm, err
 	}
 
-	cursor, err := query.Group("Path").Ungroup().Field("reduction").Map(foldDiffs).Filter(func(diff gorethink.Term) gorethink.Term {
+	return page(query.Group("Path").Ungroup().Field("reduction").Map(foldDiffs).Filter(func(diff gorethink.Term) gorethink.Term {
 		return diff.Field("FileType").Ne(persist.FileType_NONE)
-	}).OrderBy("Path").Run(d.dbClient, gorethink.RunOpts{ArrayLimit: 10000000})
-	if err != nil {
-		return nil, err
-	}
+	}).OrderBy("Path"), offset, limit), nil
+}
 
-	var diffs []*persist.Diff
-	if err := cursor.All(&diffs); err != nil {
+func (d *driver) getChildrenRecursive(repo string, file *pfs.File, diffMethod *pfs.DiffMethod, offset int, limit int) ([]*persist.Diff, error) {
+	query, err := d.getChildrenRecursiveQuery(repo, file, diffMethod, offset, limit)
+	if err != nil {
 		return nil, err
 	}
-	return diffs, nil
+	return d.getDiffs(query)
 }
 
-func (d *driver) getChildrenRecursive(repo string, file *pfs.File, diffMethod *pfs.DiffMethod) ([]*persist.Diff, error) {
+func (d *driver) getChildrenRecursiveQuery(repo string, file *pfs.File, diffMethod *pfs.DiffMethod, offset int, limit int) (nilTerm gorethink.Term, retErr error) {
 	query, err := d.getDiffsInCommitRange(diffMethod, file, false, DiffPrefixIndex.Name, func(clock interface{}) interface{} {
 		return diffPrefixIndexKey(repo, file.Path, clock)
 	})
 	if err != nil {
-		return nil, err
+		return nilTerm, err
 	}
 
 	parent := file.Path
-	cursor, err := query.Group("Path").Ungroup().Field("reduction").Map(foldDiffs).Filter(func(diff gorethink.Term) gorethink.Term {
+	return page(query.Group("Path").Ungroup().Field("reduction").Map(foldDiffs).Filter(func(diff gorethink.Term) gorethink.Term {
 		return diff.Field("FileType").Ne(persist.FileType_NONE)
 	}).Group(func(diff gorethink.Term) gorethink.Term {
 		// This query gives us the first component after the parent prefix.
@@ -1847,19 +5161,36 @@ func (d *driver) getChildrenRecursive(repo string, file *pfs.File, diffMethod *p
 				"BlockRefs": left.Field("BlockRefs").Add(right.Field("BlockRefs")),
 			}),
 		)
-	}).Ungroup().Field("reduction").OrderBy("Path").Run(d.dbClient, gorethink.RunOpts{ArrayLimit: 10000000})
+	}).Ungroup().Field("reduction").OrderBy("Path"), offset, limit), nil
+}
+
+// getDiffs runs a query that returns a sequence of diffs.
+func (d *driver) getDiffs(query gorethink.Term) ([]*persist.Diff, error) {
+	cursor, err := query.Run(d.dbClient, gorethink.RunOpts{ArrayLimit: 10000000})
 	if err != nil {
-		return nil, err
+		return nil, asFileTypeConflict(err)
 	}
+	defer cursor.Close()
 
 	var diffs []*persist.Diff
 	if err := cursor.All(&diffs); err != nil {
-		return nil, err
+		return nil, asFileTypeConflict(err)
 	}
-
 	return diffs, nil
 }
 
+// page skips the first offset documents of an ordered query and returns at
+// most limit documents.  Non-positive values of offset and limit are ignored.
+func page(query gorethink.Term, offset int, limit int) gorethink.Term {
+	if offset > 0 {
+		query = query.Skip(offset)
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	return query
+}
+
 type clockToIndexKeyFunc func(interface{}) interface{}
 
 func (d *driver) getDiffsInCommitRange(diffMethod *pfs.DiffMethod, file *pfs.File, reverse bool, indexName string, keyFunc clockToIndexKeyFunc) (nilTerm gorethink.Term, retErr error) {
@@ -1897,6 +5228,7 @@ func (d *driver) getDiffsInCommitRange(diffMethod *pfs.DiffMethod, file *pfs.Fil
 		if err != nil {
 			return nilTerm, err
 		}
+		defer cursor.Close()
 		if err := cursor.One(&somethingChanged); err != nil {
 			return nilTerm, err
 		}
@@ -1960,61 +5292,242 @@ func (d *driver) _getDiffsInCommitRange(fromCommit *pfs.Commit, toCommit *pfs.Co
 	}), nil
 }
 
+// getRawCommits resolves a batch of commit IDs in repo, like getRawCommit,
+// and maps each ID to its commit.  Readable IDs like "master/3" are looked
+// up in a single query; branch names and IDs with ancestry suffixes are
+// resolved one at a time.  The IDs of commits that don't exist are left out.
+func (d *driver) getRawCommits(repo string, ids []string) (map[string]*persist.Commit, error) {
+	result := make(map[string]*persist.Commit)
+	rawIDToIDs := make(map[string][]string)
+	var rawIDs []interface{}
+	for _, id := range ids {
+		baseID, _, err := parseAncestry(id)
+		if err != nil {
+			return nil, err
+		}
+		if baseID == id && !isBranchName(id) {
+			rawID, err := getRawCommitID(repo, id)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := rawIDToIDs[rawID]; !ok {
+				rawIDs = append(rawIDs, rawID)
+			}
+			rawIDToIDs[rawID] = append(rawIDToIDs[rawID], id)
+			continue
+		}
+		rawCommit, err := d.getRawCommit(&pfs.Commit{
+			Repo: &pfs.Repo{Name: repo},
+			ID:   id,
+		})
+		if err != nil {
+			if _, ok := err.(*pfsserver.ErrCommitNotFound); ok {
+				continue
+			}
+			return nil, err
+		}
+		result[id] = rawCommit
+	}
+	if len(rawIDs) == 0 {
+		return result, nil
+	}
+
+	cursor, err := d.getTerm(commitTable).GetAll(rawIDs...).Run(d.dbClient)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var rawCommits []*persist.Commit
+	if err := cursor.All(&rawCommits); err != nil {
+		return nil, err
+	}
+	for _, rawCommit := range rawCommits {
+		for _, id := range rawIDToIDs[rawCommit.ID] {
+			result[id] = rawCommit
+		}
+	}
+	return result, nil
+}
+
 func (d *driver) getFullClock(to *pfs.Commit) (persist.FullClock, error) {
 	commit, err := d.getRawCommit(to)
 	if err != nil {
 		return nil, err
 	}
-	return commit.FullClock, nil
-}
+	return commit.FullClock, nil
+}
+
+func (d *driver) inspectFile(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) (*persist.Diff, error) {
+	if err := checkShard(filterShard); err != nil {
+		return nil, err
+	}
+	if !pfsserver.FileInShard(filterShard, file) {
+		return nil, pfsserver.NewErrFileNotFound(file.Path, file.Commit.Repo.Name, file.Commit.ID)
+	}
+
+	query, err := d.getDiffsInCommitRange(diffMethod, file, false, DiffPathIndex.Name, func(clock interface{}) interface{} {
+		return diffPathIndexKey(file.Commit.Repo.Name, file.Path, clock)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := foldDiffs(query).Run(d.dbClient)
+	if err != nil {
+		return nil, asFileTypeConflict(err)
+	}
+	defer cursor.Close()
+
+	diff := &persist.Diff{}
+	if err := cursor.One(diff); err != nil {
+		if err == gorethink.ErrEmptyResult {
+			return nil, pfsserver.NewErrFileNotFound(file.Path, file.Commit.Repo.Name, file.Commit.ID)
+		}
+		return nil, asFileTypeConflict(err)
+	}
+
+	return filterBlocks(diff, filterShard, file)
+}
+
+func (d *driver) ListFile(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod, mode drive.ListFileMode, offset int, limit int) (fileInfos []*pfs.FileInfo, retErr error) {
+	defer func(start time.Time) { d.report("ListFile", start, retErr, fileKeyValues(file)...) }(time.Now())
+	// The shard filter can't be evaluated in the database, so when there is
+	// one, the page is selected after filtering rather than in the query.
+	// Otherwise a page would hold fewer children than limit, and offset
+	// would count the children of other shards.
+	sharded := filterShard != nil && (filterShard.FileModulus > 1 || filterShard.BlockModulus > 1)
+	queryOffset, queryLimit := offset, limit
+	if sharded {
+		queryOffset, queryLimit = 0, 0
+	}
+	fileInfo, query, err := d.listFileQuery(file, filterShard, diffMethod, mode, queryOffset, queryLimit)
+	if err != nil {
+		return nil, err
+	}
+	if fileInfo != nil {
+		if offset > 0 {
+			return nil, nil
+		}
+		return []*pfs.FileInfo{fileInfo}, nil
+	}
+
+	diffs, err := d.getDiffs(query)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, diff := range diffs {
+		fileInfo, err := diffToFileInfo(diff, file, filterShard)
+		if err != nil {
+			return nil, err
+		}
+		if fileInfo != nil {
+			fileInfos = append(fileInfos, fileInfo)
+		}
+	}
 
-func (d *driver) inspectFile(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) (*persist.Diff, error) {
-	if !pfsserver.FileInShard(filterShard, file) {
-		return nil, pfsserver.NewErrFileNotFound(file.Path, file.Commit.Repo.Name, file.Commit.ID)
+	if sharded {
+		if offset > 0 {
+			if offset >= len(fileInfos) {
+				return nil, nil
+			}
+			fileInfos = fileInfos[offset:]
+		}
+		if limit > 0 && limit < len(fileInfos) {
+			fileInfos = fileInfos[:limit]
+		}
 	}
+	return fileInfos, nil
+}
 
-	query, err := d.getDiffsInCommitRange(diffMethod, file, false, DiffPathIndex.Name, func(clock interface{}) interface{} {
-		return diffPathIndexKey(file.Commit.Repo.Name, file.Path, clock)
-	})
+func (d *driver) ListFileStream(ctx context.Context, file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod, mode drive.ListFileMode) (<-chan *pfs.FileInfo, <-chan error) {
+	fileInfoCh := make(chan *pfs.FileInfo)
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(errCh)
+		defer close(fileInfoCh)
+		errCh <- d.listFileStream(ctx, file, filterShard, diffMethod, mode, fileInfoCh)
+	}()
+	return fileInfoCh, errCh
+}
+
+func (d *driver) listFileStream(ctx context.Context, file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod, mode drive.ListFileMode, fileInfoCh chan<- *pfs.FileInfo) error {
+	fileInfo, query, err := d.listFileQuery(file, filterShard, diffMethod, mode, 0, 0)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if fileInfo != nil {
+		select {
+		case fileInfoCh <- fileInfo:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
-	cursor, err := foldDiffs(query).Run(d.dbClient)
+	cursor, err := query.Run(d.dbClient, gorethink.RunOpts{ArrayLimit: 10000000})
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer cursor.Close()
+
+	// Closing the cursor unblocks the call to Next below
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cursor.Close()
+		case <-done:
+		}
+	}()
 
 	diff := &persist.Diff{}
-	if err := cursor.One(diff); err != nil {
-		if err == gorethink.ErrEmptyResult {
-			return nil, pfsserver.NewErrFileNotFound(file.Path, file.Commit.Repo.Name, file.Commit.ID)
+	for cursor.Next(diff) {
+		fileInfo, err := diffToFileInfo(diff, file, filterShard)
+		if err != nil {
+			return err
 		}
-		return nil, err
+		if fileInfo != nil {
+			select {
+			case fileInfoCh <- fileInfo:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		diff = &persist.Diff{}
 	}
-
-	return filterBlocks(diff, filterShard, file)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return cursor.Err()
 }
 
-func (d *driver) ListFile(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod, mode drive.ListFileMode) ([]*pfs.FileInfo, error) {
+// listFileQuery returns the FileInfo of file if it's a regular file.
+// Otherwise, it returns a query for the diffs of the children of file.
+func (d *driver) listFileQuery(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod, mode drive.ListFileMode, offset int, limit int) (*pfs.FileInfo, gorethink.Term, error) {
+	var nilTerm gorethink.Term
 	fixPath(file)
+	if err := checkShard(filterShard); err != nil {
+		return nil, nilTerm, err
+	}
 	if mode == drive.ListFileFAST && filterShard != nil && filterShard.BlockModulus > 1 {
-		return nil, fmt.Errorf("the FAST mode of ListFile does not support block shards")
+		return nil, nilTerm, fmt.Errorf("the FAST mode of ListFile does not support block shards")
 	}
 
 	// We treat the root directory specially: we know that it's a directory
 	if file.Path != "/" {
 		fileInfo, err := d.InspectFile(file, filterShard, diffMethod)
 		if err != nil {
-			return nil, err
+			return nil, nilTerm, err
 		}
 		switch fileInfo.FileType {
 		case pfs.FileType_FILE_TYPE_REGULAR:
-			return []*pfs.FileInfo{fileInfo}, nil
+			return fileInfo, nilTerm, nil
 		case pfs.FileType_FILE_TYPE_DIR:
 			break
 		default:
-			return nil, fmt.Errorf("unrecognized file type %d; this is likely a bug", fileInfo.FileType)
+			return nil, nilTerm, fmt.Errorf("unrecognized file type %d; this is likely a bug", fileInfo.FileType)
 		}
 	}
 
@@ -2024,93 +5537,159 @@ func (d *driver) ListFile(file *pfs.File, filterShard *pfs.Shard, diffMethod *pf
 		diffMethod.FullFile = false
 	}
 
-	var diffs []*persist.Diff
+	var query gorethink.Term
 	var err error
 	switch mode {
 	case drive.ListFileNORMAL:
-		diffs, err = d.getChildren(file.Commit.Repo.Name, file, diffMethod)
+		query, err = d.getChildrenQuery(file.Commit.Repo.Name, file, diffMethod, offset, limit)
 	case drive.ListFileFAST:
-		diffs, err = d.getChildrenFast(file.Commit.Repo.Name, file, diffMethod)
+		query, err = d.getChildrenFastQuery(file.Commit.Repo.Name, file, diffMethod, offset, limit)
 	case drive.ListFileRECURSE:
-		diffs, err = d.getChildrenRecursive(file.Commit.Repo.Name, file, diffMethod)
+		query, err = d.getChildrenRecursiveQuery(file.Commit.Repo.Name, file, diffMethod, offset, limit)
+	default:
+		err = fmt.Errorf("unrecognized ListFile mode %d", mode)
+	}
+	return nil, query, err
+}
+
+// diffToFileInfo converts the diff of a child of parent to a FileInfo.  It
+// returns nil if the child is filtered out by filterShard.
+func diffToFileInfo(diff *persist.Diff, parent *pfs.File, filterShard *pfs.Shard) (*pfs.FileInfo, error) {
+	fileInfo := &pfs.FileInfo{}
+	fileInfo.File = &pfs.File{
+		Commit: parent.Commit,
+		Path:   diff.Path,
+	}
+	if !pfsserver.FileInShard(filterShard, fileInfo.File) {
+		return nil, nil
 	}
+	diff, err := filterBlocks(diff, filterShard, fileInfo.File)
 	if err != nil {
+		if _, ok := err.(*pfsserver.ErrFileNotFound); ok {
+			return nil, nil
+		}
 		return nil, err
 	}
-
-	var fileInfos []*pfs.FileInfo
-	for _, diff := range diffs {
-		fileInfo := &pfs.FileInfo{}
-		fileInfo.File = &pfs.File{
-			Commit: file.Commit,
-			Path:   diff.Path,
-		}
-		if !pfsserver.FileInShard(filterShard, fileInfo.File) {
-			continue
-		}
-		diff, err := filterBlocks(diff, filterShard, fileInfo.File)
-		if err != nil {
-			if _, ok := err.(*pfsserver.ErrFileNotFound); ok {
-				continue
-			}
-			return nil, err
-		}
-		fileInfo.SizeBytes = diff.Size
-		fileInfo.Modified = diff.Modified
-		switch diff.FileType {
-		case persist.FileType_FILE:
-			fileInfo.FileType = pfs.FileType_FILE_TYPE_REGULAR
-		case persist.FileType_DIR:
-			fileInfo.FileType = pfs.FileType_FILE_TYPE_DIR
-		default:
-			return nil, fmt.Errorf("unrecognized file type %d; this is likely a bug", diff.FileType)
-		}
-		fileInfo.CommitModified = &pfs.Commit{
-			Repo: file.Commit.Repo,
-			ID:   persist.FullClockHead(diff.Clock).ReadableCommitID(),
-		}
-		fileInfos = append(fileInfos, fileInfo)
+	fileInfo.SizeBytes = diff.Size
+	fileInfo.Modified = diff.Modified
+	switch diff.FileType {
+	case persist.FileType_FILE:
+		fileInfo.FileType = pfs.FileType_FILE_TYPE_REGULAR
+	case persist.FileType_DIR:
+		fileInfo.FileType = pfs.FileType_FILE_TYPE_DIR
+	default:
+		return nil, fmt.Errorf("unrecognized file type %d; this is likely a bug", diff.FileType)
 	}
-
-	return fileInfos, nil
+	fileInfo.CommitModified = &pfs.Commit{
+		Repo: parent.Commit.Repo,
+		ID:   persist.FullClockHead(diff.Clock).ReadableCommitID(),
+	}
+	return fileInfo, nil
 }
 
-func (d *driver) DeleteFile(file *pfs.File) error {
+func (d *driver) DeleteFile(file *pfs.File) (retErr error) {
+	defer func(start time.Time) { d.report("DeleteFile", start, retErr, fileKeyValues(file)...) }(time.Now())
 	fixPath(file)
 
 	commit, err := d.getRawCommit(file.Commit)
 	if err != nil {
 		return err
 	}
+	if commit.Finished != nil {
+		return pfsserver.NewErrCommitFinished(commit.Repo, commit.ID)
+	}
+
+	paths, err := d.getDescendantPaths(commit.Repo, file)
+	if err != nil {
+		return err
+	}
+	return d.deletePaths(commit, append(paths, file.Path))
+}
 
-	repo := commit.Repo
-	commitID := commit.ID
-	prefix := file.Path
+// DeleteFiles deletes the files and directories in an open commit whose
+// paths match glob, along with everything under the matching directories.
+// The glob is evaluated against the paths that exist as of the commit, i.e.
+// after folding the diffs of the commit and its ancestors.
+func (d *driver) DeleteFiles(commit *pfs.Commit, glob string) (retErr error) {
+	defer func(start time.Time) { d.report("DeleteFiles", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	rawCommit, err := d.getRawCommit(commit)
+	if err != nil {
+		return err
+	}
+	if rawCommit.Finished != nil {
+		return pfsserver.NewErrCommitFinished(rawCommit.Repo, rawCommit.ID)
+	}
 
-	query, err := d.getDiffsInCommitRange(nil, file, false, DiffPrefixIndex.Name, func(clock interface{}) interface{} {
-		return diffPrefixIndexKey(repo, prefix, clock)
+	patternComponents, root, err := parseGlob(glob)
+	if err != nil {
+		return err
+	}
+	candidates, err := d.getDescendantPaths(rawCommit.Repo, &pfs.File{
+		Commit: commit,
+		Path:   root,
 	})
 	if err != nil {
 		return err
 	}
 
-	// Get all files under the directory, ordered by path.
+	var paths []string
+	for _, candidate := range candidates {
+		// A path is deleted if it or any of its ancestors matches
+		for p := candidate; p != root && p != "/"; p = path.Dir(p) {
+			if globMatch(patternComponents, strings.Split(p, "/")) {
+				paths = append(paths, candidate)
+				break
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	return d.deletePaths(rawCommit, paths)
+}
+
+// getDescendantPaths returns the paths of the files and directories under a
+// directory, at any depth, ordered by path.
+func (d *driver) getDescendantPaths(repo string, file *pfs.File) ([]string, error) {
+	query, err := d.getDiffsInCommitRange(nil, file, false, DiffPrefixIndex.Name, func(clock interface{}) interface{} {
+		return diffPrefixIndexKey(repo, file.Path, clock)
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	cursor, err := query.Group("Path").Ungroup().Field("reduction").Map(foldDiffs).Filter(func(diff gorethink.Term) gorethink.Term {
 		return diff.Field("FileType").Ne(persist.FileType_NONE)
 	}).Field("Path").Run(d.dbClient)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer cursor.Close()
 
 	var paths []string
 	if err := cursor.All(&paths); err != nil {
-		return err
+		return nil, err
 	}
-	paths = append(paths, prefix)
+	return paths, nil
+}
 
-	var diffs []*persist.Diff
+// deletePaths writes delete diffs for paths into an open commit.
+//
+// The diffs are inserted one level at a time, from the deepest paths up, so
+// that a path is never deleted while one of its descendants still exists,
+// even if an insert fails midway.  See writeFiles.
+func (d *driver) deletePaths(commit *persist.Commit, paths []string) error {
+	repo := commit.Repo
+	commitID := commit.ID
+
+	diffsByDepth := make(map[int][]*persist.Diff)
+	var depths []int
 	for _, path := range paths {
-		diffs = append(diffs, &persist.Diff{
+		depth := strings.Count(path, "/")
+		if _, ok := diffsByDepth[depth]; !ok {
+			depths = append(depths, depth)
+		}
+		diffsByDepth[depth] = append(diffsByDepth[depth], &persist.Diff{
 			ID:        getDiffID(repo, commitID, path),
 			Repo:      repo,
 			Path:      path,
@@ -2121,46 +5700,292 @@ func (d *driver) DeleteFile(file *pfs.File) error {
 			FileType:  persist.FileType_NONE,
 		})
 	}
+	sort.Sort(sort.Reverse(sort.IntSlice(depths)))
 
-	// TODO: ideally we want to insert the documents ordered by their path,
-	// where we insert the leaves first all the way to the root.  That way
-	// we ensure the consistency of the file system: it's ok if we've removed
-	// "/foo/bar" but not "/foo", but it's problematic if we've removed "/foo"
-	// but not "/foo/bar"
-	_, err = d.getTerm(diffTable).Insert(diffs, gorethink.InsertOpts{
-		Conflict: "replace",
-	}).RunWrite(d.dbClient)
+	for _, depth := range depths {
+		res, err := d.runWrite(d.getTerm(diffTable).Insert(diffsByDepth[depth], gorethink.InsertOpts{
+			Conflict:      "replace",
+			ReturnChanges: true,
+		}))
+		if err != nil {
+			return err
+		}
+		// The data that was written to the deleted paths in this commit no
+		// longer counts towards the size of the commit.
+		if err := d.addCommitSize(commitID, -int64(replacedSize(res.Changes))); err != nil {
+			return err
+		}
+		for _, diff := range diffsByDepth[depth] {
+			d.fileTypes.remove(repo, commitID, diff.Path)
+		}
+	}
+	return nil
+}
 
-	return err
+// replacedSize returns the total size of the diffs that a write replaced.
+func replacedSize(changes []gorethink.ChangeResponse) uint64 {
+	var size uint64
+	for _, change := range changes {
+		oldVal, ok := change.OldValue.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if oldSize, ok := oldVal["Size"].(float64); ok {
+			size += uint64(oldSize)
+		}
+	}
+	return size
+}
+
+func (d *driver) ListCommitDiffs(commit *pfs.Commit) (retDiffInfos []*drive.DiffInfo, retErr error) {
+	defer func(start time.Time) { d.report("ListCommitDiffs", start, retErr, commitKeyValues(commit)...) }(time.Now())
+	rawCommit, err := d.getRawCommit(commit)
+	if err != nil {
+		return nil, err
+	}
+
+	clock := persist.FullClockHead(rawCommit.FullClock)
+	diffs, err := d.getDiffs(d.getTerm(diffTable).GetAllByIndex(
+		DiffClockIndex.Name,
+		diffClockIndexKey(rawCommit.Repo, clock.Branch, clock.Clock),
+	).OrderBy("Path"))
+	if err != nil {
+		return nil, err
+	}
+
+	var diffInfos []*drive.DiffInfo
+	for _, diff := range diffs {
+		diffInfo := &drive.DiffInfo{
+			Path:     diff.Path,
+			Delete:   diff.Delete,
+			Size:     diff.Size,
+			Modified: diff.Modified,
+		}
+		switch diff.FileType {
+		case persist.FileType_NONE:
+			diffInfo.FileType = pfs.FileType_FILE_TYPE_NONE
+		case persist.FileType_FILE:
+			diffInfo.FileType = pfs.FileType_FILE_TYPE_REGULAR
+		case persist.FileType_DIR:
+			diffInfo.FileType = pfs.FileType_FILE_TYPE_DIR
+		default:
+			return nil, fmt.Errorf("unrecognized file type %d; this is likely a bug", diff.FileType)
+		}
+		diffInfos = append(diffInfos, diffInfo)
+	}
+	return diffInfos, nil
+}
+
+func (d *driver) FileHistory(file *pfs.File, from *pfs.Commit) (fileInfos []*pfs.FileInfo, retErr error) {
+	defer func(start time.Time) { d.report("FileHistory", start, retErr, fileKeyValues(file)...) }(time.Now())
+	fixPath(file)
+
+	// The size of the file as of from, which the diffs after it build upon
+	var size uint64
+	if from != nil {
+		diff, err := d.inspectFile(&pfs.File{
+			Commit: from,
+			Path:   file.Path,
+		}, nil, nil)
+		if err != nil {
+			if _, ok := err.(*pfsserver.ErrFileNotFound); !ok {
+				return nil, err
+			}
+		} else {
+			size = diff.Size
+		}
+	}
+
+	query, err := d._getDiffsInCommitRange(from, file.Commit, false, DiffPathIndex.Name, func(clock interface{}) interface{} {
+		return diffPathIndexKey(file.Commit.Repo.Name, file.Path, clock)
+	})
+	if err != nil {
+		return nil, err
+	}
+	diffs, err := d.getDiffs(query)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, diff := range diffs {
+		// Same as foldDiffs
+		if diff.Delete {
+			size = diff.Size
+		} else {
+			size += diff.Size
+		}
+		commit := &pfs.Commit{
+			Repo: file.Commit.Repo,
+			ID:   persist.FullClockHead(diff.Clock).ReadableCommitID(),
+		}
+		fileInfo := &pfs.FileInfo{
+			File: &pfs.File{
+				Commit: commit,
+				Path:   file.Path,
+			},
+			// Deletions have the type NONE
+			FileType:       toPFSFileType(diff.FileType),
+			Modified:       diff.Modified,
+			CommitModified: commit,
+		}
+		if diff.FileType == persist.FileType_FILE {
+			fileInfo.SizeBytes = size
+		}
+		fileInfos = append(fileInfos, fileInfo)
+	}
+	return fileInfos, nil
+}
+
+// ListAllRepoFiles returns every file path that has ever been written in the
+// given repo, mapped to the IDs of the commits that wrote to it.
+func (d *driver) ListAllRepoFiles(repo *pfs.Repo) (files map[string][]string, retErr error) {
+	defer func(start time.Time) { d.report("ListAllRepoFiles", start, retErr, repoKeyValues(repo)...) }(time.Now())
+	if _, err := d.inspectRepo(repo); err != nil {
+		return nil, err
+	}
+
+	cursor, err := d.betweenIndex(
+		diffTable, DiffPathIndex.Name,
+		diffPathIndexKey(repo.Name, gorethink.MinVal, gorethink.MinVal),
+		diffPathIndexKey(repo.Name, gorethink.MaxVal, gorethink.MaxVal),
+		false,
+	).Filter(map[string]interface{}{
+		// Diffs that delete a file have no file type.  Diffs written by
+		// PutFileOverwrite have Delete set, but still write to the file.
+		"FileType": persist.FileType_FILE,
+	}).Group("Path").Map(func(diff gorethink.Term) gorethink.Term {
+		return diff.Field("Clock").Nth(-1)
+	}).Ungroup().Run(d.dbClient, gorethink.RunOpts{ArrayLimit: 10000000})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var groups []struct {
+		Path   string           `gorethink:"group"`
+		Clocks []*persist.Clock `gorethink:"reduction"`
+	}
+	if err := cursor.All(&groups); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string][]string)
+	for _, group := range groups {
+		seen := make(map[string]bool)
+		for _, clock := range group.Clocks {
+			commitID := clock.ReadableCommitID()
+			if seen[commitID] {
+				continue
+			}
+			seen[commitID] = true
+			result[group.Path] = append(result[group.Path], commitID)
+		}
+		sort.Strings(result[group.Path])
+	}
+	return result, nil
 }
 
 func (d *driver) DeleteAll() error {
 	for _, table := range tables {
-		if _, err := d.getTerm(table).Delete().RunWrite(d.dbClient); err != nil {
+		// The schema version describes the database, not its data
+		if table == metaTable {
+			continue
+		}
+		if _, err := d.runWrite(d.getTerm(table).Delete()); err != nil {
 			return err
 		}
 	}
-
+	d.fileTypes.purge()
 	return nil
 }
 
 func (d *driver) ArchiveAll() error {
-	_, err := d.getTerm(commitTable).Update(map[string]interface{}{
+	_, err := d.runWrite(d.getTerm(commitTable).Update(map[string]interface{}{
 		"Archived": true,
-	}).RunWrite(d.dbClient)
+	}))
 	return err
 }
 
+// dumpSampleSize is the number of rows of each table that Dump logs.
+const dumpSampleSize = 10
+
+// Dump logs a snapshot of the database for debugging: the number of rows in
+// each table, a sample of them, and the diffs and commits that are orphaned,
+// i.e. that refer to a commit or repo that doesn't exist.  It only reads
+// from the database, so it's safe to call while the driver is serving
+// requests, but the numbers may be inconsistent with each other if writes
+// happen concurrently.
 func (d *driver) Dump() {
+	count := func(name string, query gorethink.Term) {
+		var n int
+		if err := d.runOne(query.Count(), &n); err != nil {
+			protolion.Errorf("dump: error counting %s: %v", name, err)
+			return
+		}
+		protolion.Infof("dump: %s: %d", name, n)
+	}
+	sample := func(name string, query gorethink.Term) {
+		cursor, err := query.Limit(dumpSampleSize).Run(d.dbClient)
+		if err != nil {
+			protolion.Errorf("dump: error sampling %s: %v", name, err)
+			return
+		}
+		defer cursor.Close()
+		var row map[string]interface{}
+		for cursor.Next(&row) {
+			protolion.Infof("dump: %s: %v", name, row)
+			row = nil
+		}
+		if err := cursor.Err(); err != nil {
+			protolion.Errorf("dump: error sampling %s: %v", name, err)
+		}
+	}
+
+	repos := d.getTerm(repoTable)
+	commits := d.getTerm(commitTable)
+	diffs := d.getTerm(diffTable)
+	count("repos", repos)
+	count("commits", commits)
+	count("finished commits", commits.Filter(func(commit gorethink.Term) gorethink.Term {
+		return commit.Field("Finished").Default(nil).Ne(nil)
+	}))
+	count("open commits", commits.Filter(func(commit gorethink.Term) gorethink.Term {
+		return commit.Field("Finished").Default(nil).Eq(nil)
+	}))
+	count("diffs", diffs)
+	sample("repos", repos)
+	sample("commits", commits)
+	sample("diffs", diffs)
+
+	// A commit is orphaned if its repo is gone, and a diff is orphaned if no
+	// commit has its clock, e.g. if a write raced with DeleteCommit.
+	orphanedCommits := commits.Filter(func(commit gorethink.Term) gorethink.Term {
+		return repos.Get(commit.Field("Repo")).Eq(nil)
+	})
+	orphanedDiffs := diffs.Filter(d.isOrphanedDiff)
+	count("orphaned commits", orphanedCommits)
+	count("orphaned diffs", orphanedDiffs)
+	sample("orphaned commits", orphanedCommits)
+	sample("orphaned diffs", orphanedDiffs)
+}
+
+// runOne runs query and decodes its only result into result.
+func (d *driver) runOne(query gorethink.Term, result interface{}) error {
+	cursor, err := query.Run(d.dbClient)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	return cursor.One(result)
 }
 
 func (d *driver) insertMessage(table Table, message proto.Message) error {
-	_, err := d.getTerm(table).Insert(message).RunWrite(d.dbClient)
+	_, err := d.runWrite(d.getTerm(table).Insert(message))
 	return err
 }
 
 func (d *driver) updateMessage(table Table, message proto.Message) error {
-	_, err := d.getTerm(table).Insert(message, gorethink.InsertOpts{Conflict: "update"}).RunWrite(d.dbClient)
+	_, err := d.runWrite(d.getTerm(table).Insert(message, gorethink.InsertOpts{Conflict: "update"}))
 	return err
 }
 
@@ -2169,6 +5994,7 @@ func (d *driver) getMessageByPrimaryKey(table Table, key interface{}, message pr
 	if err != nil {
 		return err
 	}
+	defer cursor.Close()
 	err = cursor.One(message)
 	if err == gorethink.ErrEmptyResult {
 		return fmt.Errorf("%v not found in table %v", key, table)
@@ -2181,6 +6007,7 @@ func (d *driver) getMessageByIndex(table Table, i *index, key interface{}, messa
 	if err != nil {
 		return err
 	}
+	defer cursor.Close()
 	err = cursor.One(message)
 	if err == gorethink.ErrEmptyResult {
 		return fmt.Errorf("%v not found in index %v of table %v", key, i, table)
@@ -2201,8 +6028,34 @@ func (d *driver) betweenIndex(table Table, index interface{}, minVal interface{}
 	}).Between(minVal, maxVal, opts...)
 }
 
+// runWrite runs a write query, and fails with an ErrWriteTimeout if it
+// doesn't complete within the driver's write timeout.  gorethink can't
+// cancel a query, so a write that times out may still be applied later.
+func (d *driver) runWrite(query gorethink.Term) (gorethink.WriteResponse, error) {
+	if d.writeTimeout <= 0 {
+		return query.RunWrite(d.dbClient)
+	}
+	type result struct {
+		res gorethink.WriteResponse
+		err error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		res, err := query.RunWrite(d.dbClient)
+		resultCh <- result{res, err}
+	}()
+	timer := time.NewTimer(d.writeTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-resultCh:
+		return r.res, r.err
+	case <-timer.C:
+		return gorethink.WriteResponse{}, pfsserver.NewErrWriteTimeout(d.writeTimeout)
+	}
+}
+
 func (d *driver) deleteMessageByPrimaryKey(table Table, key interface{}) error {
-	_, err := d.getTerm(table).Get(key).Delete().RunWrite(d.dbClient)
+	_, err := d.runWrite(d.getTerm(table).Get(key).Delete())
 	return err
 }
 
@@ -2210,6 +6063,13 @@ func (d *driver) deleteMessageByPrimaryKey(table Table, key interface{}) error {
 // The ID can be of 2 forms:
 // 1. branch/clock: like "master/3"
 // 2. branch: like "master".  This would represent the head of the branch.
+// Either form can be followed by git-style ancestry suffixes, like
+// "master^", "master~2" or "master/3~1^", which refer to the ancestors of
+// the commit.
+// Every commit belongs to exactly one branch: its FullClock records the
+// branches that it descends from, so a commit reachable from several
+// branches still has a single ID and a single parent, and resolving an ID
+// never has to pick among branches.
 func (d *driver) getRawCommit(commit *pfs.Commit) (retCommit *persist.Commit, retErr error) {
 	defer func() {
 		if retErr == gorethink.ErrEmptyResult {
@@ -2217,18 +6077,32 @@ func (d *driver) getRawCommit(commit *pfs.Commit) (retCommit *persist.Commit, re
 		}
 	}()
 
-	commitID, err := getRawCommitID(commit.Repo.Name, commit.ID)
-	retCommit = &persist.Commit{}
+	baseID, n, err := parseAncestry(commit.ID)
 	if err != nil {
-		// We see if the commitID is a branch name
+		return nil, err
+	}
+	if baseID != commit.ID {
+		return d.getAncestorRawCommit(&pfs.Commit{
+			Repo: commit.Repo,
+			ID:   baseID,
+		}, n, commit.ID)
+	}
+
+	retCommit = &persist.Commit{}
+	if isBranchName(commit.ID) {
 		if err := d.getHeadOfBranch(commit.Repo.Name, commit.ID, retCommit); err != nil {
 			return nil, err
 		}
 	} else {
+		commitID, err := getRawCommitID(commit.Repo.Name, commit.ID)
+		if err != nil {
+			return nil, err
+		}
 		cursor, err := d.getTerm(commitTable).Get(commitID).Run(d.dbClient)
 		if err != nil {
 			return nil, err
 		}
+		defer cursor.Close()
 
 		if err := cursor.One(retCommit); err != nil {
 			return nil, err
@@ -0,0 +1,3532 @@
+package persist_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/pachyderm/src/client/pfs"
+	"github.com/pachyderm/pachyderm/src/client/pkg/require"
+	"github.com/pachyderm/pachyderm/src/client/pkg/uuid"
+	"github.com/pachyderm/pachyderm/src/client/version"
+	pfsserver "github.com/pachyderm/pachyderm/src/server/pfs"
+	persist "github.com/pachyderm/pachyderm/src/server/pfs/db"
+	"github.com/pachyderm/pachyderm/src/server/pfs/drive"
+	"github.com/pachyderm/pachyderm/src/server/pfs/server"
+
+	"github.com/dancannon/gorethink"
+	"go.pedge.io/lion"
+	"go.pedge.io/pb/go/google/protobuf"
+	"go.pedge.io/proto/server"
+	"go.pedge.io/proto/time"
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+)
+
+var (
+	RethinkAddress       = "localhost:28015"
+	port           int32 = 31651
+)
+
+func TestListAllRepoFiles(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestListAllRepoFiles")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "dir/bar"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.DeleteFile(&pfs.File{Commit: commit2, Path: "dir/bar"}))
+	require.NoError(t, d.FinishCommit(commit2, false))
+
+	commit3, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit3, Path: "buzz"}, pfs.Delimiter_LINE, strings.NewReader("buzz\n")))
+	// Overwriting a file counts as writing to it
+	require.NoError(t, d.PutFileOverwrite(&pfs.File{Commit: commit3, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo2\n")))
+	require.NoError(t, d.PutFileOverwrite(&pfs.File{Commit: commit3, Path: "over"}, pfs.Delimiter_LINE, strings.NewReader("over\n")))
+	require.NoError(t, d.FinishCommit(commit3, false))
+
+	files, err := d.ListAllRepoFiles(repo)
+	require.NoError(t, err)
+	require.Equal(t, 4, len(files))
+	require.Equal(t, []string{commit1.ID, commit2.ID, commit3.ID}, files["/foo"])
+	require.Equal(t, []string{commit1.ID}, files["/dir/bar"])
+	require.Equal(t, []string{commit3.ID}, files["/buzz"])
+	require.Equal(t, []string{commit3.ID}, files["/over"])
+}
+
+func TestGetFileConcatDir(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestGetFileConcatDir")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "dir/b"}, pfs.Delimiter_LINE, strings.NewReader("bb\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "dir/a"}, pfs.Delimiter_LINE, strings.NewReader("aaa\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "dir/c"}, pfs.Delimiter_LINE, strings.NewReader("")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "dir/sub/d"}, pfs.Delimiter_LINE, strings.NewReader("d\n")))
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	dir := &pfs.File{Commit: commit, Path: "dir"}
+	_, err = d.GetFile(dir, nil, 0, 0, nil, false)
+	require.YesError(t, err)
+
+	require.Equal(t, "aaa\nbb\n", getFile(t, d, dir, 0, 0))
+	require.Equal(t, "a\nbb", getFile(t, d, dir, 2, 4))
+	require.Equal(t, "b\n", getFile(t, d, dir, 5, 0))
+}
+
+func TestFileTypeConflictError(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestFileTypeConflictError")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "file"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+
+	err = d.MakeDirectory(&pfs.File{Commit: commit, Path: "file"})
+	require.YesError(t, err)
+	conflict, ok := err.(*pfsserver.ErrFileTypeConflict)
+	require.True(t, ok, err.Error())
+	require.Equal(t, "/file", conflict.Path)
+	require.Equal(t, pfs.FileType_FILE_TYPE_REGULAR, conflict.ExistingType)
+	require.Equal(t, pfs.FileType_FILE_TYPE_DIR, conflict.AttemptedType)
+
+	err = d.PutFile(&pfs.File{Commit: commit, Path: "file/foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n"))
+	require.YesError(t, err)
+	conflict, ok = err.(*pfsserver.ErrFileTypeConflict)
+	require.True(t, ok, err.Error())
+	require.Equal(t, "/file", conflict.Path)
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	// Racing writes may get past the type check in the driver, in which case
+	// the conflict is detected by the database
+	for i := 0; i < 10; i++ {
+		commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+		require.NoError(t, err)
+		dir := fmt.Sprintf("/race%d", i)
+		errCh := make(chan error, 2)
+		go func() {
+			errCh <- d.PutFile(&pfs.File{Commit: commit, Path: dir}, pfs.Delimiter_LINE, strings.NewReader("foo\n"))
+		}()
+		go func() {
+			errCh <- d.PutFile(&pfs.File{Commit: commit, Path: dir + "/foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n"))
+		}()
+		var errs []error
+		for j := 0; j < 2; j++ {
+			if err := <-errCh; err != nil {
+				errs = append(errs, err)
+			}
+		}
+		require.Equal(t, 1, len(errs))
+		conflict, ok := errs[0].(*pfsserver.ErrFileTypeConflict)
+		require.True(t, ok, errs[0].Error())
+		require.Equal(t, dir, conflict.Path)
+		require.NoError(t, d.FinishCommit(commit, false))
+	}
+}
+
+type slowReader struct {
+	io.Reader
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.Reader.Read(p)
+}
+
+func TestPutFileSplit(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestPutFileSplit")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+
+	var readers []io.Reader
+	var expected string
+	for i := 0; i < 5; i++ {
+		chunk := strings.Repeat(fmt.Sprintf("%d\n", i), i+1)
+		expected += chunk
+		// The earlier readers finish last
+		readers = append(readers, &slowReader{
+			Reader: strings.NewReader(chunk),
+			delay:  time.Duration(5-i) * 10 * time.Millisecond,
+		})
+	}
+	file := &pfs.File{Commit: commit, Path: "file"}
+	require.NoError(t, d.PutFileSplit(file, pfs.Delimiter_LINE, readers))
+	require.NoError(t, d.PutFile(file, pfs.Delimiter_LINE, strings.NewReader("last\n")))
+	expected += "last\n"
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	require.Equal(t, expected, getFile(t, d, file, 0, 0))
+	commitInfo, err := d.InspectCommit(commit)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(expected)), commitInfo.SizeBytes)
+}
+
+func TestPutFiles(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestPutFiles")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "/a/foo"}, pfs.Delimiter_LINE, strings.NewReader("foo1\n")))
+
+	require.NoError(t, d.PutFiles(commit, []*drive.PutFileRequest{
+		{Path: "/a/foo", Delimiter: pfs.Delimiter_LINE, Reader: strings.NewReader("foo2\n")},
+		{Path: "/a/b/bar", Delimiter: pfs.Delimiter_LINE, Reader: strings.NewReader("bar\n")},
+		{Path: "a/foo", Delimiter: pfs.Delimiter_LINE, Reader: strings.NewReader("foo3\n")},
+		{Path: "/buzz", Delimiter: pfs.Delimiter_LINE, Reader: strings.NewReader("buzz\n")},
+	}))
+	// A type conflict fails the whole batch
+	require.YesError(t, d.PutFiles(commit, []*drive.PutFileRequest{
+		{Path: "/fizz", Delimiter: pfs.Delimiter_LINE, Reader: strings.NewReader("fizz\n")},
+		{Path: "/buzz/fizz", Delimiter: pfs.Delimiter_LINE, Reader: strings.NewReader("fizz\n")},
+	}))
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	require.Equal(t, "foo1\nfoo2\nfoo3\n", getFile(t, d, &pfs.File{Commit: commit, Path: "/a/foo"}, 0, 0))
+	require.Equal(t, "bar\n", getFile(t, d, &pfs.File{Commit: commit, Path: "/a/b/bar"}, 0, 0))
+	require.Equal(t, "buzz\n", getFile(t, d, &pfs.File{Commit: commit, Path: "/buzz"}, 0, 0))
+	_, err = d.InspectFile(&pfs.File{Commit: commit, Path: "/fizz"}, nil, nil)
+	require.YesError(t, err)
+	fileInfo, err := d.InspectFile(&pfs.File{Commit: commit, Path: "/a/b"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, pfs.FileType_FILE_TYPE_DIR, fileInfo.FileType)
+
+	commitInfo, err := d.InspectCommit(commit)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len("foo1\nfoo2\nfoo3\nbar\nbuzz\n")), commitInfo.SizeBytes)
+}
+
+func TestPutFilesRollback(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestPutFilesRollback")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "/a/foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+
+	// "/a/b/c" is written both as a directory and as a file, so the insert
+	// of the file diffs fails after the directories have been inserted
+	err = d.PutFiles(commit, []*drive.PutFileRequest{
+		{Path: "/a/foo", Delimiter: pfs.Delimiter_LINE, Reader: strings.NewReader("foo\n")},
+		{Path: "/a/b/c", Delimiter: pfs.Delimiter_LINE, Reader: strings.NewReader("c\n")},
+		{Path: "/a/b/c/d", Delimiter: pfs.Delimiter_LINE, Reader: strings.NewReader("d\n")},
+	})
+	require.YesError(t, err)
+	_, ok := err.(*pfsserver.ErrFileTypeConflict)
+	require.True(t, ok, err.Error())
+
+	// No dangling directories, and the existing diffs are restored
+	_, err = d.InspectFile(&pfs.File{Commit: commit, Path: "/a/b"}, nil, nil)
+	require.YesError(t, err)
+	_, err = d.InspectFile(&pfs.File{Commit: commit, Path: "/a/b/c/d"}, nil, nil)
+	require.YesError(t, err)
+	require.Equal(t, "foo\n", getFile(t, d, &pfs.File{Commit: commit, Path: "/a/foo"}, 0, 0))
+
+	require.NoError(t, d.FinishCommit(commit, false))
+	commitInfo, err := d.InspectCommit(commit)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len("foo\n")), commitInfo.SizeBytes)
+}
+
+func TestPutFileDelimiter(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestPutFileDelimiter")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	content := map[pfs.Delimiter]string{
+		pfs.Delimiter_NONE: "foo",
+		pfs.Delimiter_JSON: `{"foo": "bar"}`,
+		pfs.Delimiter_LINE: "foo\n",
+	}
+	for delimiter, data := range content {
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: delimiter.String()}, delimiter, strings.NewReader(data)))
+	}
+
+	invalid := pfs.Delimiter(42)
+	err = d.PutFile(&pfs.File{Commit: commit, Path: "invalid"}, invalid, strings.NewReader("foo\n"))
+	_, ok := err.(*pfsserver.ErrInvalidDelimiter)
+	require.True(t, ok)
+	err = d.PutFiles(commit, []*drive.PutFileRequest{
+		{Path: "valid", Delimiter: pfs.Delimiter_LINE, Reader: strings.NewReader("foo\n")},
+		{Path: "invalid", Delimiter: invalid, Reader: strings.NewReader("foo\n")},
+	})
+	_, ok = err.(*pfsserver.ErrInvalidDelimiter)
+	require.True(t, ok)
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	for delimiter, data := range content {
+		require.Equal(t, data, getFile(t, d, &pfs.File{Commit: commit, Path: delimiter.String()}, 0, 0))
+	}
+	fileInfos, err := d.ListFile(&pfs.File{Commit: commit, Path: "/"}, nil, nil, drive.ListFileNORMAL, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, len(content), len(fileInfos))
+}
+
+func TestPutFileWithInfo(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestPutFileWithInfo")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "file"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+
+	// The size includes the content written in previous commits
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	fileInfo, err := d.PutFileWithInfo(&pfs.File{Commit: &pfs.Commit{Repo: repo, ID: "master"}, Path: "file"}, pfs.Delimiter_LINE, strings.NewReader("bar\n"))
+	require.NoError(t, err)
+	require.Equal(t, commit2.ID, fileInfo.File.Commit.ID)
+	require.Equal(t, "/file", fileInfo.File.Path)
+	require.Equal(t, pfs.FileType_FILE_TYPE_REGULAR, fileInfo.FileType)
+	require.Equal(t, uint64(8), fileInfo.SizeBytes)
+	require.NotNil(t, fileInfo.Modified)
+
+	inspected, err := d.InspectFile(&pfs.File{Commit: commit2, Path: "file"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, inspected, fileInfo)
+	require.NoError(t, d.FinishCommit(commit2, false))
+}
+
+func TestCopyFile(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestCopyFile")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "a/b"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "a/c/d"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "x/y"}, pfs.Delimiter_LINE, strings.NewReader("old\n")))
+	// A file, over an existing one
+	require.NoError(t, d.CopyFile(&pfs.File{Commit: commit1, Path: "a/b"}, &pfs.File{Commit: commit2, Path: "x/y"}))
+	// A directory
+	require.NoError(t, d.CopyFile(&pfs.File{Commit: commit1, Path: "a"}, &pfs.File{Commit: commit2, Path: "e"}))
+	// The destination must not conflict with existing files
+	require.YesError(t, d.CopyFile(&pfs.File{Commit: commit1, Path: "a/b"}, &pfs.File{Commit: commit2, Path: "x"}))
+	require.NoError(t, d.FinishCommit(commit2, false))
+	// The destination commit must be open
+	require.YesError(t, d.CopyFile(&pfs.File{Commit: commit1, Path: "a/b"}, &pfs.File{Commit: commit2, Path: "z"}))
+
+	require.Equal(t, "foo\n", getFile(t, d, &pfs.File{Commit: commit2, Path: "x/y"}, 0, 0))
+	require.Equal(t, "foo\n", getFile(t, d, &pfs.File{Commit: commit2, Path: "e/b"}, 0, 0))
+	require.Equal(t, "bar\n", getFile(t, d, &pfs.File{Commit: commit2, Path: "e/c/d"}, 0, 0))
+	fileInfo, err := d.InspectFile(&pfs.File{Commit: commit2, Path: "e/c"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, pfs.FileType_FILE_TYPE_DIR, fileInfo.FileType)
+	commitInfo, err := d.InspectCommit(commit2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(12), commitInfo.SizeBytes)
+
+	// Across repos
+	other := &pfs.Repo{Name: uniqueString("TestCopyFileOther")}
+	require.NoError(t, d.CreateRepo(other, nil))
+	commit3, err := d.StartCommit(&pfs.Commit{Repo: other, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.CopyFile(&pfs.File{Commit: &pfs.Commit{Repo: repo, ID: "master"}, Path: "e/c/d"}, &pfs.File{Commit: commit3, Path: "d"}))
+	require.NoError(t, d.FinishCommit(commit3, false))
+	require.Equal(t, "bar\n", getFile(t, d, &pfs.File{Commit: commit3, Path: "d"}, 0, 0))
+}
+
+func TestMoveFile(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestMoveFile")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "a/b"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "a/c/d"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "e"}, pfs.Delimiter_LINE, strings.NewReader("buzz\n")))
+	// A file written in this commit
+	require.NoError(t, d.MoveFile(&pfs.File{Commit: commit2, Path: "e"}, &pfs.File{Commit: commit2, Path: "f"}))
+	// A directory written in a previous commit
+	require.NoError(t, d.MoveFile(&pfs.File{Commit: commit2, Path: "a"}, &pfs.File{Commit: commit2, Path: "g/h"}))
+	// Into itself, across commits and from a path that doesn't exist
+	require.YesError(t, d.MoveFile(&pfs.File{Commit: commit2, Path: "g"}, &pfs.File{Commit: commit2, Path: "g/i"}))
+	require.YesError(t, d.MoveFile(&pfs.File{Commit: commit1, Path: "a/b"}, &pfs.File{Commit: commit2, Path: "b"}))
+	require.YesError(t, d.MoveFile(&pfs.File{Commit: commit2, Path: "a"}, &pfs.File{Commit: commit2, Path: "b"}))
+	require.NoError(t, d.FinishCommit(commit2, false))
+
+	fileInfos, err := d.ListFile(&pfs.File{Commit: commit2, Path: "/"}, nil, nil, drive.ListFileNORMAL, 0, 0)
+	require.NoError(t, err)
+	var paths []string
+	for _, fileInfo := range fileInfos {
+		paths = append(paths, fileInfo.File.Path)
+	}
+	require.Equal(t, []string{"/f", "/g"}, paths)
+	require.Equal(t, "buzz\n", getFile(t, d, &pfs.File{Commit: commit2, Path: "f"}, 0, 0))
+	require.Equal(t, "foo\n", getFile(t, d, &pfs.File{Commit: commit2, Path: "g/h/b"}, 0, 0))
+	require.Equal(t, "bar\n", getFile(t, d, &pfs.File{Commit: commit2, Path: "g/h/c/d"}, 0, 0))
+	// The previous commit is unchanged
+	require.Equal(t, "foo\n", getFile(t, d, &pfs.File{Commit: commit1, Path: "a/b"}, 0, 0))
+}
+
+func TestGetFileBranchSnapshot(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestGetFileBranchSnapshot")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "dir/000"}, pfs.Delimiter_LINE, strings.NewReader("0\n")))
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	// Each commit adds a file to the directory
+	done := make(chan struct{})
+	var eg errgroup.Group
+	eg.Go(func() error {
+		for i := 1; ; i++ {
+			select {
+			case <-done:
+				return nil
+			default:
+			}
+			commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+			if err != nil {
+				return err
+			}
+			if err := d.PutFile(&pfs.File{Commit: commit, Path: fmt.Sprintf("dir/%03d", i)}, pfs.Delimiter_LINE, strings.NewReader(fmt.Sprintf("%d\n", i))); err != nil {
+				return err
+			}
+			if err := d.FinishCommit(commit, false); err != nil {
+				return err
+			}
+		}
+	})
+
+	// Every read of the branch head sees the directory as of one commit
+	for i := 0; i < 50; i++ {
+		reader, err := d.GetFile(&pfs.File{Commit: &pfs.Commit{Repo: repo, ID: "master"}, Path: "dir"}, nil, 0, 0, nil, true)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		for j, line := range lines {
+			require.Equal(t, fmt.Sprintf("%d", j), line)
+		}
+	}
+	close(done)
+	require.NoError(t, eg.Wait())
+}
+
+func TestGetFileRange(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestGetFileRange")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	// Each PutFile adds a block to the file
+	file := &pfs.File{Commit: commit, Path: "file"}
+	for _, block := range []string{"aaaa\n", "bbbb\n", "cccc\n"} {
+		require.NoError(t, d.PutFile(file, pfs.Delimiter_LINE, strings.NewReader(block)))
+	}
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	// Across all three blocks
+	require.Equal(t, "aa\nbbbb\ncc", getFile(t, d, file, 2, 10))
+	// Within a block, and up to the end of a block
+	require.Equal(t, "bb", getFile(t, d, file, 6, 2))
+	require.Equal(t, "bbbb\n", getFile(t, d, file, 5, 5))
+	// Until the end of the file
+	require.Equal(t, "b\ncccc\n", getFile(t, d, file, 8, 0))
+
+	// A range that ends past the end of the file is shortened
+	require.Equal(t, "cc\n", getFile(t, d, file, 12, 100))
+	require.Equal(t, "", getFile(t, d, file, 15, 10))
+	// A range that starts past the end of the file is an error
+	_, err = d.GetFile(file, nil, 16, 0, nil, false)
+	require.YesError(t, err)
+	_, ok := err.(*pfsserver.ErrRangeOutOfBounds)
+	require.True(t, ok)
+}
+
+func TestGetFileReaderAt(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: "repo"}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	// Each PutFile adds a block to the file
+	file := &pfs.File{Commit: commit, Path: "file"}
+	var content string
+	for i := 0; i < 10; i++ {
+		chunk := strings.Repeat(fmt.Sprintf("%d", i), 100+i)
+		content += chunk
+		require.NoError(t, d.PutFile(file, pfs.Delimiter_LINE, strings.NewReader(chunk)))
+	}
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	readerAt, err := d.GetFileReaderAt(file, nil, nil)
+	require.NoError(t, err)
+	var eg errgroup.Group
+	for off := 0; off < len(content); off += 37 {
+		off := off
+		eg.Go(func() error {
+			// Reads overlap each other and cross block boundaries
+			data := make([]byte, 250)
+			n, err := readerAt.ReadAt(data, int64(off))
+			expected := content[off:]
+			if len(expected) > len(data) {
+				expected = expected[:len(data)]
+				if err != nil {
+					return err
+				}
+			} else if err != io.EOF {
+				return fmt.Errorf("expected EOF reading at %d, got %v", off, err)
+			}
+			if string(data[:n]) != expected {
+				return fmt.Errorf("read %q at %d, expected %q", data[:n], off, expected)
+			}
+			return nil
+		})
+	}
+	require.NoError(t, eg.Wait())
+
+	n, err := readerAt.ReadAt(make([]byte, 10), int64(len(content)))
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 0, n)
+
+	_, err = d.GetFileReaderAt(&pfs.File{Commit: commit, Path: "/"}, nil, nil)
+	require.YesError(t, err)
+}
+
+func TestDedupBlocks(t *testing.T) {
+	blockAddress := getBlockAddress(t)
+	newDriver := func(dedupBlocks bool) drive.Driver {
+		dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
+		require.NoError(t, persist.InitDB(RethinkAddress, dbName, "", 0, 0))
+		d, err := persist.NewDriver(blockAddress, RethinkAddress, dbName, &persist.DriverOptions{DedupBlocks: dedupBlocks})
+		require.NoError(t, err)
+		return d
+	}
+	d := newDriver(true)
+	plain := newDriver(false)
+
+	lines := strings.Repeat("foo\n", 1000)
+	objects := strings.Repeat(`{"foo": "bar"}`, 1000)
+	for _, d := range []drive.Driver{d, plain} {
+		repo := &pfs.Repo{Name: "repo"}
+		require.NoError(t, d.CreateRepo(repo, nil))
+		commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+		require.NoError(t, err)
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "lines1"}, pfs.Delimiter_LINE, strings.NewReader(lines)))
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "lines2"}, pfs.Delimiter_LINE, strings.NewReader(lines)))
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "objects"}, pfs.Delimiter_JSON, strings.NewReader(objects)))
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "empty"}, pfs.Delimiter_LINE, strings.NewReader("")))
+		require.NoError(t, d.FinishCommit(commit, false))
+	}
+
+	commit := &pfs.Commit{Repo: &pfs.Repo{Name: "repo"}, ID: "master"}
+	blockRefs := func(d drive.Driver, path string) []string {
+		refs, err := d.GetFileBlockRefs(&pfs.File{Commit: commit, Path: path}, nil, nil)
+		require.NoError(t, err)
+		var res []string
+		for _, ref := range refs {
+			res = append(res, fmt.Sprintf("%s:%d-%d", ref.Hash, ref.Lower, ref.Upper))
+		}
+		return res
+	}
+	// Duplicate content refers to the same blocks
+	require.Equal(t, blockRefs(d, "lines1"), blockRefs(d, "lines2"))
+	// The blocks are the same as those the block server computes
+	for _, path := range []string{"lines1", "objects", "empty"} {
+		require.Equal(t, blockRefs(plain, path), blockRefs(d, path))
+	}
+	require.Equal(t, lines, getFile(t, d, &pfs.File{Commit: commit, Path: "lines2"}, 0, 0))
+	require.Equal(t, objects, getFile(t, d, &pfs.File{Commit: commit, Path: "objects"}, 0, 0))
+	require.Equal(t, "", getFile(t, d, &pfs.File{Commit: commit, Path: "empty"}, 0, 0))
+}
+
+func TestVerifyBlocks(t *testing.T) {
+	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
+	require.NoError(t, persist.InitDB(RethinkAddress, dbName, "", 0, 0))
+	blockDir := uniqueString("/tmp/pach_test/run")
+	blockAddress := serveBlocks(t, blockDir)
+	newDriver := func(verifyBlocks bool) drive.Driver {
+		d, err := persist.NewDriver(blockAddress, RethinkAddress, dbName, &persist.DriverOptions{VerifyBlocks: verifyBlocks})
+		require.NoError(t, err)
+		return d
+	}
+	d := newDriver(true)
+	repo := &pfs.Repo{Name: uniqueString("TestVerifyBlocks")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	file := &pfs.File{Commit: commit, Path: "foo"}
+	require.NoError(t, d.PutFile(file, pfs.Delimiter_LINE, strings.NewReader("foo\nbar\n")))
+	require.NoError(t, d.FinishCommit(commit, false))
+	require.Equal(t, "bar\n", getFile(t, d, file, 4, 0))
+
+	// Corrupt the content of the blocks without changing their size
+	blockPaths, err := filepath.Glob(filepath.Join(blockDir, "block", "*"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(blockPaths))
+	require.NoError(t, ioutil.WriteFile(blockPaths[0], []byte("f00\nbar\n"), 0666))
+
+	// Only the part of the block that's read is corrupted, but the whole
+	// block is checked
+	reader, err := d.GetFile(file, nil, 4, 0, nil, true)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	require.YesError(t, err)
+	_, ok := err.(*pfsserver.ErrBlockCorrupted)
+	require.True(t, ok)
+	require.NoError(t, reader.Close())
+	readerAt, err := d.GetFileReaderAt(file, nil, nil)
+	require.NoError(t, err)
+	_, err = readerAt.ReadAt(make([]byte, 4), 4)
+	require.YesError(t, err)
+	_, ok = err.(*pfsserver.ErrBlockCorrupted)
+	require.True(t, ok)
+
+	// Without verification, the corrupted content is read
+	require.Equal(t, "f00\nbar\n", getFile(t, newDriver(false), file, 0, 0))
+}
+
+func TestFileHandle(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestFileHandle")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, d.PutFileHandle(&pfs.File{Commit: commit, Path: "/a/foo"}, "handle", pfs.Delimiter_LINE, strings.NewReader("foo1\n")))
+	require.NoError(t, d.PutFileHandle(&pfs.File{Commit: commit, Path: "/a/bar"}, "handle", pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	require.NoError(t, d.PutFileHandle(&pfs.File{Commit: commit, Path: "/a/foo"}, "handle", pfs.Delimiter_LINE, strings.NewReader("foo2\n")))
+	require.NoError(t, d.PutFileHandle(&pfs.File{Commit: commit, Path: "/aborted"}, "aborted", pfs.Delimiter_LINE, strings.NewReader("aborted\n")))
+	require.NoError(t, d.PutFileHandle(&pfs.File{Commit: commit, Path: "/unfinished"}, "unfinished", pfs.Delimiter_LINE, strings.NewReader("unfinished\n")))
+
+	// Nothing is visible until the handle is committed
+	_, err = d.InspectFile(&pfs.File{Commit: commit, Path: "/a"}, nil, nil)
+	require.YesError(t, err)
+	require.NoError(t, d.CommitFileHandle(commit, "handle"))
+	require.Equal(t, "foo1\nfoo2\n", getFile(t, d, &pfs.File{Commit: commit, Path: "/a/foo"}, 0, 0))
+	require.Equal(t, "bar\n", getFile(t, d, &pfs.File{Commit: commit, Path: "/a/bar"}, 0, 0))
+	// Nothing is staged under a handle once it's committed or aborted
+	err = d.CommitFileHandle(commit, "handle")
+	_, ok := err.(*pfsserver.ErrHandleNotFound)
+	require.True(t, ok)
+	require.Equal(t, "foo1\nfoo2\n", getFile(t, d, &pfs.File{Commit: commit, Path: "/a/foo"}, 0, 0))
+
+	require.NoError(t, d.AbortFileHandle(commit, "aborted"))
+	err = d.CommitFileHandle(commit, "aborted")
+	_, ok = err.(*pfsserver.ErrHandleNotFound)
+	require.True(t, ok)
+	err = d.CommitFileHandle(commit, "nonexistent")
+	_, ok = err.(*pfsserver.ErrHandleNotFound)
+	require.True(t, ok)
+	_, err = d.InspectFile(&pfs.File{Commit: commit, Path: "/aborted"}, nil, nil)
+	require.YesError(t, err)
+
+	require.NoError(t, d.FinishCommit(commit, false))
+	require.YesError(t, d.CommitFileHandle(commit, "unfinished"))
+	_, err = d.InspectFile(&pfs.File{Commit: commit, Path: "/unfinished"}, nil, nil)
+	require.YesError(t, err)
+
+	commitInfo, err := d.InspectCommit(commit)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len("foo1\nfoo2\nbar\n")), commitInfo.SizeBytes)
+}
+
+func TestCanonicalPaths(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestCanonicalPaths")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+
+	for path, canonicalPath := range map[string]string{
+		"/a/./b":       "/a/b",
+		"/a//c":        "/a/c",
+		"/a/../d":      "/d",
+		"e/":           "/e",
+		"/../../f":     "/f",
+		"/a/x/../../g": "/g",
+	} {
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: path}, pfs.Delimiter_LINE, strings.NewReader(canonicalPath+"\n")))
+		require.Equal(t, canonicalPath+"\n", getFile(t, d, &pfs.File{Commit: commit, Path: canonicalPath}, 0, 0))
+		require.Equal(t, canonicalPath+"\n", getFile(t, d, &pfs.File{Commit: commit, Path: path}, 0, 0))
+	}
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	// The directories that were created match the canonical paths
+	fileInfos, err := d.ListFile(&pfs.File{Commit: commit, Path: "/"}, nil, nil, drive.ListFileNORMAL, 0, 0)
+	require.NoError(t, err)
+	var paths []string
+	for _, fileInfo := range fileInfos {
+		paths = append(paths, fileInfo.File.Path)
+	}
+	sort.Strings(paths)
+	require.Equal(t, []string{"/a", "/d", "/e", "/f", "/g"}, paths)
+	fileInfos, err = d.ListFile(&pfs.File{Commit: commit, Path: "/a/."}, nil, nil, drive.ListFileNORMAL, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(fileInfos))
+	_, err = d.InspectFile(&pfs.File{Commit: commit, Path: "/a/x"}, nil, nil)
+	require.YesError(t, err)
+}
+
+func TestGetFiles(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestGetFiles")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	paths := []string{"/a.csv", "/b.txt", "/data/c.csv", "/data/sub/d.csv", "/data/sub/e.txt"}
+	for _, path := range paths {
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: path}, pfs.Delimiter_LINE, strings.NewReader(path+"\n")))
+	}
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	getFiles := func(glob string) []string {
+		readers, err := d.GetFiles(commit, glob, nil)
+		require.NoError(t, err, glob)
+		var paths []string
+		for path, reader := range readers {
+			data, err := ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			require.NoError(t, reader.Close())
+			require.Equal(t, path+"\n", string(data))
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		return paths
+	}
+	require.Equal(t, []string{"/a.csv"}, getFiles("*.csv"))
+	require.Equal(t, []string{"/data/c.csv"}, getFiles("/data/*.csv"))
+	require.Equal(t, []string{"/data/c.csv", "/data/sub/d.csv"}, getFiles("/data/**/*.csv"))
+	require.Equal(t, []string{"/a.csv", "/data/c.csv", "/data/sub/d.csv"}, getFiles("**/*.csv"))
+	require.Equal(t, paths, getFiles("**"))
+	require.Equal(t, []string{"/data/sub/e.txt"}, getFiles("/data/sub/e.txt"))
+	require.Equal(t, 0, len(getFiles("/nothing/*")))
+
+	_, err = d.GetFiles(commit, "/data/[", nil)
+	require.YesError(t, err)
+}
+
+func TestDeleteFileDeepestFirst(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestDeleteFileDeepestFirst")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	paths := []string{"/a", "/a/b", "/a/b/c", "/a/b/c/d", "/a/b/c/d/e"}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: fmt.Sprintf("/a/b/c/d/e/file%d", i)}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	}
+
+	exists := func(path string) bool {
+		_, err := d.InspectFile(&pfs.File{Commit: commit, Path: path}, nil, nil)
+		return err == nil
+	}
+	done := make(chan struct{})
+	var violations []string
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// Deletions are permanent, so if a directory is gone, none of
+			// its descendants may show up afterwards
+			for i := 0; i < len(paths)-1; i++ {
+				if !exists(paths[i]) && exists(paths[i+1]) {
+					violations = append(violations, paths[i])
+				}
+			}
+			if !exists("/a/b/c/d/e") {
+				fileInfos, err := d.ListFile(&pfs.File{Commit: commit, Path: "/a/b/c/d/e"}, nil, nil, drive.ListFileNORMAL, 0, 0)
+				if err == nil && len(fileInfos) > 0 {
+					violations = append(violations, "/a/b/c/d/e")
+				}
+			}
+		}
+	}()
+	require.NoError(t, d.DeleteFile(&pfs.File{Commit: commit, Path: "/a"}))
+	close(done)
+	wg.Wait()
+	require.Equal(t, 0, len(violations))
+
+	for _, path := range paths {
+		require.False(t, exists(path), path)
+	}
+	require.NoError(t, d.FinishCommit(commit, false))
+}
+
+func TestDeleteFiles(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestDeleteFiles")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	for _, path := range []string{"/logs/a.tmp", "/logs/b.log", "/logs/old/c.tmp", "/logs/old.tmp/d.log", "/e.tmp"} {
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: path}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	}
+	require.NoError(t, d.FinishCommit(commit1, false))
+
+	// The files from the parent commit can be deleted
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "/logs/new.tmp"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	// A matching directory is deleted along with its content
+	require.NoError(t, d.DeleteFiles(commit2, "/logs/*.tmp"))
+	require.NoError(t, d.FinishCommit(commit2, false))
+
+	listPaths := func(commit *pfs.Commit) []string {
+		readers, err := d.GetFiles(commit, "**", nil)
+		require.NoError(t, err)
+		var paths []string
+		for path, reader := range readers {
+			require.NoError(t, reader.Close())
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		return paths
+	}
+	require.Equal(t, []string{"/e.tmp", "/logs/b.log", "/logs/old/c.tmp"}, listPaths(commit2))
+	_, err = d.InspectFile(&pfs.File{Commit: commit2, Path: "/logs/old.tmp"}, nil, nil)
+	require.YesError(t, err)
+
+	commit3, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.DeleteFiles(commit3, "**/*.tmp"))
+	// Nothing matches
+	require.NoError(t, d.DeleteFiles(commit3, "/nothing/*"))
+	require.NoError(t, d.FinishCommit(commit3, false))
+	require.Equal(t, []string{"/logs/b.log"}, listPaths(commit3))
+	// Directories are left alone when only their content matches
+	fileInfo, err := d.InspectFile(&pfs.File{Commit: commit3, Path: "/logs/old"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, pfs.FileType_FILE_TYPE_DIR, fileInfo.FileType)
+
+	// The commit's size doesn't count the deleted file
+	commitInfo, err := d.InspectCommit(commit2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), commitInfo.SizeBytes)
+
+	require.YesError(t, d.DeleteFiles(commit3, "**"))
+	commit4, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.YesError(t, d.DeleteFiles(commit4, "/logs/["))
+}
+
+func TestGetFileBlockRefs(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestGetFileBlockRefs")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	file1 := &pfs.File{Commit: commit1, Path: "dir/file"}
+	require.NoError(t, d.PutFile(file1, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	file2 := &pfs.File{Commit: commit2, Path: "dir/file"}
+	require.NoError(t, d.PutFile(file2, pfs.Delimiter_LINE, strings.NewReader("barbaz\n")))
+	require.NoError(t, d.FinishCommit(commit2, false))
+
+	blockRefs, err := d.GetFileBlockRefs(file1, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(blockRefs))
+	require.Equal(t, uint64(4), blockRefs[0].Size())
+
+	blockRefs, err = d.GetFileBlockRefs(file2, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(blockRefs))
+	var size uint64
+	for _, blockRef := range blockRefs {
+		require.NotEqual(t, "", blockRef.Hash)
+		size += blockRef.Size()
+	}
+	require.Equal(t, uint64(11), size)
+
+	// Only the blocks added since commit1
+	blockRefs, err = d.GetFileBlockRefs(file2, nil, &pfs.DiffMethod{FromCommit: commit1})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(blockRefs))
+	require.Equal(t, uint64(7), blockRefs[0].Size())
+
+	_, err = d.GetFileBlockRefs(&pfs.File{Commit: commit2, Path: "dir"}, nil, nil)
+	require.YesError(t, err)
+	_, err = d.GetFileBlockRefs(&pfs.File{Commit: commit2, Path: "nonexistent"}, nil, nil)
+	require.YesError(t, err)
+}
+
+func TestGetFileClose(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestGetFileClose")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "file"}, pfs.Delimiter_LINE, strings.NewReader(strings.Repeat("foo\n", 1000))))
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	reader, err := d.GetFile(&pfs.File{Commit: commit, Path: "file"}, nil, 0, 0, nil, false)
+	require.NoError(t, err)
+	data := make([]byte, 4)
+	n, err := reader.Read(data)
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+	require.Equal(t, "foo\n", string(data))
+
+	require.NoError(t, reader.Close())
+	n, err = reader.Read(data)
+	require.Equal(t, persist.ErrReaderClosed, err)
+	require.Equal(t, 0, n)
+}
+
+func TestWriteToFinishedCommit(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestWriteToFinishedCommit")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "file"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	err = d.PutFile(&pfs.File{Commit: commit, Path: "file"}, pfs.Delimiter_LINE, strings.NewReader("bar\n"))
+	_, ok := err.(*pfsserver.ErrCommitFinished)
+	require.True(t, ok)
+
+	err = d.DeleteFile(&pfs.File{Commit: commit, Path: "file"})
+	_, ok = err.(*pfsserver.ErrCommitFinished)
+	require.True(t, ok)
+
+	err = d.PutFileOverwrite(&pfs.File{Commit: commit, Path: "file"}, pfs.Delimiter_LINE, strings.NewReader("bar\n"))
+	_, ok = err.(*pfsserver.ErrCommitFinished)
+	require.True(t, ok)
+
+	err = d.MakeDirectory(&pfs.File{Commit: commit, Path: "dir"})
+	_, ok = err.(*pfsserver.ErrCommitFinished)
+	require.True(t, ok)
+
+	require.Equal(t, "foo\n", getFile(t, d, &pfs.File{Commit: commit, Path: "file"}, 0, 0))
+}
+
+func TestFileTypeConflict(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestFileTypeConflict")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.MakeDirectory(&pfs.File{Commit: commit1, Path: "dir"}))
+	// Check twice so that the second check is served by the cache
+	for i := 0; i < 2; i++ {
+		require.YesError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "foo/bar"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+		require.YesError(t, d.MakeDirectory(&pfs.File{Commit: commit1, Path: "foo"}))
+		require.YesError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "dir"}, pfs.Delimiter_LINE, strings.NewReader("dir\n")))
+	}
+	require.NoError(t, d.FinishCommit(commit1, false))
+
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.YesError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "foo/bar"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	// Once the file is deleted, its path can be used as a directory
+	require.NoError(t, d.DeleteFile(&pfs.File{Commit: commit2, Path: "foo"}))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "foo/bar"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	require.YesError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit2, false))
+}
+
+func TestRepoSize(t *testing.T) {
+	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
+	require.NoError(t, persist.InitDB(RethinkAddress, dbName, "", 0, 0))
+	d, err := persist.NewDriver(getBlockAddress(t), RethinkAddress, dbName, nil)
+	require.NoError(t, err)
+	repo := &pfs.Repo{Name: uniqueString("TestRepoSize")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "bar"}, pfs.Delimiter_LINE, strings.NewReader("barbar\n")))
+
+	// Open commits don't count towards the size of the repo
+	repoInfo, err := d.InspectRepo(repo)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), repoInfo.SizeBytes)
+
+	require.NoError(t, d.FinishCommit(commit2, false))
+
+	// Simulate a crash that left a stale size in the repo document; the size
+	// of the repo should only depend on its commits.
+	dbClient, err := persist.DbConnect(RethinkAddress)
+	require.NoError(t, err)
+	_, err = gorethink.DB(dbName).Table("Repos").Get(repo.Name).Update(map[string]interface{}{
+		"Size": 12345,
+	}).RunWrite(dbClient)
+	require.NoError(t, err)
+
+	repoInfo, err = d.InspectRepo(repo)
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), repoInfo.SizeBytes)
+	repoInfos, err := d.ListRepo(nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(repoInfos))
+	require.Equal(t, uint64(11), repoInfos[0].SizeBytes)
+}
+
+func TestOpenFile(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestOpenFile")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "dir/file"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "dir/file"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "dir/file2"}, pfs.Delimiter_LINE, strings.NewReader("foo\nbar\n")))
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	handle, err := d.OpenFile(&pfs.File{Commit: commit, Path: "dir/file"})
+	require.NoError(t, err)
+	fileInfo, err := d.InspectFile(&pfs.File{Commit: commit, Path: "dir/file"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, fileInfo, handle.Info)
+	require.Equal(t, uint64(8), handle.Info.SizeBytes)
+	require.NotEqual(t, "", handle.Hash)
+
+	reader := handle.Reader()
+	data, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, "foo\nbar\n", string(data))
+
+	_, err = d.OpenFile(&pfs.File{Commit: commit, Path: "dir"})
+	require.YesError(t, err)
+}
+
+func TestCursorsAreClosed(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestCursorsAreClosed")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	for i := 0; i < 5000; i++ {
+		_, err := d.InspectCommit(commit)
+		require.NoError(t, err)
+	}
+
+	dbClient, err := persist.DbConnect(RethinkAddress)
+	require.NoError(t, err)
+	defer dbClient.Close()
+	cursor, err := gorethink.DB("rethinkdb").Table("jobs").Filter(map[string]interface{}{
+		"type": "query",
+	}).Count().Run(dbClient)
+	require.NoError(t, err)
+	defer cursor.Close()
+	var numQueries int
+	require.NoError(t, cursor.One(&numQueries))
+	// Other tests might be running queries concurrently, so we can't expect
+	// an exact number here.
+	require.True(t, numQueries < 100)
+}
+
+func TestStartCommitAfterCrash(t *testing.T) {
+	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
+	require.NoError(t, persist.InitDB(RethinkAddress, dbName, "", 0, 0))
+	d, err := persist.NewDriver(getBlockAddress(t), RethinkAddress, dbName, nil)
+	require.NoError(t, err)
+	repo := &pfs.Repo{Name: uniqueString("TestStartCommitAfterCrash")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit1, false))
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+
+	// Simulate a crash that lost the commit document.  Since the clock of a
+	// commit is stored in the commit document itself, nothing is orphaned.
+	dbClient, err := persist.DbConnect(RethinkAddress)
+	require.NoError(t, err)
+	defer dbClient.Close()
+	_, err = gorethink.DB(dbName).Table("Commits").Filter(map[string]interface{}{
+		"Repo":     repo.Name,
+		"Finished": nil,
+	}).Delete().RunWrite(dbClient)
+	require.NoError(t, err)
+
+	commit3, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, commit2.ID, commit3.ID)
+	require.NoError(t, d.FinishCommit(commit3, false))
+}
+
+func TestListFilePagination(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestListFilePagination")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	numFiles := 10
+	for i := 0; i < numFiles; i++ {
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: fmt.Sprintf("dir/%d/file", i)}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	}
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	for _, mode := range []drive.ListFileMode{drive.ListFileNORMAL, drive.ListFileFAST, drive.ListFileRECURSE} {
+		var paths []string
+		for offset := 0; ; offset += 3 {
+			fileInfos, err := d.ListFile(&pfs.File{Commit: commit, Path: "dir"}, nil, nil, mode, offset, 3)
+			require.NoError(t, err)
+			if len(fileInfos) == 0 {
+				break
+			}
+			require.True(t, len(fileInfos) <= 3)
+			for _, fileInfo := range fileInfos {
+				require.Equal(t, pfs.FileType_FILE_TYPE_DIR, fileInfo.FileType)
+				if mode == drive.ListFileRECURSE {
+					require.Equal(t, uint64(4), fileInfo.SizeBytes)
+				}
+				paths = append(paths, fileInfo.File.Path)
+			}
+		}
+		require.Equal(t, numFiles, len(paths))
+		require.True(t, sort.StringsAreSorted(paths))
+	}
+}
+
+func TestListFileShard(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestListFileShard")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	numFiles := 20
+	for i := 0; i < numFiles; i++ {
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: fmt.Sprintf("file%02d", i)}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	}
+	require.NoError(t, d.FinishCommit(commit, false))
+	root := &pfs.File{Commit: commit, Path: "/"}
+
+	listFile := func(shard *pfs.Shard, offset int, limit int) []string {
+		fileInfos, err := d.ListFile(root, shard, nil, drive.ListFileNORMAL, offset, limit)
+		require.NoError(t, err)
+		var paths []string
+		for _, fileInfo := range fileInfos {
+			paths = append(paths, fileInfo.File.Path)
+		}
+		return paths
+	}
+	all := listFile(nil, 0, 0)
+	require.Equal(t, numFiles, len(all))
+
+	numShards := 3
+	seen := make(map[string]bool)
+	for i := 0; i < numShards; i++ {
+		shard := &pfs.Shard{FileNumber: uint64(i), FileModulus: uint64(numShards)}
+		paths := listFile(shard, 0, 0)
+		for _, path := range paths {
+			require.False(t, seen[path])
+			seen[path] = true
+		}
+
+		// Pages are selected among the children in the shard
+		var pagedPaths []string
+		for offset := 0; ; offset += 2 {
+			page := listFile(shard, offset, 2)
+			if len(page) == 0 {
+				break
+			}
+			if offset+2 <= len(paths) {
+				require.Equal(t, 2, len(page))
+			}
+			pagedPaths = append(pagedPaths, page...)
+		}
+		require.Equal(t, paths, pagedPaths)
+	}
+	var union []string
+	for path := range seen {
+		union = append(union, path)
+	}
+	sort.Strings(union)
+	require.Equal(t, all, union)
+}
+
+func TestListFileStream(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestListFileStream")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: fmt.Sprintf("dir/%d", i)}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	}
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	for _, mode := range []drive.ListFileMode{drive.ListFileNORMAL, drive.ListFileFAST, drive.ListFileRECURSE} {
+		expected, err := d.ListFile(&pfs.File{Commit: commit, Path: "dir"}, nil, nil, mode, 0, 0)
+		require.NoError(t, err)
+		fileInfoCh, errCh := d.ListFileStream(context.Background(), &pfs.File{Commit: commit, Path: "dir"}, nil, nil, mode)
+		var fileInfos []*pfs.FileInfo
+		for fileInfo := range fileInfoCh {
+			fileInfos = append(fileInfos, fileInfo)
+		}
+		require.NoError(t, <-errCh)
+		require.Equal(t, expected, fileInfos)
+	}
+
+	fileInfoCh, errCh := d.ListFileStream(context.Background(), &pfs.File{Commit: commit, Path: "nonexistent"}, nil, nil, drive.ListFileNORMAL)
+	for range fileInfoCh {
+	}
+	require.YesError(t, <-errCh)
+
+	// A consumer that stops early cancels the context instead of draining
+	ctx, cancel := context.WithCancel(context.Background())
+	fileInfoCh, errCh = d.ListFileStream(ctx, &pfs.File{Commit: commit, Path: "dir"}, nil, nil, drive.ListFileNORMAL)
+	<-fileInfoCh
+	cancel()
+	for range fileInfoCh {
+	}
+	require.Equal(t, context.Canceled, <-errCh)
+}
+
+func TestListCommitDiffs(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestListCommitDiffs")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "dir/foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "bar"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "dir/foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.DeleteFile(&pfs.File{Commit: commit2, Path: "bar"}))
+	require.NoError(t, d.FinishCommit(commit2, false))
+
+	diffInfos, err := d.ListCommitDiffs(commit2)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(diffInfos))
+	require.Equal(t, "/bar", diffInfos[0].Path)
+	require.True(t, diffInfos[0].Delete)
+	require.Equal(t, pfs.FileType_FILE_TYPE_NONE, diffInfos[0].FileType)
+	require.Equal(t, "/dir", diffInfos[1].Path)
+	require.False(t, diffInfos[1].Delete)
+	require.Equal(t, pfs.FileType_FILE_TYPE_DIR, diffInfos[1].FileType)
+	require.Equal(t, "/dir/foo", diffInfos[2].Path)
+	require.False(t, diffInfos[2].Delete)
+	require.Equal(t, pfs.FileType_FILE_TYPE_REGULAR, diffInfos[2].FileType)
+	// Only the content written in this commit is counted
+	require.Equal(t, uint64(4), diffInfos[2].Size)
+	require.NotNil(t, diffInfos[2].Modified)
+}
+
+func TestDeleteBranch(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestDeleteBranch")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+	commit2, err := d.ForkCommit(commit1, "fork", nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit2, false))
+
+	// master can't be deleted because fork was forked off of it
+	require.YesError(t, d.DeleteBranch(repo, "master"))
+	branches, err := d.ListBranch(repo, pfs.CommitStatus_ALL)
+	require.NoError(t, err)
+	require.Equal(t, []string{"fork", "master"}, branches)
+
+	require.NoError(t, d.DeleteBranch(repo, "fork"))
+	require.NoError(t, d.DeleteBranch(repo, "master"))
+	branches, err = d.ListBranch(repo, pfs.CommitStatus_ALL)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(branches))
+	_, err = d.InspectCommit(commit1)
+	require.YesError(t, err)
+
+	// The branch can be recreated, and doesn't contain the old files
+	commit3, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, commit1.ID, commit3.ID)
+	require.NoError(t, d.FinishCommit(commit3, false))
+	_, err = d.InspectFile(&pfs.File{Commit: commit3, Path: "foo"}, nil, nil)
+	require.YesError(t, err)
+
+	err = d.DeleteBranch(repo, "nonexistent")
+	_, ok := err.(*pfsserver.ErrCommitNotFound)
+	require.True(t, ok)
+	err = d.DeleteBranch(&pfs.Repo{Name: uniqueString("nonexistent")}, "master")
+	_, ok = err.(*pfsserver.ErrRepoNotFound)
+	require.True(t, ok)
+}
+
+func TestRenameBranch(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestRenameBranch")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+	fork, err := d.ForkCommit(commit1, "fork", nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(fork, false))
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+
+	require.YesError(t, d.RenameBranch(repo, "master", "fork"))
+	require.YesError(t, d.RenameBranch(repo, "nonexistent", "main"))
+	require.NoError(t, d.RenameBranch(repo, "master", "main"))
+
+	branches, err := d.ListBranch(repo, pfs.CommitStatus_ALL)
+	require.NoError(t, err)
+	require.Equal(t, []string{"fork", "main"}, branches)
+	_, err = d.InspectCommit(&pfs.Commit{Repo: repo, ID: "master"})
+	require.YesError(t, err)
+
+	// The head of the branch resolves under the new name
+	commitInfo, err := d.InspectCommit(&pfs.Commit{Repo: repo, ID: "main"})
+	require.NoError(t, err)
+	require.Equal(t, "main/1", commitInfo.Commit.ID)
+	require.Equal(t, "main/0", commitInfo.ParentCommit.ID)
+
+	// Writes to the open commit keep going to the same diff
+	commit2 = &pfs.Commit{Repo: repo, ID: "main/1"}
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("buzz\n")))
+	require.NoError(t, d.FinishCommit(commit2, false))
+	require.Equal(t, "foo\nbar\nbuzz\n", getFile(t, d, &pfs.File{Commit: commit2, Path: "foo"}, 0, 0))
+	diffInfos, err := d.ListCommitDiffs(commit2)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(diffInfos))
+
+	// The fork still sees the content of its parent
+	require.Equal(t, "foo\n", getFile(t, d, &pfs.File{Commit: fork, Path: "foo"}, 0, 0))
+	commitInfo, err = d.InspectCommit(fork)
+	require.NoError(t, err)
+	require.Equal(t, "main/0", commitInfo.ParentCommit.ID)
+}
+
+func TestRenameBranchProvenance(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	upstream := &pfs.Repo{Name: uniqueString("TestRenameBranchProvenanceUpstream")}
+	require.NoError(t, d.CreateRepo(upstream, nil))
+	middle := &pfs.Repo{Name: uniqueString("TestRenameBranchProvenanceMiddle")}
+	require.NoError(t, d.CreateRepo(middle, []*pfs.Repo{upstream}))
+	downstream := &pfs.Repo{Name: uniqueString("TestRenameBranchProvenanceDownstream")}
+	require.NoError(t, d.CreateRepo(downstream, []*pfs.Repo{middle}))
+
+	upstreamCommit, err := d.StartCommit(&pfs.Commit{Repo: upstream, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(upstreamCommit, false))
+	middleCommit, err := d.StartCommit(&pfs.Commit{Repo: middle, ID: "master"}, []*pfs.Commit{upstreamCommit})
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(middleCommit, false))
+	downstreamCommit, err := d.StartCommit(&pfs.Commit{Repo: downstream, ID: "master"}, []*pfs.Commit{middleCommit})
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(downstreamCommit, false))
+
+	require.NoError(t, d.RenameBranch(upstream, "master", "main"))
+
+	// Provenance is renamed in repos that are downstream of the renamed
+	// branch's repo, directly or not
+	for _, commit := range []*pfs.Commit{middleCommit, downstreamCommit} {
+		commitInfo, err := d.InspectCommit(commit)
+		require.NoError(t, err)
+		var found bool
+		for _, p := range commitInfo.Provenance {
+			if p.Repo.Name == upstream.Name {
+				require.Equal(t, "main/0", p.ID)
+				found = true
+			}
+		}
+		require.True(t, found)
+	}
+	// Branches with the same name in other repos aren't affected
+	commitInfo, err := d.InspectCommit(downstreamCommit)
+	require.NoError(t, err)
+	for _, p := range commitInfo.Provenance {
+		if p.Repo.Name == middle.Name {
+			require.Equal(t, middleCommit.ID, p.ID)
+		}
+	}
+}
+
+func TestStartCommitMissingProvenance(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	upstream := &pfs.Repo{Name: uniqueString("TestStartCommitMissingProvenanceUpstream")}
+	require.NoError(t, d.CreateRepo(upstream, nil))
+	downstream := &pfs.Repo{Name: uniqueString("TestStartCommitMissingProvenanceDownstream")}
+	require.NoError(t, d.CreateRepo(downstream, []*pfs.Repo{upstream}))
+
+	upstreamCommit, err := d.StartCommit(&pfs.Commit{Repo: upstream, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(upstreamCommit, false))
+
+	_, err = d.StartCommit(&pfs.Commit{Repo: downstream, ID: "master"}, []*pfs.Commit{
+		upstreamCommit,
+		{Repo: upstream, ID: "master/5"},
+	})
+	require.YesError(t, err)
+	require.True(t, strings.Contains(err.Error(), "master/5"))
+	branches, err := d.ListBranch(downstream, pfs.CommitStatus_ALL)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(branches))
+
+	commit, err := d.StartCommit(&pfs.Commit{Repo: downstream, ID: "master"}, []*pfs.Commit{upstreamCommit})
+	require.NoError(t, err)
+	commitInfo, err := d.InspectCommit(commit)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(commitInfo.Provenance))
+	require.Equal(t, upstreamCommit.ID, commitInfo.Provenance[0].ID)
+}
+
+func TestStartCommitProvenanceIDForms(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	upstream := &pfs.Repo{Name: uniqueString("TestStartCommitProvenanceIDFormsUpstream")}
+	require.NoError(t, d.CreateRepo(upstream, nil))
+	downstream := &pfs.Repo{Name: uniqueString("TestStartCommitProvenanceIDFormsDownstream")}
+	require.NoError(t, d.CreateRepo(downstream, []*pfs.Repo{upstream}))
+
+	for i := 0; i < 3; i++ {
+		commit, err := d.StartCommit(&pfs.Commit{Repo: upstream, ID: "master"}, nil)
+		require.NoError(t, err)
+		require.NoError(t, d.FinishCommit(commit, false))
+	}
+
+	// Readable IDs, branch names and ancestry suffixes can be mixed
+	provenance := []*pfs.Commit{
+		{Repo: upstream, ID: "master/0"},
+		{Repo: upstream, ID: "master"},
+		{Repo: upstream, ID: "master/2^"},
+		{Repo: upstream, ID: "master/0"},
+	}
+	commit, err := d.StartCommit(&pfs.Commit{Repo: downstream, ID: "master"}, provenance)
+	require.NoError(t, err)
+	commitInfo, err := d.InspectCommit(commit)
+	require.NoError(t, err)
+	// Provenance is recorded by the IDs the commits resolved to
+	var provenanceIDs []string
+	for _, c := range commitInfo.Provenance {
+		provenanceIDs = append(provenanceIDs, c.ID)
+	}
+	require.Equal(t, []string{"master/0", "master/2", "master/1"}, provenanceIDs)
+
+	// Every missing commit is reported, whatever the form of its ID
+	_, err = d.StartCommit(&pfs.Commit{Repo: downstream, ID: "master"}, []*pfs.Commit{
+		{Repo: upstream, ID: "master/1"},
+		{Repo: upstream, ID: "master/7"},
+		{Repo: upstream, ID: "nonexistent"},
+		{Repo: upstream, ID: "master~5"},
+	})
+	require.YesError(t, err)
+	require.False(t, strings.Contains(err.Error(), "master/1"))
+	require.True(t, strings.Contains(err.Error(), "master/7"))
+	require.True(t, strings.Contains(err.Error(), "nonexistent"))
+	require.True(t, strings.Contains(err.Error(), "master~5"))
+}
+
+func TestRepoNames(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	for _, test := range []struct {
+		name  string
+		valid bool
+	}{
+		{"foo", true},
+		{"foo_bar", true},
+		{"my-dataset", true},
+		{"images.v2", true},
+		{"-foo", true},
+		{"foo.", true},
+		{strings.Repeat("a", 64), true},
+		{"", false},
+		{".hidden", false},
+		{"foo/bar", false},
+		{"foo bar", false},
+		{"foo\tbar", false},
+		{"foo:bar", false},
+		{"foo||@&#$TYX", false},
+		{strings.Repeat("a", 65), false},
+	} {
+		err := d.CreateRepo(&pfs.Repo{Name: test.name}, nil)
+		if test.valid {
+			require.NoError(t, err, "repo name: %q", test.name)
+		} else {
+			require.YesError(t, err, "repo name: %q", test.name)
+		}
+	}
+}
+
+func TestCommitSizeMaintained(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestCommitSizeMaintained")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "a"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "a"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "dir/b"}, pfs.Delimiter_LINE, strings.NewReader("buzz\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "dir/c"}, pfs.Delimiter_LINE, strings.NewReader("c\n")))
+
+	commitInfo, err := d.InspectCommit(commit1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(15), commitInfo.SizeBytes)
+
+	// Deleting a file written in this commit removes its size
+	require.NoError(t, d.DeleteFile(&pfs.File{Commit: commit1, Path: "dir/b"}))
+	commitInfo, err = d.InspectCommit(commit1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), commitInfo.SizeBytes)
+	size, err := d.ReconcileCommitSize(commit1)
+	require.NoError(t, err)
+	require.Equal(t, commitInfo.SizeBytes, size)
+
+	require.NoError(t, d.FinishCommit(commit1, false))
+	commitInfo, err = d.InspectCommit(commit1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), commitInfo.SizeBytes)
+
+	// Deleting a file written in a previous commit doesn't change the size
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.DeleteFile(&pfs.File{Commit: commit2, Path: "a"}))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "d"}, pfs.Delimiter_LINE, strings.NewReader("dd\n")))
+	require.NoError(t, d.FinishCommit(commit2, false))
+	commitInfo, err = d.InspectCommit(commit2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), commitInfo.SizeBytes)
+	size, err = d.ReconcileCommitSize(commit2)
+	require.NoError(t, err)
+	require.Equal(t, commitInfo.SizeBytes, size)
+}
+
+func TestSquash(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestSquash")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "a"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "b"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "a"}, pfs.Delimiter_LINE, strings.NewReader("foo2\n")))
+	require.NoError(t, d.DeleteFile(&pfs.File{Commit: commit2, Path: "b"}))
+	require.NoError(t, d.FinishCommit(commit2, false))
+
+	commit3, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit3, Path: "dir/c"}, pfs.Delimiter_LINE, strings.NewReader("buzz\n")))
+	require.NoError(t, d.FinishCommit(commit3, false))
+
+	squashed, err := d.Squash(repo, commit1.ID, commit3.ID, "squashed")
+	require.NoError(t, err)
+	commitInfo, err := d.InspectCommit(squashed)
+	require.NoError(t, err)
+	require.NotNil(t, commitInfo.Finished)
+	require.Nil(t, commitInfo.ParentCommit)
+	require.Equal(t, uint64(14), commitInfo.SizeBytes)
+
+	require.Equal(t, "foo\nfoo2\n", getFile(t, d, &pfs.File{Commit: squashed, Path: "a"}, 0, 0))
+	require.Equal(t, "buzz\n", getFile(t, d, &pfs.File{Commit: squashed, Path: "dir/c"}, 0, 0))
+	_, err = d.InspectFile(&pfs.File{Commit: squashed, Path: "b"}, nil, nil)
+	require.YesError(t, err)
+	diffs, err := d.ListCommitDiffs(squashed)
+	require.NoError(t, err)
+	var paths []string
+	for _, diff := range diffs {
+		paths = append(paths, diff.Path)
+	}
+	require.Equal(t, []string{"/a", "/dir", "/dir/c"}, paths)
+
+	// A partial range only includes the commits in the range
+	squashed, err = d.Squash(repo, commit2.ID, commit3.ID, "squashed2")
+	require.NoError(t, err)
+	require.Equal(t, "foo2\n", getFile(t, d, &pfs.File{Commit: squashed, Path: "a"}, 0, 0))
+
+	_, err = d.Squash(repo, commit3.ID, commit1.ID, "squashed3")
+	require.YesError(t, err)
+}
+
+func TestMakeEmptyDirectory(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestMakeEmptyDirectory")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.MakeDirectory(&pfs.File{Commit: commit, Path: "a/b/c"}))
+	// Making a directory twice is fine
+	require.NoError(t, d.MakeDirectory(&pfs.File{Commit: commit, Path: "a/b"}))
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	listPaths := func(path string) []string {
+		fileInfos, err := d.ListFile(&pfs.File{Commit: commit, Path: path}, nil, nil, drive.ListFileNORMAL, 0, 0)
+		require.NoError(t, err)
+		var paths []string
+		for _, fileInfo := range fileInfos {
+			require.Equal(t, pfs.FileType_FILE_TYPE_DIR, fileInfo.FileType)
+			paths = append(paths, fileInfo.File.Path)
+		}
+		return paths
+	}
+	require.Equal(t, []string{"/a"}, listPaths("/"))
+	require.Equal(t, []string{"/a/b"}, listPaths("a"))
+	require.Equal(t, []string{"/a/b/c"}, listPaths("a/b"))
+	require.Equal(t, 0, len(listPaths("a/b/c")))
+}
+
+func TestPutFileOverwrite(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestPutFileOverwrite")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	file1 := &pfs.File{Commit: commit1, Path: "file"}
+	require.NoError(t, d.PutFile(file1, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.PutFile(file1, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	require.Equal(t, "foo\nbar\n", getFile(t, d, file1, 0, 0))
+	require.NoError(t, d.PutFileOverwrite(file1, pfs.Delimiter_LINE, strings.NewReader("buzz\n")))
+	require.Equal(t, "buzz\n", getFile(t, d, file1, 0, 0))
+	require.NoError(t, d.MakeDirectory(&pfs.File{Commit: commit1, Path: "dir"}))
+	require.YesError(t, d.PutFileOverwrite(&pfs.File{Commit: commit1, Path: "dir"}, pfs.Delimiter_LINE, strings.NewReader("dir\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+	commitInfo, err := d.InspectCommit(commit1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), commitInfo.SizeBytes)
+
+	// Overwriting also replaces the content from previous commits, and
+	// subsequent writes in the same commit are appended to the new content.
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	file2 := &pfs.File{Commit: commit2, Path: "file"}
+	require.NoError(t, d.PutFileOverwrite(file2, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.PutFile(file2, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	require.NoError(t, d.FinishCommit(commit2, false))
+	require.Equal(t, "foo\nbar\n", getFile(t, d, file2, 0, 0))
+	require.Equal(t, "buzz\n", getFile(t, d, file1, 0, 0))
+}
+
+func TestCommitNotFound(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestCommitNotFound")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	for _, id := range []string{
+		"nonexistent", // branch name
+		"master/10",   // branch/clock alias
+		"nonexistent/0",
+	} {
+		missing := &pfs.Commit{Repo: repo, ID: id}
+		_, err := d.InspectCommit(missing)
+		_, ok := err.(*pfsserver.ErrCommitNotFound)
+		require.True(t, ok, "InspectCommit(%s): %v", id, err)
+
+		err = d.FinishCommit(missing, false)
+		_, ok = err.(*pfsserver.ErrCommitNotFound)
+		require.True(t, ok, "FinishCommit(%s): %v", id, err)
+
+		err = d.PutFile(&pfs.File{Commit: missing, Path: "file"}, pfs.Delimiter_LINE, strings.NewReader("foo\n"))
+		_, ok = err.(*pfsserver.ErrCommitNotFound)
+		require.True(t, ok, "PutFile(%s): %v", id, err)
+	}
+
+	_, err = d.StartCommit(&pfs.Commit{Repo: repo, ID: "master/10"}, nil)
+	_, ok := err.(*pfsserver.ErrCommitNotFound)
+	require.True(t, ok)
+}
+
+func TestWatchCommit(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repoA := &pfs.Repo{Name: uniqueString("TestWatchCommitA")}
+	require.NoError(t, d.CreateRepo(repoA, nil))
+	repoB := &pfs.Repo{Name: uniqueString("TestWatchCommitB")}
+	require.NoError(t, d.CreateRepo(repoB, nil))
+
+	// A commit that exists before the watch starts
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repoA, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit1, false))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	commitInfoCh, errCh := d.WatchCommit(ctx, []*pfs.Commit{{Repo: repoA}, {Repo: repoB}}, nil, nil, pfs.CommitType_COMMIT_TYPE_READ, pfs.CommitStatus_NORMAL)
+
+	commitInfo := <-commitInfoCh
+	require.Equal(t, commit1.ID, commitInfo.Commit.ID)
+
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repoB, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "file"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit2, false))
+	commitInfo = <-commitInfoCh
+	require.Equal(t, repoB.Name, commitInfo.Commit.Repo.Name)
+	require.Equal(t, commit2.ID, commitInfo.Commit.ID)
+
+	commit3, err := d.StartCommit(&pfs.Commit{Repo: repoA, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit3, false))
+	commitInfo = <-commitInfoCh
+	require.Equal(t, repoA.Name, commitInfo.Commit.Repo.Name)
+	require.Equal(t, commit3.ID, commitInfo.Commit.ID)
+
+	cancel()
+	for range commitInfoCh {
+	}
+	require.NoError(t, <-errCh)
+}
+
+func TestWatchCommitByProvenance(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repoA := &pfs.Repo{Name: uniqueString("TestWatchCommitByProvenanceA")}
+	require.NoError(t, d.CreateRepo(repoA, nil))
+	repoB := &pfs.Repo{Name: uniqueString("TestWatchCommitByProvenanceB")}
+	require.NoError(t, d.CreateRepo(repoB, []*pfs.Repo{repoA}))
+
+	a1, err := d.StartCommit(&pfs.Commit{Repo: repoA, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(a1, false))
+	a2, err := d.StartCommit(&pfs.Commit{Repo: repoA, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(a2, false))
+
+	// A commit that the caller has already seen
+	b1, err := d.StartCommit(&pfs.Commit{Repo: repoB, ID: "master"}, []*pfs.Commit{a1})
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(b1, false))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	commitInfoCh, errCh := d.WatchCommitByProvenance(ctx, repoB, []*pfs.Commit{a1}, b1)
+
+	// Neither a commit with other provenance nor an unfinished commit is sent
+	b2, err := d.StartCommit(&pfs.Commit{Repo: repoB, ID: "master"}, []*pfs.Commit{a2})
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(b2, false))
+	b3, err := d.StartCommit(&pfs.Commit{Repo: repoB, ID: "master"}, []*pfs.Commit{a1})
+	require.NoError(t, err)
+	select {
+	case commitInfo := <-commitInfoCh:
+		t.Fatalf("unexpected commit %s", commitInfo.Commit.ID)
+	case <-time.After(time.Second):
+	}
+
+	require.NoError(t, d.FinishCommit(b3, false))
+	commitInfo := <-commitInfoCh
+	require.Equal(t, b3.ID, commitInfo.Commit.ID)
+
+	cancel()
+	for range commitInfoCh {
+	}
+	require.NoError(t, <-errCh)
+
+	_, errCh = d.WatchCommitByProvenance(context.Background(), repoB, []*pfs.Commit{a1}, a1)
+	require.YesError(t, <-errCh)
+}
+
+func TestMissingIndex(t *testing.T) {
+	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
+	require.NoError(t, persist.InitDB(RethinkAddress, dbName, "", 0, 0))
+	dbClient, err := persist.DbConnect(RethinkAddress)
+	require.NoError(t, err)
+	_, err = gorethink.DB(dbName).Table("Commits").IndexDrop(persist.CommitBranchIndex.Name).RunWrite(dbClient)
+	require.NoError(t, err)
+
+	_, err = persist.NewDriver(getBlockAddress(t), RethinkAddress, dbName, nil)
+	require.YesError(t, err)
+	require.True(t, strings.Contains(err.Error(), persist.CommitBranchIndex.Name))
+}
+
+func TestSchemaVersion(t *testing.T) {
+	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
+	require.NoError(t, persist.InitDB(RethinkAddress, dbName, "", 0, 0))
+	dbClient, err := persist.DbConnect(RethinkAddress)
+	require.NoError(t, err)
+	newDriver := func() error {
+		_, err := persist.NewDriver(getBlockAddress(t), RethinkAddress, dbName, nil)
+		return err
+	}
+	require.NoError(t, newDriver())
+
+	// A database written by a newer version
+	_, err = gorethink.DB(dbName).Table("Meta").Get("SchemaVersion").Update(map[string]interface{}{
+		"Version": persist.SchemaVersion + 1,
+	}).RunWrite(dbClient)
+	require.NoError(t, err)
+	require.YesError(t, newDriver())
+	// EnsureDB doesn't overwrite the version
+	require.NoError(t, persist.EnsureDB(RethinkAddress, dbName, "", 0, 0))
+	require.YesError(t, newDriver())
+
+	// A database written before versioning
+	_, err = gorethink.DB(dbName).Table("Meta").Get("SchemaVersion").Delete().RunWrite(dbClient)
+	require.NoError(t, err)
+	require.YesError(t, newDriver())
+	require.NoError(t, persist.EnsureDB(RethinkAddress, dbName, "", 0, 0))
+	require.NoError(t, newDriver())
+}
+
+func TestEnsureDB(t *testing.T) {
+	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
+	require.NoError(t, persist.EnsureDB(RethinkAddress, dbName, "", 0, 0))
+	require.NoError(t, persist.EnsureDB(RethinkAddress, dbName, "", 0, 0))
+
+	// Simulate an interrupted initialization
+	dbClient, err := persist.DbConnect(RethinkAddress)
+	require.NoError(t, err)
+	_, err = gorethink.DB(dbName).TableDrop("Diffs").RunWrite(dbClient)
+	require.NoError(t, err)
+	_, err = gorethink.DB(dbName).Table("Commits").IndexDrop(persist.CommitBranchIndex.Name).RunWrite(dbClient)
+	require.NoError(t, err)
+	require.NoError(t, persist.EnsureDB(RethinkAddress, dbName, "", 0, 0))
+
+	d, err := persist.NewDriver(getBlockAddress(t), RethinkAddress, dbName, nil)
+	require.NoError(t, err)
+	repo := &pfs.Repo{Name: "repo"}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "file"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit, false))
+	require.Equal(t, "foo\n", getFile(t, d, &pfs.File{Commit: commit, Path: "file"}, 0, 0))
+
+	require.NoError(t, persist.RemoveDBIfExists(RethinkAddress, dbName, "", 0, 0))
+	require.NoError(t, persist.RemoveDBIfExists(RethinkAddress, dbName, "", 0, 0))
+	require.YesError(t, persist.RemoveDB(RethinkAddress, dbName, "", 0, 0))
+	require.NoError(t, persist.RemoveDBIfExists(RethinkAddress, "pachyderm_test_"+uuid.NewWithoutDashes()[0:12], "", 0, 0))
+}
+
+func TestTablePrefix(t *testing.T) {
+	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
+	var drivers []drive.Driver
+	for _, prefix := range []string{"tenantA", "tenantB"} {
+		require.NoError(t, persist.InitDB(RethinkAddress, dbName, prefix, 0, 0))
+		d, err := persist.NewDriver(getBlockAddress(t), RethinkAddress, dbName, &persist.DriverOptions{TablePrefix: prefix})
+		require.NoError(t, err)
+		drivers = append(drivers, d)
+	}
+	_, err := persist.NewDriver(getBlockAddress(t), RethinkAddress, dbName, &persist.DriverOptions{TablePrefix: "tenant-C"})
+	require.YesError(t, err)
+
+	// Both instances can use the same repo name without colliding
+	for i, d := range drivers {
+		repo := &pfs.Repo{Name: "repo"}
+		require.NoError(t, d.CreateRepo(repo, nil))
+		commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+		require.NoError(t, err)
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "file"}, pfs.Delimiter_LINE, strings.NewReader(fmt.Sprintf("%d\n", i))))
+		require.NoError(t, d.FinishCommit(commit, false))
+	}
+	for i, d := range drivers {
+		repoInfos, err := d.ListRepo(nil)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(repoInfos))
+		commitInfos, err := d.ListCommit([]*pfs.Commit{{Repo: &pfs.Repo{Name: "repo"}}}, nil, nil, pfs.CommitType_COMMIT_TYPE_NONE, pfs.CommitStatus_ALL, false, nil, nil, false)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(commitInfos))
+		require.Equal(t, fmt.Sprintf("%d\n", i), getFile(t, d, &pfs.File{Commit: commitInfos[0].Commit, Path: "file"}, 0, 0))
+	}
+
+	// Removing one instance leaves the other intact
+	require.NoError(t, persist.RemoveDB(RethinkAddress, dbName, "tenantA", 0, 0))
+	repoInfos, err := drivers[1].ListRepo(nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(repoInfos))
+}
+
+func TestFinishCommitTimeout(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestFinishCommitTimeout")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	parent, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	child, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+
+	// The parent is never finished, so we give up waiting for it
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	require.YesError(t, d.FinishCommitContext(ctx, child, false))
+	commitInfo, err := d.InspectCommit(child)
+	require.NoError(t, err)
+	require.Nil(t, commitInfo.Finished)
+
+	// Once the parent is finished, the child can be finished
+	require.NoError(t, d.FinishCommit(parent, false))
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, d.FinishCommitContext(ctx, child, false))
+}
+
+func TestFinishCommitCompacted(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestFinishCommitCompacted")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	file := &pfs.File{Commit: commit, Path: "file"}
+	var expected string
+	for i := 0; i < 10; i++ {
+		line := fmt.Sprintf("line %d\n", i)
+		require.NoError(t, d.PutFile(file, pfs.Delimiter_LINE, strings.NewReader(line)))
+		expected += line
+	}
+	// Files written once aren't changed
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "other"}, pfs.Delimiter_LINE, strings.NewReader("other\n")))
+	blockRefs, err := d.GetFileBlockRefs(file, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 10, len(blockRefs))
+	require.NoError(t, d.FinishCommitCompacted(commit, false))
+
+	blockRefs, err = d.GetFileBlockRefs(file, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(blockRefs))
+	require.Equal(t, expected, getFile(t, d, file, 0, 0))
+	require.Equal(t, "other\n", getFile(t, d, &pfs.File{Commit: commit, Path: "other"}, 0, 0))
+	fileInfo, err := d.InspectFile(file, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(expected)), fileInfo.SizeBytes)
+	commitInfo, err := d.InspectCommit(commit)
+	require.NoError(t, err)
+	require.NotNil(t, commitInfo.Finished)
+
+	// A finished commit can't be compacted
+	require.YesError(t, d.FinishCommitCompacted(commit, false))
+}
+
+func TestFinishCommitNoWait(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestFinishCommitNoWait")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	parent, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	child, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+
+	// The parent is unfinished, but the child is finished anyway
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- d.FinishCommitNoWait(child, false)
+	}()
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("FinishCommitNoWait waited for the parent")
+	}
+	commitInfo, err := d.InspectCommit(child)
+	require.NoError(t, err)
+	require.NotNil(t, commitInfo.Finished)
+
+	// The child doesn't inherit the parent's cancellation
+	require.NoError(t, d.FinishCommit(parent, true))
+	commitInfo, err = d.InspectCommit(child)
+	require.NoError(t, err)
+	require.False(t, commitInfo.Cancelled)
+}
+
+func TestInspectRepoWithBranchSizes(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestInspectRepoWithBranchSizes")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "bar"}, pfs.Delimiter_LINE, strings.NewReader("barbar\n")))
+	require.NoError(t, d.FinishCommit(commit2, false))
+
+	commit3, err := d.ForkCommit(commit1, "other", nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit3, Path: "buzz"}, pfs.Delimiter_LINE, strings.NewReader("buzzbuzz\n")))
+
+	repoInfo, err := d.InspectRepoWithBranchSizes(repo)
+	require.NoError(t, err)
+	require.Equal(t, repo.Name, repoInfo.Repo.Name)
+	require.Equal(t, uint64(11), repoInfo.SizeBytes)
+	require.Equal(t, map[string]uint64{
+		"master": 7,
+		"other":  9,
+	}, repoInfo.BranchSizes)
+	require.Equal(t, uint64(3), repoInfo.NumCommits)
+}
+
+func TestListRepoWithNumCommits(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repoA := &pfs.Repo{Name: "a"}
+	require.NoError(t, d.CreateRepo(repoA, nil))
+	repoB := &pfs.Repo{Name: "b"}
+	require.NoError(t, d.CreateRepo(repoB, nil))
+	// A repo whose name is a prefix of another's
+	repoAB := &pfs.Repo{Name: "ab"}
+	require.NoError(t, d.CreateRepo(repoAB, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repoA, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit1, false))
+	// Open commits and commits on other branches count too
+	_, err = d.StartCommit(&pfs.Commit{Repo: repoA, ID: "master"}, nil)
+	require.NoError(t, err)
+	_, err = d.ForkCommit(commit1, "other", nil)
+	require.NoError(t, err)
+	commit4, err := d.StartCommit(&pfs.Commit{Repo: repoAB, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit4, false))
+
+	repoInfos, err := d.ListRepoWithNumCommits(nil)
+	require.NoError(t, err)
+	numCommits := make(map[string]uint64)
+	for _, repoInfo := range repoInfos {
+		numCommits[repoInfo.Repo.Name] = repoInfo.NumCommits
+	}
+	require.Equal(t, map[string]uint64{"a": 3, "ab": 1, "b": 0}, numCommits)
+}
+
+func TestRecreateRepo(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestRecreateRepo")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit, false))
+	require.NoError(t, d.DeleteRepo(repo, false))
+
+	// The recreated repo's commits have the same IDs as the deleted ones, but
+	// the file types of the deleted repo don't carry over
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err = d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "foo/bar"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	require.NoError(t, d.FinishCommit(commit, false))
+	require.Equal(t, "bar\n", getFile(t, d, &pfs.File{Commit: commit, Path: "foo/bar"}, 0, 0))
+}
+
+func TestDeleteRepoPreview(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestDeleteRepoPreview")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	downstream := &pfs.Repo{Name: uniqueString("TestDeleteRepoPreviewDownstream")}
+	require.NoError(t, d.CreateRepo(downstream, []*pfs.Repo{repo}))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "dir/foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+	commit2, err := d.ForkCommit(commit1, "fork", nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "bar"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	require.NoError(t, d.FinishCommit(commit2, false))
+
+	deletion, err := d.DeleteRepoPreview(repo)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), deletion.NumCommits)
+	require.Equal(t, uint64(3), deletion.NumDiffs)
+	require.Equal(t, uint64(2), deletion.NumBranches)
+	require.Equal(t, []string{downstream.Name}, deletion.DependentRepos)
+
+	// Nothing is deleted
+	_, err = d.InspectRepo(repo)
+	require.NoError(t, err)
+	_, err = d.InspectCommit(commit2)
+	require.NoError(t, err)
+	require.YesError(t, d.DeleteRepo(repo, false))
+
+	_, err = d.DeleteRepoPreview(&pfs.Repo{Name: uniqueString("TestDeleteRepoPreviewMissing")})
+	require.YesError(t, err)
+}
+
+func TestRepoTags(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	team := uniqueString("team")
+	repo1 := &pfs.Repo{Name: uniqueString("TestRepoTags1")}
+	require.NoError(t, d.CreateRepoWithTags(repo1, nil, map[string]string{"team": team, "retention": "30d"}))
+	repo2 := &pfs.Repo{Name: uniqueString("TestRepoTags2")}
+	require.NoError(t, d.CreateRepoWithTags(repo2, nil, map[string]string{"team": team}))
+	repo3 := &pfs.Repo{Name: uniqueString("TestRepoTags3")}
+	require.NoError(t, d.CreateRepo(repo3, nil))
+
+	repoInfo, err := d.InspectRepoWithTags(repo1)
+	require.NoError(t, err)
+	require.Equal(t, repo1.Name, repoInfo.Repo.Name)
+	require.Equal(t, map[string]string{"team": team, "retention": "30d"}, repoInfo.Tags)
+	repoInfo, err = d.InspectRepoWithTags(repo3)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(repoInfo.Tags))
+
+	listRepo := func(tags map[string]string) []string {
+		repoInfos, err := d.ListRepoWithTags(nil, tags)
+		require.NoError(t, err)
+		var repoNames []string
+		for _, repoInfo := range repoInfos {
+			repoNames = append(repoNames, repoInfo.Repo.Name)
+		}
+		return repoNames
+	}
+	require.Equal(t, []string{repo1.Name, repo2.Name}, listRepo(map[string]string{"team": team}))
+	require.Equal(t, []string{repo1.Name}, listRepo(map[string]string{"team": team, "retention": "30d"}))
+
+	// Updating replaces the tags
+	require.NoError(t, d.UpdateRepo(repo1, map[string]string{"team": team}))
+	repoInfo, err = d.InspectRepoWithTags(repo1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"team": team}, repoInfo.Tags)
+	require.Equal(t, 0, len(listRepo(map[string]string{"team": team, "retention": "30d"})))
+	require.NoError(t, d.UpdateRepo(repo3, map[string]string{"team": team}))
+	require.Equal(t, []string{repo1.Name, repo2.Name, repo3.Name}, listRepo(map[string]string{"team": team}))
+
+	require.YesError(t, d.UpdateRepo(&pfs.Repo{Name: uniqueString("TestRepoTagsMissing")}, nil))
+}
+
+func TestGetFileType(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestGetFileType")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "dir/foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.DeleteFile(&pfs.File{Commit: commit2, Path: "dir/foo"}))
+	require.NoError(t, d.FinishCommit(commit2, false))
+
+	fileType, err := d.GetFileType(&pfs.File{Commit: commit1, Path: "dir"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, pfs.FileType_FILE_TYPE_DIR, fileType)
+	fileType, err = d.GetFileType(&pfs.File{Commit: commit1, Path: "dir/foo"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, pfs.FileType_FILE_TYPE_REGULAR, fileType)
+
+	// Deleted and missing files aren't found
+	_, err = d.GetFileType(&pfs.File{Commit: commit2, Path: "dir/foo"}, nil, nil)
+	require.YesError(t, err)
+	_, ok := err.(*pfsserver.ErrFileNotFound)
+	require.True(t, ok)
+	_, err = d.GetFileType(&pfs.File{Commit: commit1, Path: "bar"}, nil, nil)
+	require.YesError(t, err)
+}
+
+func TestInspectFileWithNumChildren(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestInspectFileWithNumChildren")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: fmt.Sprintf("dir/file%d", i)}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	}
+	require.NoError(t, d.MakeDirectory(&pfs.File{Commit: commit1, Path: "dir/subdir"}))
+	require.NoError(t, d.FinishCommit(commit1, false))
+
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.DeleteFile(&pfs.File{Commit: commit2, Path: "dir/file0"}))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "dir/file1"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	require.NoError(t, d.FinishCommit(commit2, false))
+
+	for _, test := range []struct {
+		commit      *pfs.Commit
+		numChildren uint64
+	}{
+		{commit1, 11},
+		{commit2, 10},
+	} {
+		dir := &pfs.File{Commit: test.commit, Path: "dir"}
+		fileInfo, err := d.InspectFileWithNumChildren(dir, nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, pfs.FileType_FILE_TYPE_DIR, fileInfo.FileType)
+		require.Equal(t, test.numChildren, fileInfo.NumChildren)
+		require.Equal(t, 0, len(fileInfo.Children))
+
+		// The count matches the children listed by InspectFile
+		fullFileInfo, err := d.InspectFile(dir, nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, int(test.numChildren), len(fullFileInfo.Children))
+	}
+
+	fileInfo, err := d.InspectFileWithNumChildren(&pfs.File{Commit: commit2, Path: "dir/file1"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), fileInfo.NumChildren)
+}
+
+func TestInspectFileWithRecursiveSize(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestInspectFileWithRecursiveSize")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "dir/a"}, pfs.Delimiter_LINE, strings.NewReader("aa\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "dir/sub/b"}, pfs.Delimiter_LINE, strings.NewReader("bbbb\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "dir/sub/subsub/c"}, pfs.Delimiter_LINE, strings.NewReader("c\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "other"}, pfs.Delimiter_LINE, strings.NewReader("other\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.DeleteFile(&pfs.File{Commit: commit2, Path: "dir/a"}))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "dir/sub/b"}, pfs.Delimiter_LINE, strings.NewReader("b\n")))
+	require.NoError(t, d.FinishCommit(commit2, false))
+
+	for _, test := range []struct {
+		file *pfs.File
+		size uint64
+	}{
+		{&pfs.File{Commit: commit1, Path: "dir"}, 10},
+		{&pfs.File{Commit: commit1, Path: "dir/sub"}, 7},
+		{&pfs.File{Commit: commit2, Path: "dir"}, 9},
+		{&pfs.File{Commit: commit2, Path: "dir/sub/b"}, 7},
+	} {
+		fileInfo, err := d.InspectFileWithRecursiveSize(test.file, nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, test.size, fileInfo.SizeBytes)
+	}
+
+	// The cheap path doesn't size directories
+	fileInfo, err := d.InspectFile(&pfs.File{Commit: commit1, Path: "dir"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), fileInfo.SizeBytes)
+}
+
+func TestDiffFile(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestDiffFile")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "modified"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "unchanged"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "deleted"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "modified"}, pfs.Delimiter_LINE, strings.NewReader("barbar\n")))
+	require.NoError(t, d.DeleteFile(&pfs.File{Commit: commit2, Path: "deleted"}))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "added"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit2, false))
+
+	for _, test := range []struct {
+		path      string
+		typ       drive.FileChangeType
+		sizeDelta int64
+		added     int
+		removed   int
+	}{
+		{"modified", drive.FileModified, 7, 1, 0},
+		{"unchanged", drive.FileUnchanged, 0, 0, 0},
+		{"deleted", drive.FileDeleted, -4, 0, 1},
+		{"added", drive.FileAdded, 4, 1, 0},
+		{"nonexistent", drive.FileUnchanged, 0, 0, 0},
+	} {
+		change, err := d.DiffFile(&pfs.File{Path: test.path}, commit1, commit2)
+		require.NoError(t, err)
+		require.Equal(t, test.typ, change.Type, "path: %s", test.path)
+		require.Equal(t, test.sizeDelta, change.SizeDelta, "path: %s", test.path)
+		require.Equal(t, test.added, len(change.BlockRefsAdded), "path: %s", test.path)
+		require.Equal(t, test.removed, len(change.BlockRefsRemoved), "path: %s", test.path)
+	}
+
+	// Comparing in the other direction reverses the change
+	change, err := d.DiffFile(&pfs.File{Path: "modified"}, commit2, commit1)
+	require.NoError(t, err)
+	require.Equal(t, drive.FileModified, change.Type)
+	require.Equal(t, int64(-7), change.SizeDelta)
+	require.Equal(t, 0, len(change.BlockRefsAdded))
+	require.Equal(t, 1, len(change.BlockRefsRemoved))
+}
+
+func TestInvalidCommitID(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestInvalidCommitID")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	for id, reason := range map[string]string{
+		"master/x":   "not a non-negative integer",
+		"master/-1":  "not a non-negative integer",
+		"a/b/0":      "found 3",
+		"master~x":   "not a non-negative integer",
+		"master^2":   "use ~ instead",
+		"~1":         "missing the commit",
+		"master/x~1": "not a non-negative integer",
+	} {
+		_, err := d.InspectCommit(&pfs.Commit{Repo: repo, ID: id})
+		require.YesError(t, err, id)
+		_, ok := err.(*pfsserver.ErrInvalidCommitID)
+		require.True(t, ok, id)
+		require.True(t, strings.Contains(err.Error(), id), err.Error())
+		require.True(t, strings.Contains(err.Error(), reason), err.Error())
+		require.False(t, strings.Contains(err.Error(), "MISSING"), err.Error())
+	}
+}
+
+func TestInvalidShard(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestInvalidShard")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	file := &pfs.File{Commit: commit, Path: "file"}
+	require.NoError(t, d.PutFile(file, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit, false))
+
+	for _, shard := range []*pfs.Shard{
+		{FileNumber: 2, FileModulus: 2},
+		{BlockNumber: 3, BlockModulus: 1},
+	} {
+		_, err := d.InspectFile(file, shard, nil)
+		require.YesError(t, err)
+		_, ok := err.(*pfsserver.ErrInvalidShard)
+		require.True(t, ok, err.Error())
+		_, err = d.GetFile(file, shard, 0, 0, nil, false)
+		require.YesError(t, err)
+		_, err = d.ListFile(&pfs.File{Commit: commit, Path: "/"}, shard, nil, drive.ListFileNORMAL, 0, 0)
+		require.YesError(t, err)
+	}
+
+	// Shards within bounds are fine, even if the file is in another shard
+	_, err = d.InspectFile(file, &pfs.Shard{FileNumber: 1, FileModulus: 2, BlockNumber: 0, BlockModulus: 1}, nil)
+	if err != nil {
+		_, ok := err.(*pfsserver.ErrInvalidShard)
+		require.False(t, ok, err.Error())
+	}
+}
+
+func TestCommitAncestrySyntax(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestCommitAncestrySyntax")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	var commits []*pfs.Commit
+	for i := 0; i < 4; i++ {
+		commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+		require.NoError(t, err)
+		require.NoError(t, d.FinishCommit(commit, false))
+		commits = append(commits, commit)
+	}
+
+	for id, expected := range map[string]*pfs.Commit{
+		"master":     commits[3],
+		"master/2":   commits[2],
+		"master^":    commits[2],
+		"master~":    commits[2],
+		"master^^":   commits[1],
+		"master~2":   commits[1],
+		"master~0":   commits[3],
+		"master~2^":  commits[0],
+		"master/3~1": commits[2],
+		"master/2^":  commits[1],
+		"master~1~2": commits[0],
+	} {
+		commitInfo, err := d.InspectCommit(&pfs.Commit{Repo: repo, ID: id})
+		require.NoError(t, err, id)
+		require.Equal(t, expected.ID, commitInfo.Commit.ID, id)
+	}
+
+	// Walking past the first commit
+	_, err := d.InspectCommit(&pfs.Commit{Repo: repo, ID: "master~4"})
+	require.YesError(t, err)
+	_, ok := err.(*pfsserver.ErrCommitNotFound)
+	require.True(t, ok)
+
+	for _, id := range []string{"^", "~2", "master^2", "master~x", "master~-1", "master/x~1"} {
+		_, err := d.InspectCommit(&pfs.Commit{Repo: repo, ID: id})
+		require.YesError(t, err, id)
+	}
+
+	// Ancestry suffixes can't be used to create branches
+	_, err = d.StartCommit(&pfs.Commit{Repo: repo, ID: "master~10"}, nil)
+	require.YesError(t, err)
+	// and only branch heads can be deleted
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.YesError(t, d.DeleteCommit(&pfs.Commit{Repo: repo, ID: "master^"}))
+	require.NoError(t, d.DeleteCommit(commit))
+}
+
+func TestInspectCommitWithHead(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestInspectCommitWithHead")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit1, false))
+	fork, err := d.ForkCommit(commit1, "fork", nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(fork, false))
+
+	commitInfo, err := d.InspectCommitWithHead(commit1)
+	require.NoError(t, err)
+	require.True(t, commitInfo.IsHead)
+
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	commitInfo, err = d.InspectCommitWithHead(commit1)
+	require.NoError(t, err)
+	require.Equal(t, commit1.ID, commitInfo.Commit.ID)
+	require.False(t, commitInfo.IsHead)
+	// Open commits count as heads
+	commitInfo, err = d.InspectCommitWithHead(commit2)
+	require.NoError(t, err)
+	require.True(t, commitInfo.IsHead)
+	commitInfo, err = d.InspectCommitWithHead(&pfs.Commit{Repo: repo, ID: "master"})
+	require.NoError(t, err)
+	require.Equal(t, commit2.ID, commitInfo.Commit.ID)
+	require.True(t, commitInfo.IsHead)
+	commitInfo, err = d.InspectCommitWithHead(fork)
+	require.NoError(t, err)
+	require.True(t, commitInfo.IsHead)
+}
+
+func TestInspectCommitWithNumDiffs(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestInspectCommitWithNumDiffs")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "dir/foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "dir/bar"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit2, false))
+
+	// The directory counts as a diff
+	commitInfo, err := d.InspectCommitWithNumDiffs(commit1)
+	require.NoError(t, err)
+	require.Equal(t, commit1.ID, commitInfo.Commit.ID)
+	require.Equal(t, uint64(3), commitInfo.NumDiffs)
+	// Diffs of the parent aren't counted
+	commitInfo, err = d.InspectCommitWithNumDiffs(commit2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), commitInfo.NumDiffs)
+}
+
+func TestCommitMetadata(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestCommitMetadata")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommitWithMetadata(&pfs.Commit{Repo: repo, ID: "master"}, nil, "started", map[string]string{
+		"job": "1",
+		"sha": "abc",
+	})
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommitWithMetadata(commit1, false, "finished", map[string]string{
+		"sha":    "def",
+		"status": "ok",
+	}))
+	commitInfo, err := d.InspectCommitWithMetadata(commit1)
+	require.NoError(t, err)
+	require.Equal(t, commit1.ID, commitInfo.Commit.ID)
+	require.NotNil(t, commitInfo.Finished)
+	require.Equal(t, "finished", commitInfo.Description)
+	require.Equal(t, map[string]string{"job": "1", "sha": "def", "status": "ok"}, commitInfo.Metadata)
+
+	// Both are optional
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit2, false))
+	commitInfo, err = d.InspectCommitWithMetadata(commit2)
+	require.NoError(t, err)
+	require.Equal(t, "", commitInfo.Description)
+	require.Equal(t, 0, len(commitInfo.Metadata))
+
+	// Renaming the branch keeps them
+	require.NoError(t, d.RenameBranch(repo, "master", "renamed"))
+	commitInfo, err = d.InspectCommitWithMetadata(&pfs.Commit{Repo: repo, ID: "renamed/0"})
+	require.NoError(t, err)
+	require.Equal(t, "finished", commitInfo.Description)
+	require.Equal(t, "1", commitInfo.Metadata["job"])
+}
+
+func TestInspectAncestorCommit(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestInspectAncestorCommit")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	var masterCommits []*pfs.Commit
+	for i := 0; i < 3; i++ {
+		commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+		require.NoError(t, err)
+		require.NoError(t, d.FinishCommit(commit, false))
+		masterCommits = append(masterCommits, commit)
+	}
+	fooCommit1, err := d.ForkCommit(masterCommits[1], "foo", nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(fooCommit1, false))
+	fooCommit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "foo"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(fooCommit2, false))
+
+	commitInfo, err := d.InspectAncestorCommit(masterCommits[2], 0)
+	require.NoError(t, err)
+	require.Equal(t, masterCommits[2].ID, commitInfo.Commit.ID)
+	commitInfo, err = d.InspectAncestorCommit(&pfs.Commit{Repo: repo, ID: "master"}, 2)
+	require.NoError(t, err)
+	require.Equal(t, masterCommits[0].ID, commitInfo.Commit.ID)
+
+	// Walk back from foo onto master
+	commitInfo, err = d.InspectAncestorCommit(fooCommit2, 1)
+	require.NoError(t, err)
+	require.Equal(t, fooCommit1.ID, commitInfo.Commit.ID)
+	commitInfo, err = d.InspectAncestorCommit(fooCommit2, 2)
+	require.NoError(t, err)
+	require.Equal(t, masterCommits[1].ID, commitInfo.Commit.ID)
+	commitInfo, err = d.InspectAncestorCommit(fooCommit2, 3)
+	require.NoError(t, err)
+	require.Equal(t, masterCommits[0].ID, commitInfo.Commit.ID)
+
+	_, err = d.InspectAncestorCommit(fooCommit2, 4)
+	require.YesError(t, err)
+	_, ok := err.(*pfsserver.ErrCommitNotFound)
+	require.True(t, ok)
+	_, err = d.InspectAncestorCommit(fooCommit2, -1)
+	require.YesError(t, err)
+}
+
+func TestListBranchHeads(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestListBranchHeads")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit1, false))
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit2, true))
+	commit3, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "open"}, nil)
+	require.NoError(t, err)
+
+	commitInfos, err := d.ListBranchHeads(repo, pfs.CommitStatus_ALL)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(commitInfos))
+
+	require.Equal(t, commit2.ID, commitInfos[0].Commit.ID)
+	require.Equal(t, "master", commitInfos[0].Branch)
+	require.NotNil(t, commitInfos[0].Started)
+	require.NotNil(t, commitInfos[0].Finished)
+	require.True(t, commitInfos[0].Cancelled)
+	require.Equal(t, uint64(4), commitInfos[0].SizeBytes)
+
+	require.Equal(t, commit3.ID, commitInfos[1].Commit.ID)
+	require.Equal(t, "open", commitInfos[1].Branch)
+	require.NotNil(t, commitInfos[1].Started)
+	require.Nil(t, commitInfos[1].Finished)
+	require.False(t, commitInfos[1].Cancelled)
+
+	// The cancelled head of master is skipped
+	commitInfos, err = d.ListBranchHeads(repo, pfs.CommitStatus_NORMAL)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(commitInfos))
+	require.Equal(t, commit3.ID, commitInfos[0].Commit.ID)
+}
+
+func TestListAllBranchHeads(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo1 := &pfs.Repo{Name: uniqueString("TestListAllBranchHeads")}
+	require.NoError(t, d.CreateRepo(repo1, nil))
+	repo2 := &pfs.Repo{Name: uniqueString("TestListAllBranchHeads")}
+	require.NoError(t, d.CreateRepo(repo2, nil))
+	repo3 := &pfs.Repo{Name: uniqueString("TestListAllBranchHeads")}
+	require.NoError(t, d.CreateRepo(repo3, nil))
+
+	var heads []*pfs.Commit
+	for i := 0; i < 3; i++ {
+		commit, err := d.StartCommit(&pfs.Commit{Repo: repo1, ID: "master"}, nil)
+		require.NoError(t, err)
+		require.NoError(t, d.FinishCommit(commit, false))
+		if i == 2 {
+			heads = append(heads, commit)
+		}
+	}
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo1, ID: "dev"}, nil)
+	require.NoError(t, err)
+	heads = append(heads, commit)
+	commit, err = d.StartCommit(&pfs.Commit{Repo: repo2, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit, true))
+
+	repoToHeads, err := d.ListAllBranchHeads(pfs.CommitStatus_ALL)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(repoToHeads[repo1.Name]))
+	// Branches are ordered by name
+	require.Equal(t, heads[1].ID, repoToHeads[repo1.Name][0].Commit.ID)
+	require.Equal(t, heads[0].ID, repoToHeads[repo1.Name][1].Commit.ID)
+	require.Equal(t, 1, len(repoToHeads[repo2.Name]))
+	require.Equal(t, commit.ID, repoToHeads[repo2.Name][0].Commit.ID)
+	_, ok := repoToHeads[repo3.Name]
+	require.False(t, ok)
+
+	// The heads match those that ListBranchHeads returns
+	for _, repo := range []*pfs.Repo{repo1, repo2} {
+		for _, status := range []pfs.CommitStatus{pfs.CommitStatus_ALL, pfs.CommitStatus_NORMAL} {
+			commitInfos, err := d.ListBranchHeads(repo, status)
+			require.NoError(t, err)
+			repoToHeads, err := d.ListAllBranchHeads(status)
+			require.NoError(t, err)
+			require.Equal(t, commitInfos, repoToHeads[repo.Name])
+		}
+	}
+}
+
+func TestListDescendants(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestListDescendants")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	startCommit := func(branch string) *pfs.Commit {
+		commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: branch}, nil)
+		require.NoError(t, err)
+		require.NoError(t, d.FinishCommit(commit, false))
+		return commit
+	}
+	forkCommit := func(parent *pfs.Commit, branch string) *pfs.Commit {
+		commit, err := d.ForkCommit(parent, branch, nil)
+		require.NoError(t, err)
+		require.NoError(t, d.FinishCommit(commit, false))
+		return commit
+	}
+	master0 := startCommit("master")
+	master1 := startCommit("master")
+	master2 := startCommit("master")
+	// Forked off of an ancestor, so it's not a descendant of master1
+	forkCommit(master0, "other")
+	fork0 := forkCommit(master1, "fork")
+	fork1 := startCommit("fork")
+	nested0 := forkCommit(fork0, "nested")
+
+	listDescendants := func(commit *pfs.Commit) []string {
+		commitInfos, err := d.ListDescendants(commit)
+		require.NoError(t, err)
+		var commitIDs []string
+		for _, commitInfo := range commitInfos {
+			commitIDs = append(commitIDs, commitInfo.Commit.ID)
+		}
+		return commitIDs
+	}
+	require.Equal(t, []string{fork0.ID, nested0.ID, fork1.ID, master2.ID}, listDescendants(master1))
+	require.Equal(t, []string{nested0.ID, fork1.ID}, listDescendants(fork0))
+	require.Equal(t, 0, len(listDescendants(master2)))
+
+	_, err := d.ListDescendants(&pfs.Commit{Repo: repo, ID: "master/10"})
+	require.YesError(t, err)
+}
+
+func TestCommitGraph(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestCommitGraph")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	startCommit := func(branch string) *pfs.Commit {
+		commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: branch}, nil)
+		require.NoError(t, err)
+		require.NoError(t, d.FinishCommit(commit, false))
+		return commit
+	}
+	master0 := startCommit("master")
+	master1 := startCommit("master")
+	fork0, err := d.ForkCommit(master0, "fork", nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(fork0, false))
+	fork1 := startCommit("fork")
+
+	graph, err := d.CommitGraph(repo)
+	require.NoError(t, err)
+	var commitIDs []string
+	for _, commitInfo := range graph.Commits {
+		commitIDs = append(commitIDs, commitInfo.Commit.ID)
+	}
+	// Parents come before their children
+	require.Equal(t, []string{master0.ID, fork0.ID, fork1.ID, master1.ID}, commitIDs)
+	require.Equal(t, "fork", graph.Commits[1].Branch)
+
+	edges := make(map[string]*drive.CommitEdge)
+	for _, edge := range graph.Edges {
+		edges[edge.Child] = edge
+	}
+	require.Equal(t, 3, len(edges))
+	require.Equal(t, master0.ID, edges[master1.ID].Parent)
+	require.False(t, edges[master1.ID].Fork)
+	require.Equal(t, master0.ID, edges[fork0.ID].Parent)
+	require.True(t, edges[fork0.ID].Fork)
+	require.Equal(t, fork0.ID, edges[fork1.ID].Parent)
+	require.False(t, edges[fork1.ID].Fork)
+
+	require.Equal(t, map[string]string{"master": master1.ID, "fork": fork1.ID}, graph.Heads)
+
+	_, err = d.CommitGraph(&pfs.Repo{Name: uniqueString("TestCommitGraphMissing")})
+	require.YesError(t, err)
+}
+
+func TestFileHistory(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestFileHistory")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	var commits []*pfs.Commit
+	newCommit := func(write func(commit *pfs.Commit)) {
+		commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+		require.NoError(t, err)
+		write(commit)
+		require.NoError(t, d.FinishCommit(commit, false))
+		commits = append(commits, commit)
+	}
+	newCommit(func(commit *pfs.Commit) {
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	})
+	newCommit(func(commit *pfs.Commit) {
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	})
+	newCommit(func(commit *pfs.Commit) {
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "bar"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+	})
+	newCommit(func(commit *pfs.Commit) {
+		require.NoError(t, d.DeleteFile(&pfs.File{Commit: commit, Path: "foo"}))
+	})
+	newCommit(func(commit *pfs.Commit) {
+		require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("fo\n")))
+	})
+	newCommit(func(commit *pfs.Commit) {
+		require.NoError(t, d.PutFileOverwrite(&pfs.File{Commit: commit, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("f\n")))
+	})
+
+	type state struct {
+		commitID string
+		fileType pfs.FileType
+		size     uint64
+	}
+	history := func(from *pfs.Commit) []state {
+		fileInfos, err := d.FileHistory(&pfs.File{Commit: commits[len(commits)-1], Path: "foo"}, from)
+		require.NoError(t, err)
+		var states []state
+		for _, fileInfo := range fileInfos {
+			require.Equal(t, fileInfo.File.Commit.ID, fileInfo.CommitModified.ID)
+			states = append(states, state{fileInfo.File.Commit.ID, fileInfo.FileType, fileInfo.SizeBytes})
+		}
+		return states
+	}
+	require.Equal(t, []state{
+		{commits[0].ID, pfs.FileType_FILE_TYPE_REGULAR, 4},
+		{commits[1].ID, pfs.FileType_FILE_TYPE_REGULAR, 8},
+		{commits[3].ID, pfs.FileType_FILE_TYPE_NONE, 0},
+		{commits[4].ID, pfs.FileType_FILE_TYPE_REGULAR, 3},
+		{commits[5].ID, pfs.FileType_FILE_TYPE_REGULAR, 2},
+	}, history(nil))
+	// Sizes account for the diffs before from
+	require.Equal(t, []state{
+		{commits[1].ID, pfs.FileType_FILE_TYPE_REGULAR, 8},
+		{commits[3].ID, pfs.FileType_FILE_TYPE_NONE, 0},
+		{commits[4].ID, pfs.FileType_FILE_TYPE_REGULAR, 3},
+		{commits[5].ID, pfs.FileType_FILE_TYPE_REGULAR, 2},
+	}, history(commits[0]))
+	require.Equal(t, []state{
+		{commits[5].ID, pfs.FileType_FILE_TYPE_REGULAR, 2},
+	}, history(commits[4]))
+}
+
+func TestCommitInfoProvenance(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	upstream := &pfs.Repo{Name: uniqueString("TestCommitInfoProvenanceUpstream")}
+	require.NoError(t, d.CreateRepo(upstream, nil))
+	downstream := &pfs.Repo{Name: uniqueString("TestCommitInfoProvenanceDownstream")}
+	require.NoError(t, d.CreateRepo(downstream, []*pfs.Repo{upstream}))
+
+	upstreamCommit, err := d.StartCommit(&pfs.Commit{Repo: upstream, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(upstreamCommit, false))
+	downstreamCommit, err := d.StartCommit(&pfs.Commit{Repo: downstream, ID: "master"}, []*pfs.Commit{upstreamCommit})
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(downstreamCommit, false))
+
+	commitInfo, err := d.InspectCommit(downstreamCommit)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(commitInfo.Provenance))
+	require.Equal(t, upstream.Name, commitInfo.Provenance[0].Repo.Name)
+	require.Equal(t, upstreamCommit.ID, commitInfo.Provenance[0].ID)
+
+	commitInfos, err := d.ListCommit([]*pfs.Commit{{Repo: downstream}}, nil, nil, pfs.CommitType_COMMIT_TYPE_NONE, pfs.CommitStatus_ALL, false, nil, nil, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(commitInfos))
+	require.Equal(t, 1, len(commitInfos[0].Provenance))
+	require.Equal(t, upstream.Name, commitInfos[0].Provenance[0].Repo.Name)
+	require.Equal(t, upstreamCommit.ID, commitInfos[0].Provenance[0].ID)
+
+	// Commits without provenance report none
+	commitInfo, err = d.InspectCommit(upstreamCommit)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(commitInfo.Provenance))
+}
+
+func TestListCommitTransitiveProvenance(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repoA := &pfs.Repo{Name: uniqueString("TestListCommitTransitiveProvenanceA")}
+	require.NoError(t, d.CreateRepo(repoA, nil))
+	repoB := &pfs.Repo{Name: uniqueString("TestListCommitTransitiveProvenanceB")}
+	require.NoError(t, d.CreateRepo(repoB, []*pfs.Repo{repoA}))
+	repoC := &pfs.Repo{Name: uniqueString("TestListCommitTransitiveProvenanceC")}
+	require.NoError(t, d.CreateRepo(repoC, []*pfs.Repo{repoB}))
+
+	commitA, err := d.StartCommit(&pfs.Commit{Repo: repoA, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commitA, false))
+	commitB, err := d.StartCommit(&pfs.Commit{Repo: repoB, ID: "master"}, []*pfs.Commit{commitA})
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commitB, false))
+	commitC, err := d.StartCommit(&pfs.Commit{Repo: repoC, ID: "master"}, []*pfs.Commit{commitB})
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commitC, false))
+
+	// A commit's provenance includes the provenance of its provenance, so
+	// filtering on commitA matches commitC even though commitC was only
+	// given commitB as provenance.
+	commitInfos, err := d.ListCommit([]*pfs.Commit{{Repo: repoC}}, nil, []*pfs.Commit{commitA}, pfs.CommitType_COMMIT_TYPE_NONE, pfs.CommitStatus_ALL, false, nil, nil, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(commitInfos))
+	require.Equal(t, commitC.ID, commitInfos[0].Commit.ID)
+
+	commitInfos, err = d.ListCommit([]*pfs.Commit{{Repo: repoB}, {Repo: repoC}}, nil, []*pfs.Commit{commitA}, pfs.CommitType_COMMIT_TYPE_NONE, pfs.CommitStatus_ALL, false, nil, nil, false)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(commitInfos))
+}
+
+func TestHealth(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	require.NoError(t, d.Health())
+
+	// Nothing is listening on this address
+	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
+	require.NoError(t, persist.InitDB(RethinkAddress, dbName, "", 0, 0))
+	d, err := persist.NewDriver("localhost:1", RethinkAddress, dbName, nil)
+	require.NoError(t, err)
+	err = d.Health()
+	require.YesError(t, err)
+	require.True(t, strings.Contains(err.Error(), "block server"))
+	require.False(t, strings.Contains(err.Error(), "rethinkdb"))
+}
+
+func TestWriteTimeout(t *testing.T) {
+	proxyAddress, stall := stallingProxy(t, RethinkAddress)
+	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
+	require.NoError(t, persist.InitDB(RethinkAddress, dbName, "", 0, 0))
+	d, err := persist.NewDriver(getBlockAddress(t), proxyAddress, dbName, &persist.DriverOptions{WriteTimeout: time.Second})
+	require.NoError(t, err)
+	repo := &pfs.Repo{Name: uniqueString("TestWriteTimeout")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	// A forced DeleteRepo only writes, so it's bounded by the write timeout
+	stall()
+	start := time.Now()
+	err = d.DeleteRepo(repo, true)
+	require.YesError(t, err)
+	_, ok := err.(*pfsserver.ErrWriteTimeout)
+	require.True(t, ok)
+	require.True(t, time.Since(start) < 10*time.Second)
+}
+
+// stallingProxy forwards connections to address, and returns the address
+// that it listens on along with a function that makes it stop forwarding
+// the data that clients send.
+func stallingProxy(t *testing.T, address string) (string, func()) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	stalled := make(chan struct{})
+	go func() {
+		for {
+			clientConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			serverConn, err := net.Dial("tcp", address)
+			if err != nil {
+				clientConn.Close()
+				continue
+			}
+			go io.Copy(clientConn, serverConn)
+			go func() {
+				buf := make([]byte, 4096)
+				for {
+					n, err := clientConn.Read(buf)
+					if err != nil {
+						serverConn.Close()
+						return
+					}
+					select {
+					case <-stalled:
+						// Hold on to the data and the connection
+						select {}
+					default:
+					}
+					if _, err := serverConn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() { close(stalled) }
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := lion.GlobalLogger()
+	lion.SetLogger(lion.NewLogger(lion.NewTextWritePusher(&buf)))
+	defer lion.SetLogger(logger)
+
+	// Every operation takes longer than a nanosecond
+	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
+	require.NoError(t, persist.InitDB(RethinkAddress, dbName, "", 0, 0))
+	d, err := persist.NewDriver(getBlockAddress(t), RethinkAddress, dbName, &persist.DriverOptions{SlowQueryThreshold: time.Nanosecond})
+	require.NoError(t, err)
+	repo := &pfs.Repo{Name: uniqueString("TestSlowQueryLog")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+
+	var putFileLine string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, "PutFile") {
+			putFileLine = line
+		}
+	}
+	require.True(t, strings.Contains(putFileLine, "slow driver operation"))
+	require.True(t, strings.Contains(putFileLine, repo.Name))
+	require.True(t, strings.Contains(putFileLine, commit.ID))
+	require.True(t, strings.Contains(putFileLine, "foo"))
+
+	// A negative threshold disables the log
+	buf.Reset()
+	d, err = persist.NewDriver(getBlockAddress(t), RethinkAddress, dbName, &persist.DriverOptions{SlowQueryThreshold: -1})
+	require.NoError(t, err)
+	_, err = d.InspectRepo(repo)
+	require.NoError(t, err)
+	require.False(t, strings.Contains(buf.String(), "slow driver operation"))
+}
+
+func TestListCommitByTime(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestListCommitByTime")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	startCommit := func() *pfs.Commit {
+		commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+		require.NoError(t, err)
+		require.NoError(t, d.FinishCommit(commit, false))
+		// Make sure that the commits' timestamps are distinct
+		time.Sleep(10 * time.Millisecond)
+		return commit
+	}
+	commit1 := startCommit()
+	afterCommit1 := prototime.TimeToTimestamp(time.Now())
+	commit2 := startCommit()
+	afterCommit2 := prototime.TimeToTimestamp(time.Now())
+	commit3 := startCommit()
+
+	listCommit := func(since *google_protobuf.Timestamp, until *google_protobuf.Timestamp) []string {
+		commitInfos, err := d.ListCommit([]*pfs.Commit{{Repo: repo}}, nil, nil, pfs.CommitType_COMMIT_TYPE_NONE, pfs.CommitStatus_ALL, false, since, until, false)
+		require.NoError(t, err)
+		var commitIDs []string
+		for _, commitInfo := range commitInfos {
+			commitIDs = append(commitIDs, commitInfo.Commit.ID)
+		}
+		return commitIDs
+	}
+	require.Equal(t, []string{commit1.ID, commit2.ID, commit3.ID}, listCommit(nil, nil))
+	require.Equal(t, []string{commit2.ID, commit3.ID}, listCommit(afterCommit1, nil))
+	require.Equal(t, []string{commit1.ID}, listCommit(nil, afterCommit1))
+	require.Equal(t, []string{commit2.ID}, listCommit(afterCommit1, afterCommit2))
+	require.Equal(t, 0, len(listCommit(afterCommit2, afterCommit1)))
+}
+
+func TestListCommitOrdered(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo1 := &pfs.Repo{Name: uniqueString("TestListCommitOrdered1")}
+	require.NoError(t, d.CreateRepo(repo1, nil))
+	repo2 := &pfs.Repo{Name: uniqueString("TestListCommitOrdered2")}
+	require.NoError(t, d.CreateRepo(repo2, nil))
+
+	// Interleave commits across branches and repos
+	var started []string
+	finish := func(commit *pfs.Commit) *pfs.Commit {
+		require.NoError(t, d.FinishCommit(commit, false))
+		started = append(started, path.Join(commit.Repo.Name, commit.ID))
+		// Make sure that the commits' timestamps are distinct
+		time.Sleep(10 * time.Millisecond)
+		return commit
+	}
+	startCommit := func(repo *pfs.Repo, branch string) *pfs.Commit {
+		commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: branch}, nil)
+		require.NoError(t, err)
+		return finish(commit)
+	}
+	master1 := startCommit(repo1, "master")
+	fork, err := d.ForkCommit(master1, "fork", nil)
+	require.NoError(t, err)
+	finish(fork)
+	startCommit(repo2, "master")
+	startCommit(repo1, "master")
+	startCommit(repo1, "fork")
+	startCommit(repo2, "master")
+
+	listCommit := func(order drive.CommitOrder) []string {
+		commitInfos, err := d.ListCommitOrdered([]*pfs.Commit{{Repo: repo1}, {Repo: repo2}}, nil, nil, pfs.CommitType_COMMIT_TYPE_NONE, pfs.CommitStatus_ALL, false, nil, nil, order)
+		require.NoError(t, err)
+		var commitIDs []string
+		for _, commitInfo := range commitInfos {
+			commitIDs = append(commitIDs, path.Join(commitInfo.Commit.Repo.Name, commitInfo.Commit.ID))
+		}
+		return commitIDs
+	}
+	var reversed []string
+	for i := len(started) - 1; i >= 0; i-- {
+		reversed = append(reversed, started[i])
+	}
+	for i := 0; i < 5; i++ {
+		require.Equal(t, started, listCommit(drive.CommitOrderASCENDING))
+		require.Equal(t, reversed, listCommit(drive.CommitOrderDESCENDING))
+	}
+	require.Equal(t, len(started), len(listCommit(drive.CommitOrderNONE)))
+}
+
+func TestUnarchiveCommit(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	upstream := &pfs.Repo{Name: uniqueString("TestUnarchiveCommitUpstream")}
+	require.NoError(t, d.CreateRepo(upstream, nil))
+	downstream := &pfs.Repo{Name: uniqueString("TestUnarchiveCommitDownstream")}
+	require.NoError(t, d.CreateRepo(downstream, []*pfs.Repo{upstream}))
+
+	upstreamCommit, err := d.StartCommit(&pfs.Commit{Repo: upstream, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(upstreamCommit, false))
+	downstreamCommit, err := d.StartCommit(&pfs.Commit{Repo: downstream, ID: "master"}, []*pfs.Commit{upstreamCommit})
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(downstreamCommit, false))
+
+	listCommit := func(status pfs.CommitStatus) int {
+		commitInfos, err := d.ListCommit([]*pfs.Commit{{Repo: upstream}, {Repo: downstream}}, nil, nil, pfs.CommitType_COMMIT_TYPE_NONE, status, false, nil, nil, false)
+		require.NoError(t, err)
+		return len(commitInfos)
+	}
+
+	// Archived commits are hidden from normal listings
+	require.NoError(t, d.ArchiveCommit([]*pfs.Commit{upstreamCommit}))
+	require.Equal(t, 0, listCommit(pfs.CommitStatus_NORMAL))
+	require.Equal(t, 2, listCommit(pfs.CommitStatus_ARCHIVED))
+	require.Equal(t, 2, listCommit(pfs.CommitStatus_ALL))
+
+	require.NoError(t, d.UnarchiveCommit([]*pfs.Commit{upstreamCommit}))
+	require.Equal(t, 2, listCommit(pfs.CommitStatus_NORMAL))
+	require.Equal(t, 2, listCommit(pfs.CommitStatus_ALL))
+	commitInfo, err := d.InspectCommit(downstreamCommit)
+	require.NoError(t, err)
+	require.False(t, commitInfo.Archived)
+}
+
+func TestCancelCommit(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestCancelCommit")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit0, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit0, false))
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	commit3, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	forked, err := d.ForkCommit(commit1, "forked", nil)
+	require.NoError(t, err)
+	other, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "other"}, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, d.CancelCommit(commit1))
+	for _, commit := range []*pfs.Commit{commit1, commit2, commit3, forked} {
+		commitInfo, err := d.InspectCommit(commit)
+		require.NoError(t, err)
+		require.True(t, commitInfo.Cancelled, commit.ID)
+		require.NotNil(t, commitInfo.Finished, commit.ID)
+	}
+	// Neither the parent nor unrelated branches are affected
+	for _, commit := range []*pfs.Commit{commit0, other} {
+		commitInfo, err := d.InspectCommit(commit)
+		require.NoError(t, err)
+		require.False(t, commitInfo.Cancelled, commit.ID)
+	}
+	commitInfo, err := d.InspectCommit(other)
+	require.NoError(t, err)
+	require.Nil(t, commitInfo.Finished)
+
+	// Finishing a cancelled descendant afterwards doesn't uncancel it
+	require.NoError(t, d.FinishCommit(commit3, false))
+	commitInfo, err = d.InspectCommit(commit3)
+	require.NoError(t, err)
+	require.True(t, commitInfo.Cancelled)
+}
+
+func TestListCancelledCommit(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestListCancelledCommit")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit1, false))
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.FinishCommit(commit2, true))
+	commit3, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "open"}, nil)
+	require.NoError(t, err)
+
+	listCommit := func(commitType pfs.CommitType, status pfs.CommitStatus, cancelledOnly bool) []string {
+		commitInfos, err := d.ListCommit([]*pfs.Commit{{Repo: repo}}, nil, nil, commitType, status, cancelledOnly, nil, nil, false)
+		require.NoError(t, err)
+		var commitIDs []string
+		for _, commitInfo := range commitInfos {
+			commitIDs = append(commitIDs, commitInfo.Commit.ID)
+		}
+		sort.Strings(commitIDs)
+		return commitIDs
+	}
+	sorted := func(commitIDs ...string) []string {
+		sort.Strings(commitIDs)
+		return commitIDs
+	}
+
+	require.Equal(t, sorted(commit1.ID, commit3.ID), listCommit(pfs.CommitType_COMMIT_TYPE_NONE, pfs.CommitStatus_NORMAL, false))
+	require.Equal(t, sorted(commit1.ID, commit2.ID, commit3.ID), listCommit(pfs.CommitType_COMMIT_TYPE_NONE, pfs.CommitStatus_CANCELLED, false))
+	require.Equal(t, sorted(commit2.ID), listCommit(pfs.CommitType_COMMIT_TYPE_NONE, pfs.CommitStatus_NORMAL, true))
+	require.Equal(t, sorted(commit2.ID), listCommit(pfs.CommitType_COMMIT_TYPE_NONE, pfs.CommitStatus_ALL, true))
+	require.Equal(t, sorted(commit2.ID), listCommit(pfs.CommitType_COMMIT_TYPE_READ, pfs.CommitStatus_NORMAL, true))
+	require.Equal(t, 0, len(listCommit(pfs.CommitType_COMMIT_TYPE_WRITE, pfs.CommitStatus_NORMAL, true)))
+}
+
+func TestStartCommitConcurrently(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestStartCommitConcurrently")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	numCommits := 20
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	commitIDs := make(map[string]bool)
+	errCh := make(chan error, numCommits)
+	for i := 0; i < numCommits; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			commitIDs[commit.ID] = true
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("timed out waiting for concurrent commits")
+	}
+	close(errCh)
+	for err := range errCh {
+		require.NoError(t, err)
+	}
+	require.Equal(t, numCommits, len(commitIDs))
+
+	commitInfos, err := d.ListCommit([]*pfs.Commit{{Repo: repo}}, nil, nil, pfs.CommitType_COMMIT_TYPE_NONE, pfs.CommitStatus_ALL, false, nil, nil, false)
+	require.NoError(t, err)
+	require.Equal(t, numCommits, len(commitInfos))
+}
+
+type testReporter struct {
+	lock   sync.Mutex
+	errors map[string][]error
+}
+
+func (r *testReporter) ReportDuration(method string, d time.Duration, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.errors[method] = append(r.errors[method], err)
+}
+
+func TestReporter(t *testing.T) {
+	reporter := &testReporter{errors: make(map[string][]error)}
+	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
+	require.NoError(t, persist.InitDB(RethinkAddress, dbName, "", 0, 0))
+	d, err := persist.NewDriver(getBlockAddress(t), RethinkAddress, dbName, &persist.DriverOptions{Reporter: reporter})
+	require.NoError(t, err)
+
+	repo := &pfs.Repo{Name: uniqueString("TestReporter")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit, false))
+	_, err = d.StartCommit(&pfs.Commit{Repo: &pfs.Repo{Name: "nonexistent"}, ID: "master"}, nil)
+	require.YesError(t, err)
+
+	reporter.lock.Lock()
+	defer reporter.lock.Unlock()
+	require.Equal(t, 1, len(reporter.errors["CreateRepo"]))
+	require.Equal(t, 1, len(reporter.errors["PutFile"]))
+	require.Equal(t, 1, len(reporter.errors["FinishCommit"]))
+	require.NoError(t, reporter.errors["FinishCommit"][0])
+	require.Equal(t, 2, len(reporter.errors["StartCommit"]))
+	require.NoError(t, reporter.errors["StartCommit"][0])
+	require.YesError(t, reporter.errors["StartCommit"][1])
+}
+
+func TestRepairDiffs(t *testing.T) {
+	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
+	require.NoError(t, persist.InitDB(RethinkAddress, dbName, "", 0, 0))
+	d, err := persist.NewDriver(getBlockAddress(t), RethinkAddress, dbName, nil)
+	require.NoError(t, err)
+	repo := &pfs.Repo{Name: uniqueString("TestRepairDiffs")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+
+	commit1, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit1, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit1, false))
+	commit2, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit2, Path: "dir/bar"}, pfs.Delimiter_LINE, strings.NewReader("bar\n")))
+
+	// Simulate a crash that lost the commit document but not its diffs
+	dbClient, err := persist.DbConnect(RethinkAddress)
+	require.NoError(t, err)
+	defer dbClient.Close()
+	_, err = gorethink.DB(dbName).Table("Commits").Filter(map[string]interface{}{
+		"Repo":     repo.Name,
+		"Finished": nil,
+	}).Delete().RunWrite(dbClient)
+	require.NoError(t, err)
+
+	removed, err := d.RepairDiffs(repo)
+	require.NoError(t, err)
+	// "/dir" and "/dir/bar"
+	require.Equal(t, 2, removed)
+	removed, err = d.RepairDiffs(repo)
+	require.NoError(t, err)
+	require.Equal(t, 0, removed)
+
+	// The next commit gets the clock of the lost commit, but not its content
+	commit3, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, commit2.ID, commit3.ID)
+	_, err = d.InspectFile(&pfs.File{Commit: commit3, Path: "dir"}, nil, nil)
+	require.YesError(t, err)
+	require.Equal(t, "foo\n", getFile(t, d, &pfs.File{Commit: commit3, Path: "foo"}, 0, 0))
+
+	_, err = d.RepairDiffs(&pfs.Repo{Name: "nonexistent"})
+	require.YesError(t, err)
+}
+
+func TestDump(t *testing.T) {
+	d := getDriver(t, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("TestDump")}
+	require.NoError(t, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+	require.NoError(t, d.PutFile(&pfs.File{Commit: commit, Path: "foo"}, pfs.Delimiter_LINE, strings.NewReader("foo\n")))
+	require.NoError(t, d.FinishCommit(commit, false))
+	_, err = d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(t, err)
+
+	// Dump only logs, so we just make sure that it doesn't fail midway
+	d.Dump()
+}
+
+func BenchmarkInspectFileUnfiltered(b *testing.B) {
+	benchmarkInspectFile(b, nil)
+}
+
+func BenchmarkInspectFileBlockShard(b *testing.B) {
+	benchmarkInspectFile(b, &pfs.Shard{BlockNumber: 0, BlockModulus: 2})
+}
+
+func benchmarkInspectFile(b *testing.B, filterShard *pfs.Shard) {
+	numBlocks := 1000
+	d := getDriver(b, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("BenchmarkInspectFile")}
+	require.NoError(b, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(b, err)
+	var readers []io.Reader
+	for i := 0; i < numBlocks; i++ {
+		readers = append(readers, strings.NewReader(fmt.Sprintf("%d\n", i)))
+	}
+	file := &pfs.File{Commit: commit, Path: "file"}
+	require.NoError(b, d.PutFileSplit(file, pfs.Delimiter_LINE, readers))
+	require.NoError(b, d.FinishCommit(commit, false))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := d.InspectFile(file, filterShard, nil)
+		require.NoError(b, err)
+	}
+}
+
+func BenchmarkInspectCommitPool(b *testing.B) {
+	benchmarkInspectCommit(b, persist.DefaultMaxIdle, persist.DefaultMaxOpen)
+}
+
+func BenchmarkInspectCommitSingleConnection(b *testing.B) {
+	benchmarkInspectCommit(b, 1, 1)
+}
+
+func benchmarkInspectCommit(b *testing.B, maxIdle int, maxOpen int) {
+	concurrency := 50
+	d := getDriver(b, maxIdle, maxOpen)
+	repo := &pfs.Repo{Name: uniqueString("BenchmarkInspectCommit")}
+	require.NoError(b, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(b, err)
+	require.NoError(b, d.FinishCommit(commit, false))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < concurrency; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := d.InspectCommit(commit)
+				require.NoError(b, err)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkCountCommitsPerBranch(b *testing.B) {
+	benchmarkCountCommits(b, func(commits gorethink.Term, repo string, branches []string) gorethink.Term {
+		return gorethink.Expr(branches).Map(func(branch gorethink.Term) gorethink.Term {
+			return commits.Between(
+				[]interface{}{repo, branch, gorethink.MinVal},
+				[]interface{}{repo, branch, gorethink.MaxVal},
+				gorethink.BetweenOpts{Index: persist.CommitClockIndex.Name},
+			).Count()
+		}).Sum()
+	})
+}
+
+func BenchmarkCountCommitsRepoIndex(b *testing.B) {
+	benchmarkCountCommits(b, func(commits gorethink.Term, repo string, branches []string) gorethink.Term {
+		return commits.GetAllByIndex(persist.CommitRepoIndex.Name, repo).Count()
+	})
+}
+
+func benchmarkCountCommits(b *testing.B, count func(commits gorethink.Term, repo string, branches []string) gorethink.Term) {
+	numBranches := 10
+	numCommits := 20
+	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
+	require.NoError(b, persist.InitDB(RethinkAddress, dbName, "", 0, 0))
+	d, err := persist.NewDriver(getBlockAddress(b), RethinkAddress, dbName, nil)
+	require.NoError(b, err)
+	repo := &pfs.Repo{Name: "repo"}
+	require.NoError(b, d.CreateRepo(repo, nil))
+	root, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(b, err)
+	require.NoError(b, d.FinishCommit(root, false))
+	var branches []string
+	for i := 0; i < numBranches; i++ {
+		branch := fmt.Sprintf("branch%d", i)
+		branches = append(branches, branch)
+		commit, err := d.ForkCommit(root, branch, nil)
+		require.NoError(b, err)
+		require.NoError(b, d.FinishCommit(commit, false))
+		for j := 1; j < numCommits; j++ {
+			commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: branch}, nil)
+			require.NoError(b, err)
+			require.NoError(b, d.FinishCommit(commit, false))
+		}
+	}
+	branches = append(branches, "master")
+	dbClient, err := persist.DbConnect(RethinkAddress)
+	require.NoError(b, err)
+	query := count(gorethink.DB(dbName).Table("Commits"), repo.Name, branches)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cursor, err := query.Run(dbClient)
+		require.NoError(b, err)
+		var n int
+		require.NoError(b, cursor.One(&n))
+		require.Equal(b, numBranches*numCommits+1, n)
+		require.NoError(b, cursor.Close())
+	}
+}
+
+func BenchmarkPutFile(b *testing.B) {
+	benchmarkPutFiles(b, func(d drive.Driver, commit *pfs.Commit, files []*drive.PutFileRequest) error {
+		for _, file := range files {
+			if err := d.PutFile(&pfs.File{Commit: commit, Path: file.Path}, file.Delimiter, file.Reader); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkPutFiles(b *testing.B) {
+	benchmarkPutFiles(b, func(d drive.Driver, commit *pfs.Commit, files []*drive.PutFileRequest) error {
+		return d.PutFiles(commit, files)
+	})
+}
+
+func benchmarkPutFiles(b *testing.B, putFiles func(drive.Driver, *pfs.Commit, []*drive.PutFileRequest) error) {
+	numFiles := 100
+	d := getDriver(b, 0, 0)
+	repo := &pfs.Repo{Name: uniqueString("BenchmarkPutFiles")}
+	require.NoError(b, d.CreateRepo(repo, nil))
+	commit, err := d.StartCommit(&pfs.Commit{Repo: repo, ID: "master"}, nil)
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var files []*drive.PutFileRequest
+		for j := 0; j < numFiles; j++ {
+			files = append(files, &drive.PutFileRequest{
+				Path:      fmt.Sprintf("/dir%d/file%d", j%10, j),
+				Delimiter: pfs.Delimiter_LINE,
+				Reader:    strings.NewReader(fmt.Sprintf("%d\n", j)),
+			})
+		}
+		require.NoError(b, putFiles(d, commit, files))
+	}
+}
+
+func getFile(t *testing.T, d drive.Driver, file *pfs.File, offset int64, size int64) string {
+	reader, err := d.GetFile(file, nil, offset, size, nil, true)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, reader.Close())
+	}()
+	data, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func getDriver(tb testing.TB, maxIdle int, maxOpen int) drive.Driver {
+	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
+	require.NoError(tb, persist.InitDB(RethinkAddress, dbName, "", 0, 0))
+	d, err := persist.NewDriver(getBlockAddress(tb), RethinkAddress, dbName, &persist.DriverOptions{MaxIdle: maxIdle, MaxOpen: maxOpen})
+	require.NoError(tb, err)
+	return d
+}
+
+func getBlockAddress(tb testing.TB) string {
+	return serveBlocks(tb, uniqueString("/tmp/pach_test/run"))
+}
+
+// serveBlocks serves a local block server that stores blocks in dir, and
+// returns its address.
+func serveBlocks(tb testing.TB, dir string) string {
+	localPort := atomic.AddInt32(&port, 1)
+	blockAPIServer, err := server.NewLocalBlockAPIServer(dir)
+	require.NoError(tb, err)
+	ready := make(chan bool)
+	go func() {
+		err := protoserver.Serve(
+			func(s *grpc.Server) {
+				pfs.RegisterBlockAPIServer(s, blockAPIServer)
+				close(ready)
+			},
+			protoserver.ServeOptions{Version: version.Version},
+			protoserver.ServeEnv{GRPCPort: uint16(localPort)},
+		)
+		require.NoError(tb, err)
+	}()
+	<-ready
+	return fmt.Sprintf("localhost:%d", localPort)
+}
+
+func uniqueString(prefix string) string {
+	return prefix + "." + uuid.NewWithoutDashes()[0:12]
+}
@@ -0,0 +1,27 @@
+package persist
+
+import (
+	"testing"
+
+	"github.com/pachyderm/pachyderm/src/client/pkg/require"
+)
+
+func TestCheckAcyclic(t *testing.T) {
+	require.NoError(t, checkAcyclic(nil))
+	// A fork and a chain that share an ancestor
+	require.NoError(t, checkAcyclic(map[string]string{
+		"master/1": "master/0",
+		"master/2": "master/1",
+		"fork/0":   "master/1",
+		"fork/1":   "fork/0",
+	}))
+	require.YesError(t, checkAcyclic(map[string]string{
+		"master/0": "master/0",
+	}))
+	require.YesError(t, checkAcyclic(map[string]string{
+		"master/0": "master/1",
+		"master/1": "fork/0",
+		"fork/0":   "master/0",
+		"fork/1":   "fork/0",
+	}))
+}
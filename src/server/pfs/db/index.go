@@ -15,6 +15,7 @@ var Indexes = []*index{
 	CommitBranchIndex,
 	CommitClockIndex,
 	CommitFullClockIndex,
+	CommitRepoIndex,
 }
 
 // index is a rethinkdb index.
@@ -172,3 +173,14 @@ var CommitFullClockIndex = &index{
 		}
 	},
 }
+
+// CommitRepoIndex maps a repo to its commits, on all branches
+// Format: repo
+// Example: "repo"
+var CommitRepoIndex = &index{
+	Name:  "CommitRepoIndex",
+	Table: commitTable,
+	CreateFunction: func(row gorethink.Term) interface{} {
+		return row.Field("Repo")
+	},
+}
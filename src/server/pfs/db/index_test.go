@@ -3,7 +3,6 @@ package persist
 import (
 	"fmt"
 	"testing"
-	"time"
 
 	"github.com/pachyderm/pachyderm/src/client/pkg/require"
 	"github.com/pachyderm/pachyderm/src/server/pfs/db/persist"
@@ -119,7 +118,7 @@ func TestCommitClockIndex(t *testing.T) {
 func getClient(t *testing.T) *gorethink.Session {
 	dbClient, err := gorethink.Connect(gorethink.ConnectOpts{
 		Address: RethinkAddress,
-		Timeout: connectTimeoutSeconds * time.Second,
+		Timeout: DefaultConnectTimeout,
 	})
 	require.NoError(t, err)
 	return dbClient
@@ -96,6 +96,27 @@ func FullClockParent(child FullClock) FullClock {
 	return nil
 }
 
+// FullClockAncestor returns the nth ancestor of a full clock, or nil if the
+// clock has fewer than n ancestors.  Like FullClockParent, it walks back
+// across branch boundaries.
+// [(master, 2), (foo, 1)], 3 -> [(master, 1)]
+func FullClockAncestor(child FullClock, n uint64) FullClock {
+	clone := CloneFullClock(child)
+	for n > 0 && len(clone) > 0 {
+		lastClock := FullClockHead(clone)
+		if lastClock.Clock >= n {
+			lastClock.Clock -= n
+			return clone
+		}
+		n -= lastClock.Clock + 1
+		clone = clone[:len(clone)-1]
+	}
+	if len(clone) == 0 {
+		return nil
+	}
+	return clone
+}
+
 // FullClock is an array of clocks, e.g. [(master, 2), (foo, 3)]
 type FullClock []*Clock
 
@@ -234,3 +255,22 @@ func DBClockAncestor(parent, child gorethink.Term) gorethink.Term {
 		),
 	)
 }
+
+// DBClockReachable returns whether one FullClock can be reached from the
+// other by following children, assuming both are rethinkdb terms.  Unlike
+// DBClockDescendent, it includes the commits on branches that were forked
+// off of later commits of the parent's branch, e.g. [(master, 2), (foo, 0)]
+// is reachable from [(master, 1)].  A FullClock isn't reachable from itself.
+func DBClockReachable(child, parent gorethink.Term) gorethink.Term {
+	n := parent.Count()
+	return gorethink.Branch(
+		gorethink.Or(child.Count().Lt(n), n.Eq(0)),
+		gorethink.Expr(false),
+		gorethink.And(
+			child.Slice(0, n.Sub(1)).Eq(parent.Slice(0, -1)),
+			child.Nth(n.Sub(1)).Field("Branch").Eq(parent.Nth(-1).Field("Branch")),
+			child.Nth(n.Sub(1)).Field("Clock").Ge(parent.Nth(-1).Field("Clock")),
+			child.Ne(parent),
+		),
+	)
+}
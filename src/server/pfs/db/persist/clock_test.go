@@ -19,6 +19,21 @@ func TestNewChild(t *testing.T) {
 	require.Equal(t, expected, child)
 }
 
+func TestFullClockAncestor(t *testing.T) {
+	fullClock := FullClock{
+		&Clock{Branch: "master", Clock: 2},
+		&Clock{Branch: "foo", Clock: 1},
+	}
+	require.Equal(t, fullClock, FullClockAncestor(fullClock, 0))
+	require.Equal(t, FullClockParent(fullClock), FullClockAncestor(fullClock, 1))
+	require.Equal(t, FullClock{&Clock{Branch: "master", Clock: 2}}, FullClockAncestor(fullClock, 2))
+	require.Equal(t, FullClock{&Clock{Branch: "master", Clock: 1}}, FullClockAncestor(fullClock, 3))
+	require.Equal(t, FullClock{&Clock{Branch: "master", Clock: 0}}, FullClockAncestor(fullClock, 4))
+	require.Nil(t, FullClockAncestor(fullClock, 5))
+	// The original clock is left alone
+	require.Equal(t, uint64(1), fullClock[1].Clock)
+}
+
 func TestClockRange(t *testing.T) {
 	clockRangeList := NewClockRangeList(
 		[]*Clock{
@@ -0,0 +1,210 @@
+package persist
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/pachyderm/pachyderm/src/client/pfs"
+	"github.com/pachyderm/pachyderm/src/client/pkg/require"
+	pfsserver "github.com/pachyderm/pachyderm/src/server/pfs"
+	"github.com/pachyderm/pachyderm/src/server/pfs/db/persist"
+
+	"go.pedge.io/pb/go/google/protobuf"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func TestSeekToOffset(t *testing.T) {
+	// Blocks of sizes 0, 3, 0, 0, 2 and 0
+	var blockRefs []*persist.BlockRef
+	for _, size := range []uint64{0, 3, 0, 0, 2, 0} {
+		blockRefs = append(blockRefs, &persist.BlockRef{
+			Hash:  "hash",
+			Upper: size,
+		})
+	}
+	for _, c := range []struct {
+		offset      int64
+		index       int
+		intraOffset int64
+	}{
+		// The start, which skips the leading empty block
+		{0, 1, 0},
+		// Within a block
+		{2, 1, 2},
+		// On a boundary, which skips the empty blocks in between
+		{3, 4, 0},
+		{4, 4, 1},
+		// At and past the end
+		{5, 6, 0},
+		{7, 6, 2},
+	} {
+		index, intraOffset := seekToOffset(blockRefs, c.offset)
+		require.Equal(t, c.index, index)
+		require.Equal(t, c.intraOffset, intraOffset)
+	}
+
+	index, intraOffset := seekToOffset(nil, 0)
+	require.Equal(t, 0, index)
+	require.Equal(t, int64(0), intraOffset)
+}
+
+// fakeBlockClient serves blocks from memory and records the GetBlock
+// requests that it receives.
+type fakeBlockClient struct {
+	pfs.BlockAPIClient
+	blocks   map[string][]byte
+	requests []*pfs.GetBlockRequest
+}
+
+func (c *fakeBlockClient) GetBlock(ctx context.Context, request *pfs.GetBlockRequest, opts ...grpc.CallOption) (pfs.BlockAPI_GetBlockClient, error) {
+	c.requests = append(c.requests, request)
+	data := c.blocks[request.Block.Hash][request.OffsetBytes:]
+	if request.SizeBytes != 0 {
+		data = data[:request.SizeBytes]
+	}
+	return &fakeGetBlockClient{data: data}, nil
+}
+
+type fakeGetBlockClient struct {
+	grpc.ClientStream
+	data []byte
+}
+
+func (c *fakeGetBlockClient) Recv() (*google_protobuf.BytesValue, error) {
+	if c.data == nil {
+		return nil, io.EOF
+	}
+	value := &google_protobuf.BytesValue{Value: c.data}
+	c.data = nil
+	return value, nil
+}
+
+func TestFileReaderCoalescesBlockRefs(t *testing.T) {
+	blockClient := &fakeBlockClient{
+		blocks: map[string][]byte{
+			"a": []byte("0123456789"),
+			"b": []byte("abcdef"),
+		},
+	}
+	d := &driver{blockClient: blockClient}
+	blockRefs := []*persist.BlockRef{
+		{Hash: "a", Lower: 0, Upper: 3},
+		{Hash: "a", Lower: 3, Upper: 5},
+		{Hash: "a", Lower: 5, Upper: 8},
+		// Same block but not adjacent
+		{Hash: "a", Lower: 9, Upper: 10},
+		{Hash: "b", Lower: 0, Upper: 2},
+		{Hash: "b", Lower: 2, Upper: 6},
+	}
+
+	data, err := ioutil.ReadAll(d.newFileReader(blockRefs, &pfs.File{Path: "file"}, 0, 0))
+	require.NoError(t, err)
+	require.Equal(t, "012345679abcdef", string(data))
+	require.Equal(t, 3, len(blockClient.requests))
+	require.Equal(t, uint64(0), blockClient.requests[0].OffsetBytes)
+	require.Equal(t, uint64(8), blockClient.requests[0].SizeBytes)
+	// The blockrefs passed in aren't modified
+	require.Equal(t, uint64(3), blockRefs[0].Upper)
+
+	// A range within the adjacent blockrefs is fetched at once as well
+	blockClient.requests = nil
+	data, err = ioutil.ReadAll(d.newFileReader(blockRefs, &pfs.File{Path: "file"}, 2, 4))
+	require.NoError(t, err)
+	require.Equal(t, "2345", string(data))
+	require.Equal(t, 1, len(blockClient.requests))
+}
+
+// cancellingReader closes a fileReader once it has been read from, as if
+// the fileReader was closed during the read.
+type cancellingReader struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(data []byte) (int, error) {
+	n, err := r.Reader.Read(data)
+	r.cancel()
+	return n, err
+}
+
+func TestFileReaderClosedDuringRead(t *testing.T) {
+	d := &driver{blockClient: &fakeBlockClient{}}
+	reader := d.newFileReader([]*persist.BlockRef{{Hash: "a", Lower: 0, Upper: 3}}, &pfs.File{Path: "file"}, 0, 0)
+	reader.reader = &cancellingReader{Reader: strings.NewReader("012"), cancel: reader.cancel}
+
+	// The data read before the reader was closed is returned
+	data := make([]byte, 3)
+	n, err := reader.Read(data)
+	require.Equal(t, ErrReaderClosed, err)
+	require.Equal(t, 3, n)
+	require.Equal(t, "012", string(data))
+
+	n, err = reader.Read(data)
+	require.Equal(t, ErrReaderClosed, err)
+	require.Equal(t, 0, n)
+}
+
+func TestGetBlockByHash(t *testing.T) {
+	data := []byte("0123456789")
+	hash := pfsserver.HashBlock(data)
+	blockClient := &fakeBlockClient{
+		blocks: map[string][]byte{
+			hash:      data,
+			"corrupt": data,
+		},
+	}
+	d := &driver{blockClient: blockClient}
+	readBlock := func(hash string, offset uint64, size uint64) (string, error) {
+		reader, err := d.GetBlockByHash(hash, offset, size)
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+		data, err := ioutil.ReadAll(reader)
+		return string(data), err
+	}
+
+	block, err := readBlock(hash, 2, 3)
+	require.NoError(t, err)
+	require.Equal(t, "234", block)
+	require.Equal(t, uint64(2), blockClient.requests[0].OffsetBytes)
+	require.Equal(t, uint64(3), blockClient.requests[0].SizeBytes)
+	// A size of 0 reads until the end of the block
+	block, err = readBlock(hash, 7, 0)
+	require.NoError(t, err)
+	require.Equal(t, "789", block)
+
+	// Blocks are verified like when files are read
+	d.verifyBlocks = true
+	block, err = readBlock(hash, 7, 0)
+	require.NoError(t, err)
+	require.Equal(t, "789", block)
+	_, err = readBlock("corrupt", 0, 0)
+	require.YesError(t, err)
+	_, ok := err.(*pfsserver.ErrBlockCorrupted)
+	require.True(t, ok)
+}
+
+func TestGroupBlockRefs(t *testing.T) {
+	var blockRefs []*persist.BlockRef
+	for _, size := range []uint64{3, 4, 2, 10, 1, 1} {
+		blockRefs = append(blockRefs, &persist.BlockRef{
+			Hash:  "hash",
+			Upper: size,
+		})
+	}
+	var sizes [][]uint64
+	for _, group := range groupBlockRefs(blockRefs, 9) {
+		var groupSizes []uint64
+		for _, blockRef := range group {
+			groupSizes = append(groupSizes, blockRef.Size())
+		}
+		sizes = append(sizes, groupSizes)
+	}
+	// The blockref that's bigger than the maximum is on its own
+	require.Equal(t, [][]uint64{{3, 4, 2}, {10}, {1, 1}}, sizes)
+	require.Equal(t, 0, len(groupBlockRefs(nil, 9)))
+}
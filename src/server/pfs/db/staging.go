@@ -0,0 +1,89 @@
+package persist
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pachyderm/pachyderm/src/server/pfs/db/persist"
+)
+
+// stagedKey identifies a file handle within a commit.  CommitID is the
+// database primary key of the commit, not a branch name.
+type stagedKey struct {
+	CommitID string
+	Handle   string
+}
+
+// stagedFile is the content written to a path through a file handle.
+type stagedFile struct {
+	path      string
+	blockRefs []*persist.BlockRef
+	size      uint64
+}
+
+// stagedWrites holds the content written through file handles until the
+// handles are committed, so that partially written files are not visible.
+// Staged writes only live in the memory of the driver; they are lost if
+// the process restarts, and the blocks that they refer to are then left
+// unreferenced.  It's safe for concurrent access.
+type stagedWrites struct {
+	lock   sync.Mutex
+	writes map[stagedKey]map[string]*stagedFile
+}
+
+func newStagedWrites() *stagedWrites {
+	return &stagedWrites{
+		writes: make(map[stagedKey]map[string]*stagedFile),
+	}
+}
+
+// add appends content to a path under a file handle.
+func (s *stagedWrites) add(commitID string, handle string, path string, blockRefs []*persist.BlockRef, size uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := stagedKey{commitID, handle}
+	files, ok := s.writes[key]
+	if !ok {
+		files = make(map[string]*stagedFile)
+		s.writes[key] = files
+	}
+	file, ok := files[path]
+	if !ok {
+		file = &stagedFile{path: path}
+		files[path] = file
+	}
+	file.blockRefs = append(file.blockRefs, blockRefs...)
+	file.size += size
+}
+
+// remove removes the content staged under a file handle and returns it,
+// ordered by path.
+func (s *stagedWrites) remove(commitID string, handle string) []*stagedFile {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := stagedKey{commitID, handle}
+	files := s.writes[key]
+	delete(s.writes, key)
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var res []*stagedFile
+	for _, path := range paths {
+		res = append(res, files[path])
+	}
+	return res
+}
+
+// removeCommit discards the content staged under all file handles of a
+// commit.
+func (s *stagedWrites) removeCommit(commitID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key := range s.writes {
+		if key.CommitID == commitID {
+			delete(s.writes, key)
+		}
+	}
+}
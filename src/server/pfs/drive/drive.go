@@ -8,6 +8,10 @@ import (
 	"strings"
 
 	"github.com/pachyderm/pachyderm/src/client/pfs"
+	"github.com/pachyderm/pachyderm/src/server/pfs/db/persist"
+
+	"go.pedge.io/pb/go/google/protobuf"
+	"golang.org/x/net/context"
 )
 
 // ListFileMode specifies how ListFile executes.
@@ -22,6 +26,162 @@ const (
 	ListFileRECURSE
 )
 
+// FileChangeType specifies how a file changed between two commits.
+type FileChangeType int
+
+const (
+	// FileUnchanged means that the file is the same in both commits, or that
+	// it exists in neither
+	FileUnchanged FileChangeType = iota
+	// FileAdded means that the file only exists in the later commit
+	FileAdded
+	// FileDeleted means that the file only exists in the earlier commit
+	FileDeleted
+	// FileModified means that the file exists in both commits with different
+	// content or a different type
+	FileModified
+)
+
+// CommitOrder specifies how ListCommitOrdered orders commits.
+type CommitOrder int
+
+const (
+	// CommitOrderNONE orders the commits of each branch by clock, and the
+	// repos by name, but doesn't order commits across branches
+	CommitOrderNONE CommitOrder = iota
+	// CommitOrderASCENDING orders commits by the time they were started,
+	// oldest first, across all branches and repos
+	CommitOrderASCENDING
+	// CommitOrderDESCENDING orders commits by the time they were started,
+	// newest first, across all branches and repos
+	CommitOrderDESCENDING
+)
+
+// FileChange describes how a file changed between two commits.
+type FileChange struct {
+	Type FileChangeType
+	// SizeDelta is the size of the file in the later commit minus its size
+	// in the earlier commit.
+	SizeDelta int64
+	// BlockRefsAdded are the blockrefs that only back the file in the later
+	// commit, and BlockRefsRemoved are the ones that only back it in the
+	// earlier commit.
+	BlockRefsAdded   []*persist.BlockRef
+	BlockRefsRemoved []*persist.BlockRef
+}
+
+// FileHandle bundles the metadata of a file with a way to read its content.
+type FileHandle struct {
+	// Info is the same FileInfo that InspectFile would return.
+	Info *pfs.FileInfo
+	// Hash identifies the content of the file.
+	Hash      string
+	newReader func() io.ReadCloser
+}
+
+// NewFileHandle creates a FileHandle.  newReader is called every time the
+// handle's Reader method is called.
+func NewFileHandle(info *pfs.FileInfo, hash string, newReader func() io.ReadCloser) *FileHandle {
+	return &FileHandle{
+		Info:      info,
+		Hash:      hash,
+		newReader: newReader,
+	}
+}
+
+// Reader returns a reader for the full content of the file.
+func (h *FileHandle) Reader() io.ReadCloser {
+	return h.newReader()
+}
+
+// PutFileRequest is one of the files written by PutFiles.
+type PutFileRequest struct {
+	// Path is the path of the file within the commit.
+	Path      string
+	Delimiter pfs.Delimiter
+	Reader    io.Reader
+}
+
+// RepoInfo is a pfs.RepoInfo along with details that are too expensive to
+// compute on every InspectRepo.
+type RepoInfo struct {
+	*pfs.RepoInfo
+	// BranchSizes maps each branch of the repo to the size of its head commit.
+	BranchSizes map[string]uint64
+	// NumCommits is the number of commits in the repo, whatever their
+	// status.
+	NumCommits uint64
+	// Tags are the key/value pairs attached to the repo.
+	Tags map[string]string
+}
+
+// RepoDeletion is what deleting a repo would remove.
+type RepoDeletion struct {
+	// NumCommits is the number of commits in the repo, whatever their
+	// status.
+	NumCommits uint64
+	// NumDiffs is the number of diffs in the repo.
+	NumDiffs uint64
+	// NumBranches is the number of branches whose clocks the commits of the
+	// repo are on.
+	NumBranches uint64
+	// DependentRepos are the repos that have the repo as provenance.
+	// Deleting the repo fails without force while there are any.
+	DependentRepos []string
+}
+
+// CommitInfo is a pfs.CommitInfo along with details that are too expensive
+// to compute on every InspectCommit.
+type CommitInfo struct {
+	*pfs.CommitInfo
+	// IsHead is whether the commit is the head of its branch.
+	IsHead bool
+	// NumDiffs is the number of diffs in the commit, i.e. the number of
+	// paths that the commit touched, directories included.
+	NumDiffs uint64
+	// Description and Metadata are what was attached to the commit by
+	// StartCommitWithMetadata and FinishCommitWithMetadata.
+	Description string
+	Metadata    map[string]string
+}
+
+// CommitGraph is the DAG formed by the commits of a repo.
+type CommitGraph struct {
+	// Commits are all the commits of the repo, whatever their status,
+	// ordered by ID.  Their Branch field labels the branch they're on.
+	Commits []*pfs.CommitInfo
+	// Edges link each commit that has a parent to its parent.
+	Edges []*CommitEdge
+	// Heads maps each branch to the ID of its head commit.
+	Heads map[string]string
+}
+
+// CommitEdge links a commit to its parent in a CommitGraph.
+type CommitEdge struct {
+	Child  string
+	Parent string
+	// Fork is set if the child is the first commit of a branch that was
+	// forked off of the parent.
+	Fork bool
+}
+
+// FileInfo is a pfs.FileInfo along with details that are too expensive to
+// compute on every InspectFile.
+type FileInfo struct {
+	*pfs.FileInfo
+	// NumChildren is the number of children of a directory.
+	NumChildren uint64
+}
+
+// DiffInfo describes a single change made to a path in a commit.
+type DiffInfo struct {
+	Path     string
+	Delete   bool
+	Size     uint64
+	FileType pfs.FileType
+	Modified *google_protobuf.Timestamp
+}
+
 // IsPermissionError returns true if a given error is a permission error.
 func IsPermissionError(err error) bool {
 	return strings.Contains(err.Error(), "has already finished")
@@ -29,32 +189,267 @@ func IsPermissionError(err error) bool {
 
 // Driver represents a low-level pfs storage driver.
 type Driver interface {
+	// Health returns an error describing which of the driver's dependencies
+	// are unreachable, if any.
+	Health() error
+
 	CreateRepo(repo *pfs.Repo, provenance []*pfs.Repo) error
+	// CreateRepoWithTags is the same as CreateRepo, except that it attaches
+	// tags to the repo, e.g. its team or retention policy.
+	CreateRepoWithTags(repo *pfs.Repo, provenance []*pfs.Repo, tags map[string]string) error
+	// UpdateRepo replaces the tags of repo.
+	UpdateRepo(repo *pfs.Repo, tags map[string]string) error
 	InspectRepo(repo *pfs.Repo) (*pfs.RepoInfo, error)
+	// InspectRepoWithBranchSizes is the same as InspectRepo, except that it
+	// also computes the size of each branch and counts the commits.
+	InspectRepoWithBranchSizes(repo *pfs.Repo) (*RepoInfo, error)
+	// InspectRepoWithTags is the same as InspectRepo, except that it also
+	// returns the tags of the repo.
+	InspectRepoWithTags(repo *pfs.Repo) (*RepoInfo, error)
 	ListRepo(provenance []*pfs.Repo) ([]*pfs.RepoInfo, error)
+	// ListRepoWithNumCommits is the same as ListRepo, except that it also
+	// counts the commits of each repo.  BranchSizes isn't set.
+	ListRepoWithNumCommits(provenance []*pfs.Repo) ([]*RepoInfo, error)
+	// ListRepoWithTags is the same as ListRepo, except that it only returns
+	// the repos that have all of tags, and returns their tags.
+	ListRepoWithTags(provenance []*pfs.Repo, tags map[string]string) ([]*RepoInfo, error)
 	DeleteRepo(repo *pfs.Repo, force bool) error
+	// DeleteRepoPreview returns what DeleteRepo would remove, without
+	// removing anything.
+	DeleteRepoPreview(repo *pfs.Repo) (*RepoDeletion, error)
 
 	StartCommit(parent *pfs.Commit, provenance []*pfs.Commit) (*pfs.Commit, error)
+	// StartCommitWithMetadata is the same as StartCommit, except that it
+	// attaches a description and metadata to the commit.  Both are optional.
+	StartCommitWithMetadata(parent *pfs.Commit, provenance []*pfs.Commit, description string, metadata map[string]string) (*pfs.Commit, error)
 	ForkCommit(parent *pfs.Commit, branch string, provenance []*pfs.Commit) (*pfs.Commit, error)
 	FinishCommit(commit *pfs.Commit, cancel bool) error
+	// FinishCommitWithMetadata is the same as FinishCommit, except that it
+	// attaches a description and metadata to the commit.  A non-empty
+	// description replaces the one given when the commit was started, and
+	// the metadata is added to what was given then, replacing the values of
+	// keys that are given again.
+	FinishCommitWithMetadata(commit *pfs.Commit, cancel bool, description string, metadata map[string]string) error
+	// FinishCommitCompacted is the same as FinishCommit, except that before
+	// the commit is finished, the files that were written to it in several
+	// pieces, e.g. by repeated PutFiles, are rewritten as few blocks as
+	// possible so that reading them is cheaper.  The content of the files
+	// doesn't change.
+	FinishCommitCompacted(commit *pfs.Commit, cancel bool) error
+	// FinishCommitContext is the same as FinishCommit, except that it returns
+	// an error if ctx is done before the parent of commit is finished.
+	FinishCommitContext(ctx context.Context, commit *pfs.Commit, cancel bool) error
+	// FinishCommitNoWait is the same as FinishCommit, except that it doesn't
+	// wait for the parent of commit to be finished, and so commit doesn't
+	// inherit the parent's cancellation.  It's up to the caller to make sure
+	// that the order in which commits finish doesn't matter.
+	FinishCommitNoWait(commit *pfs.Commit, cancel bool) error
+	// CancelCommit marks commit as cancelled, finishing it if it's open, and
+	// immediately finishes all of its open descendants as cancelled as well,
+	// rather than waiting for them to be finished.  Descendants include the
+	// later commits on the same branch and the commits of branches forked
+	// off of commit.
+	CancelCommit(commit *pfs.Commit) error
 	// Squash merges the content of fromCommits into toCommit, which should be an // open commit.
 	SquashCommit(fromCommits []*pfs.Commit, toCommit *pfs.Commit) error
+	// Squash collapses the commits on one branch from fromCommit to toCommit,
+	// inclusive, into a single new commit on targetBranch, and returns the new
+	// commit.  Files that end up deleted within the range don't appear in the
+	// new commit.
+	Squash(repo *pfs.Repo, fromCommit string, toCommit string, targetBranch string) (*pfs.Commit, error)
 	// Replay replays fromCommits onto toBranch
 	ReplayCommit(fromCommits []*pfs.Commit, toBranch string) ([]*pfs.Commit, error)
 	ArchiveCommit(commit []*pfs.Commit) error
+	// UnarchiveCommit reverses ArchiveCommit, unarchiving commit along with
+	// the commits that have any of commit as provenance.  Those commits are
+	// unarchived even if they were also archived through other provenance.
+	UnarchiveCommit(commit []*pfs.Commit) error
 	InspectCommit(commit *pfs.Commit) (*pfs.CommitInfo, error)
-	ListCommit(include []*pfs.Commit, exclude []*pfs.Commit, provenance []*pfs.Commit, commitType pfs.CommitType, status pfs.CommitStatus, block bool) ([]*pfs.CommitInfo, error)
+	// InspectCommitWithHead is the same as InspectCommit, except that it
+	// also reports whether the commit is the head of its branch.
+	InspectCommitWithHead(commit *pfs.Commit) (*CommitInfo, error)
+	// InspectCommitWithNumDiffs is the same as InspectCommit, except that it
+	// also counts the diffs in the commit.  IsHead isn't set.
+	InspectCommitWithNumDiffs(commit *pfs.Commit) (*CommitInfo, error)
+	// InspectCommitWithMetadata is the same as InspectCommit, except that it
+	// also returns the description and metadata attached to the commit.
+	InspectCommitWithMetadata(commit *pfs.Commit) (*CommitInfo, error)
+	// InspectAncestorCommit returns the commit n generations before commit,
+	// following parents across branch boundaries, like git's commit~n.  It
+	// returns an ErrCommitNotFound if commit has fewer than n ancestors.
+	InspectAncestorCommit(commit *pfs.Commit, n int) (*pfs.CommitInfo, error)
+	// ListCommit returns the commits that match the arguments.  status
+	// determines which of the archived and cancelled commits are returned
+	// alongside normal commits.  If cancelledOnly is set, only cancelled
+	// commits are returned, and status only determines whether archived ones
+	// are among them.  commitType further restricts the result to finished
+	// or unfinished commits; cancelled commits are always finished.  If
+	// since or until is set, only commits started at or after since, or
+	// before until, are returned.
+	ListCommit(include []*pfs.Commit, exclude []*pfs.Commit, provenance []*pfs.Commit, commitType pfs.CommitType, status pfs.CommitStatus, cancelledOnly bool, since *google_protobuf.Timestamp, until *google_protobuf.Timestamp, block bool) ([]*pfs.CommitInfo, error)
+	// ListCommitOrdered is the same as ListCommit without blocking, except
+	// that the commits are returned in the given order.  Commits that were
+	// started at the same time are ordered by ID, so the result is
+	// deterministic.
+	ListCommitOrdered(include []*pfs.Commit, exclude []*pfs.Commit, provenance []*pfs.Commit, commitType pfs.CommitType, status pfs.CommitStatus, cancelledOnly bool, since *google_protobuf.Timestamp, until *google_protobuf.Timestamp, order CommitOrder) ([]*pfs.CommitInfo, error)
+	// WatchCommit sends the commits that match the arguments of ListCommit
+	// over a channel, first the existing ones and then new ones as they
+	// arrive, until ctx is cancelled.  Each commit is sent once.  The error
+	// channel yields the result of the watch once the commit channel is
+	// closed.
+	WatchCommit(ctx context.Context, include []*pfs.Commit, exclude []*pfs.Commit, provenance []*pfs.Commit, commitType pfs.CommitType, status pfs.CommitStatus) (<-chan *pfs.CommitInfo, <-chan error)
+	// WatchCommitByProvenance is the same as WatchCommit, except that it
+	// sends the finished, non-cancelled commits in repo that have all of
+	// provenance as provenance.  If from is set, from and its ancestors are
+	// skipped, so only commits the caller hasn't seen are sent.
+	WatchCommitByProvenance(ctx context.Context, repo *pfs.Repo, provenance []*pfs.Commit, from *pfs.Commit) (<-chan *pfs.CommitInfo, <-chan error)
 	FlushCommit(fromCommits []*pfs.Commit, toRepos []*pfs.Repo) ([]*pfs.CommitInfo, error)
 	ListBranch(repo *pfs.Repo, status pfs.CommitStatus) ([]string, error)
+	// ListBranchHeads returns the head commits of the branches that
+	// ListBranch returns, ordered by branch name.
+	ListBranchHeads(repo *pfs.Repo, status pfs.CommitStatus) ([]*pfs.CommitInfo, error)
+	// ListAllBranchHeads is the same as ListBranchHeads, except that it
+	// returns the heads of the branches of all repos in a single query,
+	// keyed by repo name.
+	ListAllBranchHeads(status pfs.CommitStatus) (map[string][]*pfs.CommitInfo, error)
+	// CommitGraph returns the commits of repo along with their parent
+	// relationships and the heads of the branches, so that clients don't
+	// have to derive parentage from clocks.
+	CommitGraph(repo *pfs.Repo) (*CommitGraph, error)
+	// ListDescendants returns the commits that can be reached from commit
+	// by following children, including those on branches forked off of the
+	// commit or its descendants.  Parents come before their children.
+	ListDescendants(commit *pfs.Commit) ([]*pfs.CommitInfo, error)
 	DeleteCommit(commit *pfs.Commit) error
+	// RepairDiffs deletes the diffs of repo that belong to no commit, and
+	// returns how many it deleted.  Such diffs are left behind if pachd
+	// crashes while deleting a commit, or if a write races with
+	// DeleteCommit, and would otherwise show up in the next commit that gets
+	// the same clock.
+	RepairDiffs(repo *pfs.Repo) (int, error)
+	// DeleteBranch deletes all commits on a branch.  It fails if other
+	// branches have been forked off of the branch, and returns
+	// ErrCommitNotFound if the branch doesn't exist.
+	DeleteBranch(repo *pfs.Repo, branch string) error
+	// RenameBranch renames a branch.  It fails if newName already exists.
+	RenameBranch(repo *pfs.Repo, oldName string, newName string) error
 
 	PutFile(file *pfs.File, delimiter pfs.Delimiter, reader io.Reader) error
+	// PutFileWithInfo is the same as PutFile, except that it returns the
+	// FileInfo of the file as of the commit it was written to, which saves
+	// calling InspectFile afterwards.
+	PutFileWithInfo(file *pfs.File, delimiter pfs.Delimiter, reader io.Reader) (*pfs.FileInfo, error)
+	// PutFileOverwrite is the same as PutFile, except that the content
+	// replaces the existing content of file rather than being appended to it.
+	PutFileOverwrite(file *pfs.File, delimiter pfs.Delimiter, reader io.Reader) error
+	// PutFileSplit is the same as PutFile, except that the content comes
+	// from several readers, which are uploaded concurrently and concatenated
+	// in order.
+	PutFileSplit(file *pfs.File, delimiter pfs.Delimiter, readers []io.Reader) error
+	// PutFiles is the same as calling PutFile for each of files in order,
+	// except that the content of all files is written to commit in a single
+	// write.  Several requests may write to the same path, in which case
+	// their content is concatenated in order.
+	PutFiles(commit *pfs.Commit, files []*PutFileRequest) error
+	// PutFileHandle is the same as PutFile, except that the content is
+	// staged under handle instead of being written to the commit.  Staged
+	// content becomes visible, all at once, when CommitFileHandle is called
+	// with the same handle.  Content staged under a handle is discarded by
+	// AbortFileHandle and when the commit is finished.  Staged content is
+	// kept in memory by the driver, so it's also lost if the driver
+	// restarts, and all the calls for a handle must go through the same
+	// driver.
+	PutFileHandle(file *pfs.File, handle string, delimiter pfs.Delimiter, reader io.Reader) error
+	// CommitFileHandle atomically writes the content staged under handle to
+	// commit.  It returns an ErrHandleNotFound if nothing is staged under
+	// handle, e.g. because the handle was already committed or aborted, or
+	// because it was written through another driver.
+	CommitFileHandle(commit *pfs.Commit, handle string) error
+	// AbortFileHandle discards the content staged under handle.
+	AbortFileHandle(commit *pfs.Commit, handle string) error
 	MakeDirectory(file *pfs.File) error
+	// CopyFile copies src to dst, which must be in an open commit, possibly
+	// of another repo.  The copy refers to the blocks of src, so no content
+	// is uploaded.  Like PutFileOverwrite, the copy replaces the content of
+	// dst.  If src is a directory, the regular files under it are copied
+	// under dst; empty directories under it aren't copied.
+	CopyFile(src *pfs.File, dst *pfs.File) error
+	// MoveFile renames src to dst within an open commit, without uploading
+	// any content.  If src is a directory, the regular files under it are
+	// moved under dst.  If it fails after dst has been written, src may be
+	// partially deleted, and retrying the move finishes it.
+	MoveFile(src *pfs.File, dst *pfs.File) error
+	// GetFile returns a reader for the content of file.  If concatDir is set
+	// and file is a directory, the reader returns the concatenated content of
+	// the regular files directly under it, in path order.
 	GetFile(file *pfs.File, filterShard *pfs.Shard, offset int64,
-		size int64, diffMethod *pfs.DiffMethod) (io.ReadCloser, error)
+		size int64, diffMethod *pfs.DiffMethod, concatDir bool) (io.ReadCloser, error)
+	// GetFiles returns a reader for each regular file in commit whose path
+	// matches glob, keyed by path.  In glob, "*" matches within a single path
+	// component and "**" matches any number of path components.
+	GetFiles(commit *pfs.Commit, glob string, filterShard *pfs.Shard) (map[string]io.ReadCloser, error)
+	// GetFileBlockRefs returns the blockrefs that back a regular file, after
+	// applying filterShard, without reading the blocks themselves.
+	GetFileBlockRefs(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) ([]*persist.BlockRef, error)
+	// GetFileReaderAt returns an io.ReaderAt for the content of a regular
+	// file, after applying filterShard.  ReadAt only fetches the blocks that
+	// cover the requested range, and it's safe for concurrent use.
+	GetFileReaderAt(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) (io.ReaderAt, error)
 	InspectFile(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) (*pfs.FileInfo, error)
-	ListFile(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod, mode ListFileMode) ([]*pfs.FileInfo, error)
+	// InspectFileWithNumChildren is the same as InspectFile, except that the
+	// children of a directory are counted rather than listed.
+	InspectFileWithNumChildren(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) (*FileInfo, error)
+	// InspectFileWithRecursiveSize is the same as InspectFile, except that the
+	// size of a directory is the total size of the files under it, at any
+	// depth.
+	InspectFileWithRecursiveSize(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) (*pfs.FileInfo, error)
+	// GetBlockByHash returns a reader for size bytes of the block with the
+	// given hash, starting at offset; a size of 0 reads until the end of the
+	// block.  Blocks are checked and cached the same way as when files are
+	// read.  Closing the reader cancels the fetch.
+	GetBlockByHash(hash string, offset uint64, size uint64) (io.ReadCloser, error)
+	// GetFileType returns the type of a file, which is cheaper than
+	// InspectFile since the children of a directory aren't listed.
+	GetFileType(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod) (pfs.FileType, error)
+	// DiffFile reports how the file at file.Path changed from fromCommit to
+	// toCommit.  Directories are only compared by type, not by content.
+	DiffFile(file *pfs.File, fromCommit *pfs.Commit, toCommit *pfs.Commit) (*FileChange, error)
+	// OpenFile returns the metadata and content of a regular file, resolving
+	// the file only once.
+	OpenFile(file *pfs.File) (*FileHandle, error)
+	// ListFile lists the children of a directory, ordered by path.  offset and
+	// limit select a page of the children; non-positive values are ignored.
+	// If filterShard is set, only the children in the shard are listed, and
+	// the page is selected among them.
+	ListFile(file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod, mode ListFileMode, offset int, limit int) ([]*pfs.FileInfo, error)
+	// ListFileStream is the same as ListFile, except that the FileInfos are
+	// sent over a channel as they are read from the database.  The channel is
+	// closed once all FileInfos have been sent, after which the error channel
+	// yields the result of the listing.  Callers that stop reading early must
+	// cancel ctx, which closes the underlying cursor; the error channel then
+	// yields ctx's error.
+	ListFileStream(ctx context.Context, file *pfs.File, filterShard *pfs.Shard, diffMethod *pfs.DiffMethod, mode ListFileMode) (<-chan *pfs.FileInfo, <-chan error)
 	DeleteFile(file *pfs.File) error
+	// DeleteFiles deletes the files and directories in an open commit whose
+	// paths match glob, as in GetFiles, along with everything under the
+	// matching directories.  The glob is evaluated against the paths that
+	// exist as of the commit.
+	DeleteFiles(commit *pfs.Commit, glob string) error
+	// ReconcileCommitSize recomputes the size of commit from its diffs,
+	// stores it, and returns it.  The size of a commit is normally maintained
+	// as files are written, so this is only needed to repair drift.
+	ReconcileCommitSize(commit *pfs.Commit) (uint64, error)
+	// ListCommitDiffs returns the diffs authored in commit, ordered by path.
+	// Unlike ListFile, the diffs are not folded with the commit's ancestors.
+	ListCommitDiffs(commit *pfs.Commit) ([]*DiffInfo, error)
+	// FileHistory returns the state of file after each commit that changed
+	// it, oldest first, from the commit after from up to file.Commit, or
+	// from the beginning of the repo if from is nil.  A commit that deleted
+	// the file has a FileInfo of type FILE_TYPE_NONE.
+	FileHistory(file *pfs.File, from *pfs.Commit) ([]*pfs.FileInfo, error)
+	// ListAllRepoFiles returns every file path that has ever existed in repo,
+	// mapped to the IDs of the commits that wrote to it.
+	ListAllRepoFiles(repo *pfs.Repo) (map[string][]string, error)
 
 	DeleteAll() error
 	ArchiveAll() error
@@ -41,7 +41,7 @@ func TestMain(m *testing.M) {
 	code := m.Run()
 	if code == 0 {
 		for _, name := range testDBs {
-			if err := persist.RemoveDB(RethinkAddress, name); err != nil {
+			if err := persist.RemoveDB(RethinkAddress, name, "", 0, 0); err != nil {
 				panic(err)
 			}
 		}
@@ -868,10 +868,10 @@ func testFuse(
 	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
 	testDBs = append(testDBs, dbName)
 
-	if err := persist.InitDB(RethinkAddress, dbName); err != nil {
+	if err := persist.InitDB(RethinkAddress, dbName, "", 0, 0); err != nil {
 		panic(err)
 	}
-	driver, err := persist.NewDriver(localAddress, RethinkAddress, dbName)
+	driver, err := persist.NewDriver(localAddress, RethinkAddress, dbName, nil)
 	require.NoError(t, err)
 
 	apiServer := server.NewAPIServer(driver, nil)
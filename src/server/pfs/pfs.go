@@ -2,6 +2,7 @@ package pfs
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/pachyderm/pachyderm/src/client/pfs"
 )
@@ -36,6 +37,59 @@ type ErrParentCommitNotFound struct {
 	error
 }
 
+// ErrFileTypeConflict represents an error where a path is written as one
+// type of file while it already exists as another, e.g. when writing a
+// regular file where there's a directory.
+type ErrFileTypeConflict struct {
+	Path          string
+	ExistingType  pfs.FileType
+	AttemptedType pfs.FileType
+}
+
+func (e *ErrFileTypeConflict) Error() string {
+	return fmt.Sprintf("file type conflict: %v is of type %v but is being written as type %v", e.Path, e.ExistingType, e.AttemptedType)
+}
+
+// ErrInvalidCommitID represents an error where a commit ID can't be parsed.
+type ErrInvalidCommitID struct {
+	error
+}
+
+// ErrInvalidShard represents an error where a shard filter is out of bounds.
+type ErrInvalidShard struct {
+	error
+}
+
+// ErrRangeOutOfBounds represents an error where a read starts past the end
+// of a file.
+type ErrRangeOutOfBounds struct {
+	error
+}
+
+// ErrInvalidDelimiter represents an error where a delimiter isn't one of
+// the values of pfs.Delimiter.
+type ErrInvalidDelimiter struct {
+	error
+}
+
+// ErrBlockCorrupted represents an error where the content of a block doesn't
+// match its hash.
+type ErrBlockCorrupted struct {
+	error
+}
+
+// ErrWriteTimeout represents an error where a write to the database didn't
+// complete in time.
+type ErrWriteTimeout struct {
+	error
+}
+
+// ErrHandleNotFound represents an error where nothing is staged under a file
+// handle.
+type ErrHandleNotFound struct {
+	error
+}
+
 // NewErrFileNotFound creates a new ErrFileNotFound.
 func NewErrFileNotFound(file string, repo string, commitID string) *ErrFileNotFound {
 	return &ErrFileNotFound{
@@ -78,6 +132,67 @@ func NewErrParentCommitNotFound(repo string, commitID string) *ErrParentCommitNo
 	}
 }
 
+// NewErrFileTypeConflict creates a new ErrFileTypeConflict.
+func NewErrFileTypeConflict(path string, existingType pfs.FileType, attemptedType pfs.FileType) *ErrFileTypeConflict {
+	return &ErrFileTypeConflict{
+		Path:          path,
+		ExistingType:  existingType,
+		AttemptedType: attemptedType,
+	}
+}
+
+// NewErrInvalidCommitID creates a new ErrInvalidCommitID.  reason explains
+// what's wrong with the commit ID.
+func NewErrInvalidCommitID(commitID string, reason string) *ErrInvalidCommitID {
+	return &ErrInvalidCommitID{
+		error: fmt.Errorf("invalid commit ID %v: %v", commitID, reason),
+	}
+}
+
+// NewErrInvalidShard creates a new ErrInvalidShard.  reason explains what's
+// wrong with the shard.
+func NewErrInvalidShard(shard *pfs.Shard, reason string) *ErrInvalidShard {
+	return &ErrInvalidShard{
+		error: fmt.Errorf("invalid shard %v: %v", shard, reason),
+	}
+}
+
+// NewErrRangeOutOfBounds creates a new ErrRangeOutOfBounds.
+func NewErrRangeOutOfBounds(file string, offset int64, size uint64) *ErrRangeOutOfBounds {
+	return &ErrRangeOutOfBounds{
+		error: fmt.Errorf("range out of bounds: offset %v is past the end of file %v, which is %v bytes long", offset, file, size),
+	}
+}
+
+// NewErrInvalidDelimiter creates a new ErrInvalidDelimiter.
+func NewErrInvalidDelimiter(delimiter pfs.Delimiter) *ErrInvalidDelimiter {
+	return &ErrInvalidDelimiter{
+		error: fmt.Errorf("invalid delimiter %d", delimiter),
+	}
+}
+
+// NewErrBlockCorrupted creates a new ErrBlockCorrupted.  actualHash is the
+// hash of the content that was read.
+func NewErrBlockCorrupted(hash string, actualHash string) *ErrBlockCorrupted {
+	return &ErrBlockCorrupted{
+		error: fmt.Errorf("block %v is corrupted: its content hashes to %v", hash, actualHash),
+	}
+}
+
+// NewErrWriteTimeout creates a new ErrWriteTimeout.
+func NewErrWriteTimeout(timeout time.Duration) *ErrWriteTimeout {
+	return &ErrWriteTimeout{
+		error: fmt.Errorf("database write timed out after %v; it may still be applied", timeout),
+	}
+}
+
+// NewErrHandleNotFound creates a new ErrHandleNotFound.
+func NewErrHandleNotFound(handle string, repo string, commitID string) *ErrHandleNotFound {
+	return &ErrHandleNotFound{
+		error: fmt.Errorf("nothing is staged under file handle %v in repo %v at commit %v", handle, repo, commitID),
+	}
+}
+
 // ByteRangeSize returns byteRange.Upper - byteRange.Lower.
 func ByteRangeSize(byteRange *pfs.ByteRange) uint64 {
 	return byteRange.Upper - byteRange.Lower
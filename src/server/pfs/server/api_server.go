@@ -118,7 +118,7 @@ func (a *apiServer) FinishCommit(ctx context.Context, request *pfs.FinishCommitR
 	metricsFn := metrics.ReportUserAction(ctx, a.reporter, "FinishCommit")
 	defer func(start time.Time) { metricsFn(start, retErr) }(time.Now())
 
-	if err := a.driver.FinishCommit(request.Commit, request.Cancel); err != nil {
+	if err := a.driver.FinishCommitContext(ctx, request.Commit, request.Cancel); err != nil {
 		return nil, err
 	}
 	return google_protobuf.EmptyInstance, nil
@@ -148,7 +148,7 @@ func (a *apiServer) ListCommit(ctx context.Context, request *pfs.ListCommitReque
 	metricsFn := metrics.ReportUserAction(ctx, a.reporter, "ListCommit")
 	defer func(start time.Time) { metricsFn(start, retErr) }(time.Now())
 
-	commitInfos, err := a.driver.ListCommit(request.Include, request.Exclude, request.Provenance, request.CommitType, request.Status, request.Block)
+	commitInfos, err := a.driver.ListCommit(request.Include, request.Exclude, request.Provenance, request.CommitType, request.Status, false, nil, nil, request.Block)
 	if err != nil {
 		return nil, err
 	}
@@ -326,7 +326,7 @@ func (a *apiServer) putFileObj(objClient obj.Client, request *pfs.PutFileRequest
 
 func (a *apiServer) GetFile(request *pfs.GetFileRequest, apiGetFileServer pfs.API_GetFileServer) (retErr error) {
 	func() { a.Log(request, nil, nil, 0) }()
-	file, err := a.driver.GetFile(request.File, request.Shard, request.OffsetBytes, request.SizeBytes, request.DiffMethod)
+	file, err := a.driver.GetFile(request.File, request.Shard, request.OffsetBytes, request.SizeBytes, request.DiffMethod, false)
 	if err != nil {
 		return err
 	}
@@ -361,7 +361,7 @@ func (a *apiServer) ListFile(ctx context.Context, request *pfs.ListFileRequest)
 		mode = drive.ListFileRECURSE
 	}
 	fileInfos, err := a.driver.ListFile(request.File, request.Shard,
-		request.DiffMethod, mode)
+		request.DiffMethod, mode, 0, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	pfsclient "github.com/pachyderm/pachyderm/src/client/pfs"
+	pfsserver "github.com/pachyderm/pachyderm/src/server/pfs"
 	"go.pedge.io/pb/go/google/protobuf"
 	"go.pedge.io/proto/rpclog"
 	"go.pedge.io/proto/stream"
@@ -69,7 +70,7 @@ func (s *localBlockAPIServer) PutBlock(putBlockServer pfsclient.BlockAPI_PutBloc
 			return err
 		}
 		result.BlockRef = append(result.BlockRef, blockRef)
-		if (blockRef.Range.Upper - blockRef.Range.Lower) < uint64(blockSize) {
+		if (blockRef.Range.Upper - blockRef.Range.Lower) < uint64(pfsserver.BlockSize) {
 			break
 		}
 	}
@@ -149,53 +150,8 @@ func (s *localBlockAPIServer) diffDir() string {
 	return filepath.Join(s.dir, "diff")
 }
 
-func readBlock(delimiter pfsclient.Delimiter, reader *bufio.Reader, decoder *json.Decoder) (*pfsclient.BlockRef, []byte, error) {
-	var buffer bytes.Buffer
-	var bytesWritten int
-	hash := newHash()
-	EOF := false
-	var value []byte
-
-	for !EOF {
-		var err error
-		if delimiter == pfsclient.Delimiter_JSON {
-			var jsonValue json.RawMessage
-			err = decoder.Decode(&jsonValue)
-			value = jsonValue
-		} else if delimiter == pfsclient.Delimiter_NONE {
-			value = make([]byte, 1000)
-			n, e := reader.Read(value)
-			err = e
-			value = value[:n]
-		} else {
-			value, err = reader.ReadBytes('\n')
-		}
-		if err != nil {
-			if err == io.EOF {
-				EOF = true
-			} else {
-				return nil, nil, err
-			}
-		}
-		buffer.Write(value)
-		hash.Write(value)
-		bytesWritten += len(value)
-		if bytesWritten > blockSize && delimiter != pfsclient.Delimiter_NONE {
-			break
-		}
-	}
-
-	return &pfsclient.BlockRef{
-		Block: getBlock(hash),
-		Range: &pfsclient.ByteRange{
-			Lower: 0,
-			Upper: uint64(buffer.Len()),
-		},
-	}, buffer.Bytes(), nil
-}
-
 func (s *localBlockAPIServer) putOneBlock(delimiter pfsclient.Delimiter, reader *bufio.Reader, decoder *json.Decoder) (*pfsclient.BlockRef, error) {
-	blockRef, data, err := readBlock(delimiter, reader, decoder)
+	blockRef, data, err := pfsserver.ReadBlock(delimiter, reader, decoder)
 	if err != nil {
 		return nil, err
 	}
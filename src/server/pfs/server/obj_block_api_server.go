@@ -19,6 +19,7 @@ import (
 	"github.com/golang/groupcache"
 	"github.com/pachyderm/pachyderm/src/client"
 	pfsclient "github.com/pachyderm/pachyderm/src/client/pfs"
+	pfsserver "github.com/pachyderm/pachyderm/src/server/pfs"
 	"github.com/pachyderm/pachyderm/src/server/pkg/obj"
 )
 
@@ -116,7 +117,7 @@ func (s *objBlockAPIServer) PutBlock(putBlockServer pfsclient.BlockAPI_PutBlockS
 	var eg errgroup.Group
 	decoder := json.NewDecoder(reader)
 	for {
-		blockRef, data, err := readBlock(putBlockRequest.Delimiter, reader, decoder)
+		blockRef, data, err := pfsserver.ReadBlock(putBlockRequest.Delimiter, reader, decoder)
 		if err != nil {
 			return err
 		}
@@ -155,7 +156,7 @@ func (s *objBlockAPIServer) PutBlock(putBlockServer pfsclient.BlockAPI_PutBlockS
 			})
 			return
 		})
-		if (blockRef.Range.Upper - blockRef.Range.Lower) < uint64(blockSize) {
+		if (blockRef.Range.Upper - blockRef.Range.Lower) < uint64(pfsserver.BlockSize) {
 			break
 		}
 	}
@@ -202,7 +203,15 @@ func (s *objBlockAPIServer) DeleteBlock(ctx context.Context, request *pfsclient.
 
 func (s *objBlockAPIServer) InspectBlock(ctx context.Context, request *pfsclient.InspectBlockRequest) (response *pfsclient.BlockInfo, retErr error) {
 	func() { s.Log(nil, nil, nil, 0) }()
-	return nil, fmt.Errorf("not implemented")
+	defer func(start time.Time) { s.Log(request, response, retErr, time.Since(start)) }(time.Now())
+	// Only the existence of the block is reported; the object store isn't
+	// asked for its size or creation time.
+	if !s.objClient.Exists(s.localServer.blockPath(request.Block)) {
+		return nil, fmt.Errorf("block %s not found", request.Block.Hash)
+	}
+	return &pfsclient.BlockInfo{
+		Block: request.Block,
+	}, nil
 }
 
 func (s *objBlockAPIServer) ListBlock(ctx context.Context, request *pfsclient.ListBlockRequest) (response *pfsclient.BlockInfos, retErr error) {
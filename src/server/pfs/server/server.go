@@ -7,10 +7,6 @@ import (
 	"github.com/pachyderm/pachyderm/src/server/pkg/obj"
 )
 
-var (
-	blockSize = 8 * 1024 * 1024 // 8 Megabytes
-)
-
 // Valid backends
 const (
 	AmazonBackendEnvVar    = "AMAZON"
@@ -50,7 +50,7 @@ func TestMain(m *testing.M) {
 	/*
 		if code == 0 {
 			for _, name := range testDBs {
-				if err := persist.RemoveDB(RethinkAddress, name); err != nil {
+				if err := persist.RemoveDB(RethinkAddress, name, "", 0, 0); err != nil {
 					panic(err)
 				}
 			}
@@ -910,8 +910,12 @@ func TestOffsetRead(t *testing.T) {
 	require.NoError(t, err)
 	require.NoError(t, client.FinishCommit(repo, "master"))
 	var buffer bytes.Buffer
-	require.NoError(t, client.GetFile(repo, "master", "foo", int64(len(fileData)*2)+1, 0, "", false, nil, &buffer))
+	require.NoError(t, client.GetFile(repo, "master", "foo", int64(len(fileData)*2), 0, "", false, nil, &buffer))
 	require.Equal(t, "", buffer.String())
+	require.NoError(t, client.GetFile(repo, "master", "foo", int64(len(fileData)), 100, "", false, nil, &buffer))
+	require.Equal(t, fileData, buffer.String())
+	// Reading past the end of the file is an error
+	require.YesError(t, client.GetFile(repo, "master", "foo", int64(len(fileData)*2)+1, 0, "", false, nil, &buffer))
 }
 
 // FinishCommit should block until the parent has been finished
@@ -1546,7 +1550,7 @@ func TestScrubbedErrorStrings(t *testing.T) {
 	client := getClient(t)
 
 	err := client.CreateRepo("foo||@&#$TYX")
-	require.Equal(t, "repo name (foo||@&#$TYX) invalid: only alphanumeric and underscore characters allowed", err.Error())
+	require.Equal(t, "repo name (foo||@&#$TYX) invalid: only alphanumeric, underscore, hyphen and dot characters allowed, and the name cannot start with a dot", err.Error())
 
 	_, err = client.StartCommit("zzzzz", "master")
 	require.Equal(t, "repo zzzzz not found", err.Error())
@@ -3461,7 +3465,7 @@ func getClient(t *testing.T) pclient.APIClient {
 	dbName := "pachyderm_test_" + uuid.NewWithoutDashes()[0:12]
 	testDBs = append(testDBs, dbName)
 
-	if err := persist.InitDB(RethinkAddress, dbName); err != nil {
+	if err := persist.InitDB(RethinkAddress, dbName, "", 0, 0); err != nil {
 		panic(err)
 	}
 
@@ -3477,7 +3481,7 @@ func getClient(t *testing.T) pclient.APIClient {
 	}
 	for i, port := range ports {
 		address := addresses[i]
-		driver, err := persist.NewDriver(address, RethinkAddress, dbName)
+		driver, err := persist.NewDriver(address, RethinkAddress, dbName, nil)
 		require.NoError(t, err)
 		blockAPIServer, err := NewLocalBlockAPIServer(root)
 		require.NoError(t, err)